@@ -3,13 +3,15 @@ package libdisco
 // This file implements a net.Conn interface over Disco.
 // Most of this code was either taken directly or inspired from Go's crypto/tls package.
 import (
+	"bytes"
+	"context"
 	"crypto"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"io/ioutil"
 	"net"
-	"time"
+	"strconv"
 
 	"golang.org/x/crypto/ed25519"
 
@@ -65,10 +67,10 @@ func (l *Listener) AcceptDisco() (*Conn, error) {
 func Listen(network, laddr string, config *Config) (net.Listener, error) {
 	// check Config
 	if config == nil {
-		return nil, errors.New("Disco: no Config set")
+		return nil, ErrNoConfig
 	}
 	if err := checkRequirements(false, config); err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// make net.Conn listen
@@ -90,10 +92,10 @@ func Listen(network, laddr string, config *Config) (net.Listener, error) {
 func ListenDisco(network, laddr string, config *Config) (*Listener, error) {
 	// check Config
 	if config == nil {
-		return nil, errors.New("Disco: no Config set")
+		return nil, ErrNoConfig
 	}
 	if err := checkRequirements(false, config); err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// make net.Conn listen
@@ -109,36 +111,113 @@ func ListenDisco(network, laddr string, config *Config) (*Listener, error) {
 	return discoListener, nil
 }
 
-type timeoutError struct{}
+// ListenPatterns creates a Disco listener accepting connections on the
+// given network address using net.Listen, for clients using any of the
+// configurations. This allows a single listener to serve clients migrating
+// from one handshake pattern to another.
+// It relies on the DiscoSocket negotiation (see Config.DiscoSocket): clients
+// must set DiscoSocket, and the server uses for each connection the configuration
+// whose protocol name is the negotiation data sent by the client (by default
+// the client's protocol name). Other clients are rejected.
+func ListenPatterns(network, laddr string, configs ...*Config) (*Listener, error) {
+	config, err := negotiatePatterns(configs)
+	if err != nil {
+		return nil, err
+	}
+
+	// make net.Conn listen
+	l, err := net.Listen(network, laddr)
+	if err != nil {
+		return nil, err
+	}
 
-func (timeoutError) Error() string   { return "Disco: DialWithDialer timed out" }
-func (timeoutError) Timeout() bool   { return true }
-func (timeoutError) Temporary() bool { return true }
+	// create new libdisco.listener
+	discoListener := new(Listener)
+	discoListener.Listener = l
+	discoListener.config = config
+	return discoListener, nil
+}
+
+// negotiatePatterns returns a server configuration picking one of the
+// configurations with the DiscoSocket negotiation (see ListenPatterns)
+func negotiatePatterns(configs []*Config) (*Config, error) {
+	if len(configs) == 0 {
+		return nil, ErrNoConfig
+	}
+	protocols := make(map[string]*Config)
+	for _, config := range configs {
+		if config == nil {
+			return nil, ErrNoConfig
+		}
+		negotiated := *config
+		negotiated.DiscoSocket = true
+		if err := checkRequirements(false, &negotiated); err != nil {
+			return nil, err
+		}
+		protocolName, _ := negotiated.ProtocolName()
+		if _, ok := protocols[protocolName]; ok {
+			return nil, errors.New("disco: several configurations use the protocol " + protocolName)
+		}
+		protocols[protocolName] = &negotiated
+	}
+	return &Config{
+		DiscoSocket: true,
+		Negotiate: func(negotiationData []byte) Negotiation {
+			if config, ok := protocols[string(negotiationData)]; ok {
+				return Negotiation{Config: config}
+			}
+			return Negotiation{Reject: true, Reason: "unsupported protocol"}
+		},
+	}, nil
+}
 
 // this functions checks if at some point in the protocol
 // the peer needs to verify the other peer static public key
 // and if the peer needs to provide a proof for its static public key
-var errNoPubkeyVerifier = errors.New("Disco: no public key verifier set in Config")
-var errNoProof = errors.New("Disco: no public key proof set in Config")
-
 func checkRequirements(isClient bool, config *Config) (err error) {
-	ht := config.HandshakePattern
-	if ht == NoiseNX || ht == NoiseKX || ht == NoiseXX || ht == NoiseIX {
-		if isClient && config.PublicKeyVerifier == nil {
-			return errNoPubkeyVerifier
-		} else if !isClient && config.StaticPublicKeyProof == nil {
-			return errNoProof
+	pattern, err := getPattern(config.HandshakePattern)
+	if err != nil {
+		return err
+	}
+	if err := config.CipherSuite.check(); err != nil {
+		return err
+	}
+	if config.NoisePipes && config.DiscoSocket {
+		return errors.New("disco: Noise Pipes cannot be used with DiscoSocket")
+	}
+	if config.NoisePipes && (config.ServerName != "" || config.GetConfigForClient != nil) {
+		return errors.New("disco: Noise Pipes cannot be used with server names")
+	}
+	if config.NoisePipes {
+		// both peers might send and receive a static key in XX or XXfallback
+		if config.HandshakePattern != NoiseIK {
+			return newError(ErrUnknownPattern, "disco: Noise Pipes can only be used with the NoiseIK handshake pattern")
+		}
+		if !config.hasVerifier() {
+			return ErrNoVerifier
+		}
+		if config.StaticPublicKeyProof == nil && config.GetKeyPair == nil {
+			return ErrNoProof
+		}
+	}
+	// the server transmits its static key during the handshake
+	if pattern.sendsStatic(false) {
+		if isClient && !config.hasVerifier() {
+			return ErrNoVerifier
+		} else if !isClient && config.StaticPublicKeyProof == nil && config.GetKeyPair == nil {
+			return ErrNoProof
 		}
 	}
-	if ht == NoiseXN || ht == NoiseXK || ht == NoiseXX || ht == NoiseX || ht == NoiseIN || ht == NoiseIK || ht == NoiseIX {
-		if isClient && config.StaticPublicKeyProof == nil {
-			return errNoProof
-		} else if !isClient && config.PublicKeyVerifier == nil {
-			return errNoPubkeyVerifier
+	// the client transmits its static key during the handshake
+	if pattern.sendsStatic(true) {
+		if isClient && config.StaticPublicKeyProof == nil && config.GetKeyPair == nil {
+			return ErrNoProof
+		} else if !isClient && !config.hasVerifier() {
+			return ErrNoVerifier
 		}
 	}
-	if ht == NoiseNNpsk2 && len(config.PreSharedKey) != 32 {
-		return errors.New("noise: a 32-byte pre-shared key needs to be passed as noise.Config")
+	if config.HandshakePattern.hasPSK() && len(config.PreSharedKey) != 32 {
+		return ErrInvalidPSK
 	}
 	return nil
 }
@@ -152,66 +231,48 @@ func checkRequirements(isClient bool, config *Config) (err error) {
 // configuration; see the documentation of Config for the defaults.
 // TODO: make sure sane defaults for time outs are set!!!
 func DialWithDialer(dialer *net.Dialer, network, addr string, config *Config) (net.Conn, error) {
+	c, err := dial(context.Background(), dialer, network, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func dial(ctx context.Context, netDialer *net.Dialer, network, addr string, config *Config) (*Conn, error) {
 	// We want the Timeout and Deadline values from dialer to cover the
-	// whole process: TCP connection and Disco handshake. This means that we
-	// also need to start our own timers now.
-	timeout := dialer.Timeout
-
-	if !dialer.Deadline.IsZero() {
-		deadlineTimeout := time.Until(dialer.Deadline)
-		if timeout == 0 || deadlineTimeout < timeout {
-			timeout = deadlineTimeout
-		}
+	// whole process: TCP connection and Disco handshake.
+	if netDialer.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, netDialer.Timeout)
+		defer cancel()
+	}
+
+	if !netDialer.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, netDialer.Deadline)
+		defer cancel()
 	}
 
 	// check Config
 	if config == nil {
-		panic("Disco: no Config set")
+		return nil, ErrNoConfig
 	}
 
 	if err := checkRequirements(true, config); err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// Dial the net.Conn first
-	var errChannel chan error
-
-	if timeout != 0 {
-		errChannel = make(chan error, 2)
-		time.AfterFunc(timeout, func() {
-			errChannel <- timeoutError{}
-		})
-	}
-
-	rawConn, err := dialer.Dial(network, addr)
+	rawConn, err := netDialer.DialContext(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: use the following code to implement some sort of SNI extension?
-	/*
-		colonPos := strings.LastIndex(addr, ":")
-		if colonPos == -1 {
-			colonPos = len(addr)
-		}
-		hostname := addr[:colonPos]
-	*/
-
 	// Create the libdisco.Conn
 	conn := Client(rawConn, config)
 
 	// Do the handshake
-	if timeout == 0 {
-		err = conn.Handshake()
-	} else {
-		go func() {
-			errChannel <- conn.Handshake()
-		}()
-
-		err = <-errChannel
-	}
-
-	if err != nil {
+	if err := conn.HandshakeContext(ctx); err != nil {
 		rawConn.Close()
 		return nil, err
 	}
@@ -229,6 +290,54 @@ func Dial(network, addr string, config *Config) (net.Conn, error) {
 	return DialWithDialer(new(net.Dialer), network, addr, config)
 }
 
+// DialContext connects to the given network address and then initiates a
+// Disco handshake, returning the resulting Disco connection.
+// If the context expires or is cancelled before the handshake completes,
+// the connection attempt is aborted and the underlying connection is closed.
+// Once the connection is returned, the context does not affect it anymore.
+func DialContext(ctx context.Context, network, addr string, config *Config) (net.Conn, error) {
+	c, err := dial(ctx, new(net.Dialer), network, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Dialer dials Disco connections given a configuration and a Dialer for the
+// underlying connection.
+type Dialer struct {
+	// NetDialer is the optional dialer to use for the underlying connections.
+	// A nil NetDialer is equivalent to the zero net.Dialer.
+	NetDialer *net.Dialer
+
+	// Config is the Disco configuration to use for new connections.
+	Config *Config
+}
+
+// Dial connects to the given network address and initiates a Disco handshake,
+// returning the resulting Disco connection (of type *Conn).
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the given network address and initiates a Disco handshake,
+// returning the resulting Disco connection (of type *Conn).
+// It can be used as the DialContext function of a net/http.Transport.
+// If the context expires or is cancelled before the handshake completes,
+// the connection attempt is aborted and the underlying connection is closed.
+// Once the connection is returned, the context does not affect it anymore.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	netDialer := d.NetDialer
+	if netDialer == nil {
+		netDialer = new(net.Dialer)
+	}
+	c, err := dial(ctx, netDialer, network, addr, d.Config)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
 //
 // Authentication helpers
 //
@@ -239,8 +348,8 @@ func Dial(network, addr string, config *Config) (net.Conn, error) {
 // point during the handshake
 func CreatePublicKeyVerifier(rootPublicKey ed25519.PublicKey) func([]byte, []byte) bool {
 	return func(publicKey, proof []byte) bool {
-		// ed25519.Verify panics if len(publicKey) is not PublicKeySize. We need to avoid that
-		if len(publicKey) != 32 {
+		// only the public keys of the DH functions are signed
+		if !isPublicKeySize(len(publicKey)) {
 			return false
 		}
 		return ed25519.Verify(rootPublicKey, publicKey, proof)
@@ -250,18 +359,19 @@ func CreatePublicKeyVerifier(rootPublicKey ed25519.PublicKey) func([]byte, []byt
 // CreateStaticPublicKeyProof can be used to create the proof
 // StaticPublicKeyProof sometimes required in a libdisco.Config
 // for peers that are sending their static public key at some
-// point during the handshake
-func CreateStaticPublicKeyProof(rootPrivateKey ed25519.PrivateKey, publicKey []byte) []byte {
-
-	if len(publicKey) != 32 {
-		panic("disco: length of public key passed is incorrect (should be 32)")
+// point during the handshake.
+// It returns an error matching ErrInvalidKey if rootPrivateKey is not an
+// ed25519 private key or if publicKey is not of the size of a DH function's
+// public keys.
+func CreateStaticPublicKeyProof(rootPrivateKey ed25519.PrivateKey, publicKey []byte) ([]byte, error) {
+	if len(rootPrivateKey) != ed25519.PrivateKeySize {
+		return nil, newError(ErrInvalidKey, "disco: the root private key is not an ed25519 private key")
 	}
-
-	signature, err := rootPrivateKey.Sign(rand.Reader, publicKey, crypto.Hash(0))
-	if err != nil {
-		panic("disco: can't create static public key proof")
+	if !isPublicKeySize(len(publicKey)) {
+		return nil, newError(ErrInvalidKey, "disco: the length of the public key does not match any DH function")
 	}
-	return signature
+
+	return rootPrivateKey.Sign(rand.Reader, publicKey, crypto.Hash(0))
 }
 
 //
@@ -330,17 +440,25 @@ func LoadDiscoRootPrivateKey(discoRootPrivateKey string) (rootPrivateKey ed25519
 // and saves it to a file in hexadecimal form. If a non-empty passphrase is passed, the file
 // will be encrypted. You can use ExportPublicKey() to export the public key part.
 func GenerateAndSaveDiscoKeyPair(discoKeyPairFile string, passphrase string) (keyPair *KeyPair, err error) {
-	keyPair = GenerateKeypair(nil)
-	var dataToWrite [128]byte
-	hex.Encode(dataToWrite[:64], keyPair.PrivateKey[:])
-	hex.Encode(dataToWrite[64:], keyPair.PublicKey[:])
+	return GenerateAndSaveDiscoKeyPairWithDH(DH25519, discoKeyPairFile, passphrase)
+}
+
+// GenerateAndSaveDiscoKeyPairWithDH works like GenerateAndSaveDiscoKeyPair for
+// the DH function dh. The name of the function is saved along with the keys,
+// the key pair can be loaded with LoadDiscoKeyPairWithDH.
+func GenerateAndSaveDiscoKeyPairWithDH(dh DHFunction, discoKeyPairFile string, passphrase string) (keyPair *KeyPair, err error) {
+	if keyPair, err = dh.GenerateKeypair(nil); err != nil {
+		return nil, err
+	}
+	// name of the DH function, private key, public key
+	dataToWrite := []byte(dh.String() + ":" + hex.EncodeToString(keyPair.PrivateKey) + hex.EncodeToString(keyPair.PublicKey))
 
 	if passphrase != "" {
 		key := argon2.Key([]byte(passphrase), []byte("DiscoKeyPair"), 3, 32*1024, 4, 32)
-		ciphertext := Encrypt(key, dataToWrite[:])
+		ciphertext := Encrypt(key, dataToWrite)
 		err = ioutil.WriteFile(discoKeyPairFile, ciphertext, 0400)
 	} else {
-		err = ioutil.WriteFile(discoKeyPairFile, dataToWrite[:], 0400)
+		err = ioutil.WriteFile(discoKeyPairFile, dataToWrite, 0400)
 	}
 
 	if err != nil {
@@ -349,9 +467,17 @@ func GenerateAndSaveDiscoKeyPair(discoKeyPairFile string, passphrase string) (ke
 	return keyPair, nil
 }
 
-// LoadDiscoKeyPair reads and parses a public/private key pair from a pair
-// of files. You can pass a non-empty passphrase if the keys are stored encrypted.
+// LoadDiscoKeyPair reads and parses a X25519 public/private key pair from a file.
+// You can pass a non-empty passphrase if the keys are stored encrypted.
 func LoadDiscoKeyPair(discoKeyPairFile, passphrase string) (*KeyPair, error) {
+	return LoadDiscoKeyPairWithDH(DH25519, discoKeyPairFile, passphrase)
+}
+
+// LoadDiscoKeyPairWithDH reads and parses a key pair of the DH function dh from
+// a file created by GenerateAndSaveDiscoKeyPairWithDH. It returns an error
+// matching ErrInvalidKey if the key pair was saved for another DH function.
+// You can pass a non-empty passphrase if the keys are stored encrypted.
+func LoadDiscoKeyPairWithDH(dh DHFunction, discoKeyPairFile, passphrase string) (*KeyPair, error) {
 	keyPairString, err := ioutil.ReadFile(discoKeyPairFile)
 	if err != nil {
 		return nil, err
@@ -365,19 +491,35 @@ func LoadDiscoKeyPair(discoKeyPairFile, passphrase string) (*KeyPair, error) {
 		}
 	}
 
-	if len(keyPairString) != 64*2 {
+	// files written by previous versions only contain a X25519 key pair
+	name := DH25519.String()
+	if separator := bytes.IndexByte(keyPairString, ':'); separator >= 0 {
+		name, keyPairString = string(keyPairString[:separator]), keyPairString[separator+1:]
+	}
+	if name != dh.String() {
+		return nil, newError(ErrInvalidKey, "disco: the key pair file contains a key pair for "+strconv.Quote(name)+", not "+strconv.Quote(dh.String()))
+	}
+
+	keySize := dh.DHLen()
+	if len(keyPairString) != 4*keySize {
 		return nil, errors.New("Disco: Disco key pair file is not correctly formated")
 	}
 
-	var keyPair KeyPair
-	_, err = hex.Decode(keyPair.PrivateKey[:], keyPairString[:64])
+	keyPair := KeyPair{PrivateKey: make([]byte, keySize), PublicKey: make([]byte, keySize)}
+	_, err = hex.Decode(keyPair.PrivateKey, keyPairString[:2*keySize])
 	if err != nil {
 		return nil, err
 	}
-	_, err = hex.Decode(keyPair.PublicKey[:], keyPairString[64:])
+	_, err = hex.Decode(keyPair.PublicKey, keyPairString[2*keySize:])
 	if err != nil {
 		return nil, err
 	}
 
+	// the public key must belong to the private key
+	expected, err := dh.GenerateKeypair(keyPair.PrivateKey)
+	if err != nil || !bytes.Equal(expected.PublicKey, keyPair.PublicKey) {
+		return nil, newError(ErrInvalidKey, "disco: the key pair file contains a public key that does not match the private key")
+	}
+
 	return &keyPair, nil
 }
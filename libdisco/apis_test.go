@@ -1,8 +1,17 @@
 package libdisco
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestCreationKeys(t *testing.T) {
@@ -39,6 +48,39 @@ func TestCreationKeys(t *testing.T) {
 			return
 		}
 	}
+	// key pairs of every DH function, in encrypted files
+	for _, dh := range []DHFunction{DH25519, DH448, DHRistretto255} {
+		file := filepath.Join(t.TempDir(), "keyPair"+dh.String())
+		keyPair, err := GenerateAndSaveDiscoKeyPairWithDH(dh, file, "passphrase")
+		if err != nil {
+			t.Fatal("Disco key pair couldn't be written on disk", err)
+		}
+		loaded, err := LoadDiscoKeyPairWithDH(dh, file, "passphrase")
+		if err != nil {
+			t.Fatal("Disco key pair couldn't be loaded from disk", err)
+		}
+		if !bytes.Equal(keyPair.PrivateKey, loaded.PrivateKey) || !bytes.Equal(keyPair.PublicKey, loaded.PublicKey) {
+			t.Fatal("Disco key pair generated and loaded are different", dh)
+		}
+		// the key pair cannot be loaded for another DH function of the same size
+		other := DHRistretto255
+		if dh == DHRistretto255 {
+			other = DH25519
+		}
+		if _, err := LoadDiscoKeyPairWithDH(other, file, "passphrase"); !errors.Is(err, ErrInvalidKey) {
+			t.Fatal("expected ErrInvalidKey", dh, err)
+		}
+	}
+	// key pairs saved by previous versions
+	legacyFile := filepath.Join(t.TempDir(), "legacyKeyPair")
+	legacyKeyPair := GenerateKeypair(nil)
+	if err := ioutil.WriteFile(legacyFile, []byte(hex.EncodeToString(legacyKeyPair.PrivateKey)+hex.EncodeToString(legacyKeyPair.PublicKey)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := LoadDiscoKeyPair(legacyFile, ""); err != nil || !bytes.Equal(loaded.PublicKey, legacyKeyPair.PublicKey) {
+		t.Fatal("cannot load a key pair saved by a previous version", err)
+	}
+
 	// generate root key
 	err = GenerateAndSaveDiscoRootKeyPair(rootPrivateKeyFile, rootPublicKeyFile)
 	if err != nil {
@@ -60,7 +102,15 @@ func TestCreationKeys(t *testing.T) {
 	}
 
 	// create a proof
-	proof := CreateStaticPublicKeyProof(rootPriv, keyPair.PublicKey[:])
+	proof, err := CreateStaticPublicKeyProof(rootPriv, keyPair.PublicKey[:])
+	if err != nil {
+		t.Error("cannot create proof", err)
+		return
+	}
+	if _, err := CreateStaticPublicKeyProof(rootPriv, keyPair.PublicKey[1:]); !errors.Is(err, ErrInvalidKey) {
+		t.Error("expected ErrInvalidKey", err)
+		return
+	}
 
 	// verify the proof
 	verifior := CreatePublicKeyVerifier(rootPub)
@@ -71,3 +121,173 @@ func TestCreationKeys(t *testing.T) {
 
 	// end
 }
+
+func TestDialContext(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseXX)
+
+	// a server that never answers the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+	serverDone := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverDone <- err
+			return
+		}
+		defer conn.Close()
+		// read the first handshake message, then wait for the client to give up
+		_, err = io.Copy(io.Discard, conn)
+		serverDone <- err
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := DialContext(ctx, "tcp", listener.Addr().String(), clientConfig); !errors.Is(err, context.Canceled) {
+		t.Fatal("the handshake should have been cancelled", err)
+	}
+	select {
+	case err := <-serverDone:
+		if err != nil {
+			t.Fatal("the server did not see the connection being closed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client did not close the connection")
+	}
+
+	// a failed dial does not return a non-nil net.Conn holding a nil *Conn
+	if conn, err := DialContext(context.Background(), "tcp", "127.0.0.1:0", clientConfig); err == nil || conn != nil {
+		t.Fatal("a failed dial should return a nil net.Conn", err)
+	}
+	if conn, err := DialWithDialer(new(net.Dialer), "tcp", "127.0.0.1:0", clientConfig); err == nil || conn != nil {
+		t.Fatal("a failed dial should return a nil net.Conn", err)
+	}
+	if conn, err := (&Dialer{Config: clientConfig}).DialContext(context.Background(), "tcp", "127.0.0.1:0"); err == nil || conn != nil {
+		t.Fatal("a failed dial should return a nil net.Conn", err)
+	}
+
+	// the dialer's timeout applies to the handshake
+	dialer := &Dialer{NetDialer: &net.Dialer{Timeout: 100 * time.Millisecond}, Config: clientConfig}
+	if _, err := dialer.DialContext(context.Background(), "tcp", listener.Addr().String()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("the handshake should have timed out", err)
+	}
+
+	// a successful handshake is not affected by the context afterwards
+	discoListener, err := Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer discoListener.Close()
+	go func() {
+		conn, err := discoListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	ctx, cancel = context.WithCancel(context.Background())
+	conn, err := (&Dialer{Config: clientConfig}).DialContext(ctx, "tcp", discoListener.Addr().String())
+	if err != nil {
+		t.Fatal("client can't connect to server", err)
+	}
+	defer conn.Close()
+	cancel()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal("client can't write on socket", err)
+	}
+	var buf [5]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil || string(buf[:]) != "hello" {
+		t.Fatal("client can't read on socket", err)
+	}
+
+	// a handshake interrupted after the last message received by the client does not complete
+	ctx, cancel = context.WithCancel(context.Background())
+	clientConfig, serverConfig = configsForPattern(NoiseNX)
+	interruptedConfig := *clientConfig
+	interruptedConfig.HandshakePayloadReceived = func(messageIndex int, payload []byte) error {
+		cancel()
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	go Server(serverConn, serverConfig).Handshake()
+	client := Client(clientConn, &interruptedConfig)
+	if err := client.HandshakeContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatal("the handshake should have been cancelled", err)
+	}
+	if client.ConnectionState().HandshakeComplete {
+		t.Fatal("an interrupted handshake should not complete")
+	}
+}
+
+func TestListenPatterns(t *testing.T) {
+	patterns := []noiseHandshakeType{NoiseNX, NoiseXX, NoiseIK}
+	var clientConfigs, serverConfigs []*Config
+	for _, pattern := range patterns {
+		clientConfig, serverConfig := configsForPattern(pattern)
+		clientConfig.DiscoSocket = true
+		clientConfigs = append(clientConfigs, clientConfig)
+		serverConfigs = append(serverConfigs, serverConfig)
+	}
+
+	if _, err := ListenPatterns("tcp", "127.0.0.1:0"); !errors.Is(err, ErrNoConfig) {
+		t.Fatal("expected ErrNoConfig", err)
+	}
+	if _, err := ListenPatterns("tcp", "127.0.0.1:0", serverConfigs[0], serverConfigs[0]); err == nil {
+		t.Fatal("the same pattern should not be accepted twice")
+	}
+	listener, err := ListenPatterns("tcp", "127.0.0.1:0", serverConfigs...)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+
+	// the server greets each client with the pattern it used
+	go func() {
+		for {
+			serverConn, err := listener.AcceptDisco()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer serverConn.Close()
+				if err := serverConn.Handshake(); err != nil {
+					return
+				}
+				if _, err := serverConn.Write([]byte(serverConn.ConnectionState().ProtocolName)); err != nil {
+					return
+				}
+				io.Copy(io.Discard, serverConn)
+			}()
+		}
+	}()
+
+	for _, clientConfig := range clientConfigs {
+		clientConn, err := Dial("tcp", listener.Addr().String(), clientConfig)
+		if err != nil {
+			t.Fatal("client can't connect to server", err)
+		}
+		buf := make([]byte, 100)
+		n, err := clientConn.Read(buf)
+		if err != nil {
+			t.Fatal("client can't read", err)
+		}
+		expected, _ := clientConfig.ProtocolName()
+		if string(buf[:n]) != expected {
+			t.Fatal("the server did not use the client's pattern", string(buf[:n]))
+		}
+		clientConn.Close()
+	}
+
+	// patterns that are not configured are rejected
+	clientConfig, _ := configsForPattern(NoiseNK)
+	clientConfig.DiscoSocket = true
+	if _, err := Dial("tcp", listener.Addr().String(), clientConfig); !errors.Is(err, ErrRejected) {
+		t.Fatal("expected ErrRejected", err)
+	}
+}
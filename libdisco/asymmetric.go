@@ -5,44 +5,84 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"strconv"
 
+	"github.com/cloudflare/circl/dh/x448"
 	ristretto "github.com/gtank/ristretto255"
 	"golang.org/x/crypto/curve25519"
 )
 
-// The following code defines the X25519, chacha20poly1305, SHA-256 suite.
 const (
-	dhLen  = 32 // A constant specifying the size in bytes of public keys and DH outputs. For security reasons, dhLen must be 32 or greater.
 	skSize = 32 // a secret key is encoded as a 32 byte array.
 )
 
 // 4.1. DH functions
 
-// TODO: store the KeyPair's parts in *[32]byte or []byte ?
+// DHFunction is a Diffie-Hellman function, as defined in section 4.1 of the
+// Noise specification. DH25519 is used by default, another function can be
+// selected with CipherSuite.DH (the peers must use the same function).
+type DHFunction interface {
+	// GenerateKeypair creates a key pair out of a private key. If privateKey
+	// is nil a random key pair is generated.
+	GenerateKeypair(privateKey []byte) (*KeyPair, error)
+	// DH returns the shared secret of a private key and a public key, or an
+	// error matching ErrInvalidKey if the keys cannot be used.
+	DH(privateKey, publicKey []byte) ([]byte, error)
+	// DHLen returns the size in bytes of public keys and DH outputs,
+	// it must be 32 or greater.
+	DHLen() int
+	// String returns the name of the function in protocol names (for example "25519")
+	String() string
+}
+
+var (
+	// DH25519 is X25519, the default DH function
+	DH25519 DHFunction = dh25519{}
+	// DH448 is X448
+	DH448 DHFunction = dh448{}
+	// DHRistretto255 is a Diffie-Hellman over the ristretto255 group. Private
+	// keys are canonical encodings of scalars.
+	DHRistretto255 DHFunction = dhRistretto255{}
+)
+
+// dhFunctions are the DH functions that can be found in protocol names
+var dhFunctions = map[string]DHFunction{
+	DH25519.String():        DH25519,
+	DH448.String():          DH448,
+	DHRistretto255.String(): DHRistretto255,
+}
+
+// isPublicKeySize returns true if size is the size of the public keys of a DH function
+func isPublicKeySize(size int) bool {
+	for _, function := range dhFunctions {
+		if function.DHLen() == size {
+			return true
+		}
+	}
+	return false
+}
 
-// KeyPair contains a private and a public part, both of 32-byte.
-// It can be generated via the GenerateKeyPair() function.
+// KeyPair contains a private and a public part, their sizes depend on the
+// DH function (32 bytes each for DH25519).
+// It can be generated via the GenerateKeypair() function, or the
+// GenerateKeypair method of a DHFunction.
 // The public part can also be extracted via the ExportPublicKey function.
 type KeyPair struct {
-	PrivateKey [32]byte // must stay a [32]byte because of Serialize()
-	PublicKey  [32]byte // must stay a [32]byte because of Serialize()
+	PrivateKey []byte
+	PublicKey  []byte
 }
 
 // GenerateKeypair creates a X25519 static keyPair out of a private key. If privateKey is nil the function generates a random key pair.
 func GenerateKeypair(privateKey *[32]byte) *KeyPair {
-
-	var keyPair KeyPair
+	var key []byte
 	if privateKey != nil {
-		copy(keyPair.PrivateKey[:], privateKey[:])
-	} else {
-		if _, err := rand.Read(keyPair.PrivateKey[:]); err != nil {
-			panic(err)
-		}
+		key = privateKey[:]
 	}
-
-	curve25519.ScalarBaseMult(&keyPair.PublicKey, &keyPair.PrivateKey)
-
-	return &keyPair
+	keyPair, err := DH25519.GenerateKeypair(key)
+	if err != nil {
+		panic(err)
+	}
+	return keyPair
 }
 
 // ExportPublicKey returns the public part in hex format of a static key pair.
@@ -50,13 +90,132 @@ func (kp KeyPair) ExportPublicKey() string {
 	return hex.EncodeToString(kp.PublicKey[:])
 }
 
-func dh(keyPair KeyPair, publicKey [32]byte) (shared [32]byte) {
+// copy returns a copy of the key pair that does not share its memory with kp
+func (kp KeyPair) copy() KeyPair {
+	return KeyPair{
+		PrivateKey: append([]byte(nil), kp.PrivateKey...),
+		PublicKey:  append([]byte(nil), kp.PublicKey...),
+	}
+}
+
+// randomPrivateKey returns privateKey if it has the expected size, or a random key if it is nil
+func randomPrivateKey(privateKey []byte, size int) ([]byte, error) {
+	if privateKey == nil {
+		privateKey = make([]byte, size)
+		if _, err := rand.Read(privateKey); err != nil {
+			return nil, err
+		}
+		return privateKey, nil
+	}
+	if len(privateKey) != size {
+		return nil, newError(ErrInvalidKey, "disco: the private key should be "+strconv.Itoa(size)+"-byte")
+	}
+	return append([]byte(nil), privateKey...), nil
+}
+
+// checkKeySizes returns an error if the keys passed to a DH function are not of the expected size
+func checkKeySizes(privateKey, publicKey []byte, size int) error {
+	if len(privateKey) != size || len(publicKey) != size {
+		return newError(ErrInvalidKey, "disco: the keys should be "+strconv.Itoa(size)+"-byte")
+	}
+	return nil
+}
+
+type dh25519 struct{}
 
-	curve25519.ScalarMult(&shared, &keyPair.PrivateKey, &publicKey)
+func (dh25519) GenerateKeypair(privateKey []byte) (*KeyPair, error) {
+	var secret, public [32]byte
+	key, err := randomPrivateKey(privateKey, 32)
+	if err != nil {
+		return nil, err
+	}
+	copy(secret[:], key)
+	curve25519.ScalarBaseMult(&public, &secret)
+	return &KeyPair{PrivateKey: key, PublicKey: public[:]}, nil
+}
+
+func (dh25519) DH(privateKey, publicKey []byte) ([]byte, error) {
+	if err := checkKeySizes(privateKey, publicKey, 32); err != nil {
+		return nil, err
+	}
+	var secret, public, shared [32]byte
+	copy(secret[:], privateKey)
+	copy(public[:], publicKey)
+	curve25519.ScalarMult(&shared, &secret, &public)
+	return shared[:], nil
+}
+
+func (dh25519) DHLen() int     { return 32 }
+func (dh25519) String() string { return "25519" }
 
-	return
+type dh448 struct{}
+
+func (dh448) GenerateKeypair(privateKey []byte) (*KeyPair, error) {
+	var secret, public x448.Key
+	key, err := randomPrivateKey(privateKey, x448.Size)
+	if err != nil {
+		return nil, err
+	}
+	copy(secret[:], key)
+	x448.KeyGen(&public, &secret)
+	return &KeyPair{PrivateKey: key, PublicKey: public[:]}, nil
+}
+
+func (dh448) DH(privateKey, publicKey []byte) ([]byte, error) {
+	if err := checkKeySizes(privateKey, publicKey, x448.Size); err != nil {
+		return nil, err
+	}
+	var secret, public, shared x448.Key
+	copy(secret[:], privateKey)
+	copy(public[:], publicKey)
+	if !x448.Shared(&shared, &secret, &public) {
+		return nil, newError(ErrInvalidKey, "disco: the X448 public key is of low order")
+	}
+	return shared[:], nil
 }
 
+func (dh448) DHLen() int     { return x448.Size }
+func (dh448) String() string { return "448" }
+
+type dhRistretto255 struct{}
+
+func (dhRistretto255) GenerateKeypair(privateKey []byte) (*KeyPair, error) {
+	var secret ristretto.Scalar
+	if privateKey == nil {
+		var err error
+		if secret, err = newRandomScalar(); err != nil {
+			return nil, err
+		}
+	} else if len(privateKey) != 32 || secret.Decode(privateKey) != nil {
+		return nil, newError(ErrInvalidKey, "disco: the private key is not a canonical ristretto255 scalar")
+	}
+	var public ristretto.Element
+	public.ScalarBaseMult(&secret)
+	return &KeyPair{PrivateKey: secret.Encode(nil), PublicKey: public.Encode(nil)}, nil
+}
+
+func (dhRistretto255) DH(privateKey, publicKey []byte) ([]byte, error) {
+	if err := checkKeySizes(privateKey, publicKey, 32); err != nil {
+		return nil, err
+	}
+	var secret ristretto.Scalar
+	var public, shared ristretto.Element
+	if secret.Decode(privateKey) != nil {
+		return nil, newError(ErrInvalidKey, "disco: the private key is not a canonical ristretto255 scalar")
+	}
+	if public.Decode(publicKey) != nil {
+		return nil, newError(ErrInvalidKey, "disco: the public key is not a valid ristretto255 element")
+	}
+	shared.ScalarMult(&secret, &public)
+	if shared.Equal(ristretto.NewElement()) == 1 {
+		return nil, newError(ErrInvalidKey, "disco: the ristretto255 shared secret is the identity")
+	}
+	return shared.Encode(nil), nil
+}
+
+func (dhRistretto255) DHLen() int     { return 32 }
+func (dhRistretto255) String() string { return "ristretto255" }
+
 // The following code implements the Schnorrkel variant of Schnorr signatures
 // over ristretto255.
 // This implementation was picked from https://github.com/w3f/schnorrkel
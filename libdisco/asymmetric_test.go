@@ -2,6 +2,8 @@ package libdisco
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
 	"testing"
 )
 
@@ -37,6 +39,143 @@ func TestDeterministicSignatures(t *testing.T) {
 	}
 }
 
+func TestDHFunctions(t *testing.T) {
+	for _, function := range []DHFunction{DH25519, DH448, DHRistretto255} {
+		alice, err := function.GenerateKeypair(nil)
+		if err != nil {
+			t.Fatal("cannot generate a key pair", function, err)
+		}
+		bob, err := function.GenerateKeypair(nil)
+		if err != nil {
+			t.Fatal("cannot generate a key pair", function, err)
+		}
+		if len(alice.PublicKey) != function.DHLen() {
+			t.Fatal("unexpected public key size", function, len(alice.PublicKey))
+		}
+		shared1, err1 := function.DH(alice.PrivateKey, bob.PublicKey)
+		shared2, err2 := function.DH(bob.PrivateKey, alice.PublicKey)
+		if err1 != nil || err2 != nil || !bytes.Equal(shared1, shared2) {
+			t.Fatal("the shared secrets do not match", function, err1, err2)
+		}
+		// a key pair is derived from its private key
+		derived, err := function.GenerateKeypair(alice.PrivateKey)
+		if err != nil || !bytes.Equal(derived.PublicKey, alice.PublicKey) {
+			t.Fatal("cannot derive the key pair", function, err)
+		}
+		if _, err := function.DH(alice.PrivateKey, bob.PublicKey[1:]); !errors.Is(err, ErrInvalidKey) {
+			t.Fatal("expected ErrInvalidKey", function, err)
+		}
+	}
+
+	// invalid public keys
+	if _, err := DH448.DH(make([]byte, 56), make([]byte, 56)); !errors.Is(err, ErrInvalidKey) {
+		t.Fatal("expected ErrInvalidKey for a low order X448 public key", err)
+	}
+	keyPair, _ := DHRistretto255.GenerateKeypair(nil)
+	if _, err := DHRistretto255.DH(keyPair.PrivateKey, bytes.Repeat([]byte{0xff}, 32)); !errors.Is(err, ErrInvalidKey) {
+		t.Fatal("expected ErrInvalidKey for an invalid ristretto255 public key", err)
+	}
+	if _, err := DHRistretto255.GenerateKeypair(bytes.Repeat([]byte{0xff}, 32)); !errors.Is(err, ErrInvalidKey) {
+		t.Fatal("expected ErrInvalidKey for a non-canonical ristretto255 scalar", err)
+	}
+}
+
+func TestX448Vector(t *testing.T) {
+	// from section 6.2 of RFC 7748
+	alicePrivate, _ := hex.DecodeString("9a8f4925d1519f5775cf46b04b5800d4ee9ee8bae8bc5565d498c28dd9c9baf574a9419744897391006382a6f127ab1d9ac2d8c0a598726b")
+	alicePublic, _ := hex.DecodeString("9b08f7cc31b7e3e67d22d5aea121074a273bd2b83de09c63faa73d2c22c5d9bbc836647241d953d40c5b12da88120d53177f80e532c41fa0")
+	bobPublic, _ := hex.DecodeString("3eb7a829b0cd20f5bcfc0b599b6feccf6da4627107bdb0d4f345b43027d8b972fc3e34fb4232a13ca706dcb57aec3dae07bdc1c67bf33609")
+	expected, _ := hex.DecodeString("07fff4181ac6cc95ec1c16a94a0f74d12da232ce40a77552281d282bb60c0b56fd2464c335543936521c24403085d59a449a5037514a879d")
+
+	alice, err := DH448.GenerateKeypair(alicePrivate)
+	if err != nil || !bytes.Equal(alice.PublicKey, alicePublic) {
+		t.Fatal("unexpected public key", err)
+	}
+	shared, err := DH448.DH(alice.PrivateKey, bobPublic)
+	if err != nil || !bytes.Equal(shared, expected) {
+		t.Fatal("unexpected shared secret", err)
+	}
+}
+
+func TestDHConn(t *testing.T) {
+	for _, suite := range []CipherSuite{
+		{DH: DH448},
+		{DH: DHRistretto255, Cipher: CipherChaChaPoly, Hash: HashSHA256},
+	} {
+		for _, handshakeType := range []noiseHandshakeType{NoiseXX, NoiseIK} {
+			clientConfig, serverConfig := configsForPattern(handshakeType)
+			clientKeyPair, _ := suite.DH.GenerateKeypair(nil)
+			serverKeyPair, _ := suite.DH.GenerateKeypair(nil)
+			clientConfig.CipherSuite, serverConfig.CipherSuite = suite, suite
+			clientConfig.KeyPair, serverConfig.KeyPair = clientKeyPair, serverKeyPair
+			clientConfig.StaticPublicKeyProof = createProof(clientKeyPair.PublicKey)
+			serverConfig.StaticPublicKeyProof = createProof(serverKeyPair.PublicKey)
+			if clientConfig.RemoteKey != nil {
+				clientConfig.RemoteKey = serverKeyPair.PublicKey
+			}
+
+			client, server, clientErr, serverErr := connPair(clientConfig, serverConfig)
+			if clientErr != nil || serverErr != nil {
+				t.Fatal("the handshake failed", suite, clientErr, serverErr)
+			}
+			state := client.ConnectionState()
+			if state.ProtocolName != "Noise_"+handshakeType.String()+"_"+suite.String() {
+				t.Fatal("unexpected protocol name", state.ProtocolName)
+			}
+			if !bytes.Equal(state.RemotePublicKey, serverKeyPair.PublicKey) ||
+				!bytes.Equal(server.ConnectionState().RemotePublicKey, clientKeyPair.PublicKey) {
+				t.Fatal("the peers did not receive the expected static keys", suite)
+			}
+			client.conn.Close()
+			server.conn.Close()
+		}
+	}
+
+	// the keys must be of the DH function
+	clientConfig, serverConfig := configsForPattern(NoiseIK)
+	clientConfig.CipherSuite, serverConfig.CipherSuite = CipherSuite{DH: DH448}, CipherSuite{DH: DH448}
+	if _, _, clientErr, _ := connPair(clientConfig, serverConfig); !errors.Is(clientErr, ErrInvalidKey) {
+		t.Fatal("expected ErrInvalidKey", clientErr)
+	}
+}
+
+func TestDHSerialize(t *testing.T) {
+	suite := CipherSuite{DH: DH448}
+	initiatorKeyPair, _ := DH448.GenerateKeypair(nil)
+	responderKeyPair, _ := DH448.GenerateKeypair(nil)
+	initiator, err := InitializeWithCipherSuite(suite, NoiseXX, true, nil, initiatorKeyPair, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := InitializeWithCipherSuite(suite, NoiseXX, false, nil, responderKeyPair, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var message, payload []byte
+	for i := 0; i < 3; i++ {
+		// the initiator is serialized between every message
+		if initiator, err = RecoverState(initiator.Serialize(), nil, initiatorKeyPair); err != nil {
+			t.Fatal("cannot recover the state", err)
+		}
+		writer, reader := initiator, responder
+		if i%2 != 0 {
+			writer, reader = responder, initiator
+		}
+		message = message[:0]
+		if _, _, err = writer.WriteMessage(nil, &message); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = reader.ReadMessage(message, &payload); err != nil {
+			t.Fatal("cannot read message", i, err)
+		}
+	}
+	if !bytes.Equal(initiator.RemoteStaticKey(), responderKeyPair.PublicKey) ||
+		!bytes.Equal(initiator.HandshakeHash(), responder.HandshakeHash()) {
+		t.Fatal("the handshake did not complete with the recovered states")
+	}
+}
+
 func BenchmarkSignVerify(b *testing.B) {
 	kp, err := GenerateSigningKeypair()
 	if err != nil {
@@ -0,0 +1,285 @@
+package libdisco
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+//
+// Certificates
+//
+
+// A static public key can be authenticated by a chain of certificates instead
+// of a bare signature (see CreateStaticPublicKeyProof): the leaf certificate
+// binds the key to names and a validity period, and is signed by a root key or
+// by an intermediate certificate that chains up to a root key.
+
+// KeyUsage restricts what the key of a certificate can be used for
+type KeyUsage uint8
+
+const (
+	// KeyUsageServer allows the key to be the static key of a server
+	KeyUsageServer KeyUsage = 1 << iota
+	// KeyUsageClient allows the key to be the static key of a client
+	KeyUsageClient
+	// KeyUsageCertSign allows the key, an ed25519 public key, to sign other certificates
+	KeyUsageCertSign
+)
+
+// certificateVersion is the first byte of an encoded certificate
+const certificateVersion = 1
+
+// certificateContext is prepended to the signed part of a certificate
+const certificateContext = "DiscoCertificate"
+
+// Certificate binds a public key to a subject and to names for a period of
+// time. It is signed by its issuer, a root key or an intermediate certificate.
+type Certificate struct {
+	// the name of the issuer, the subject of its certificate or the name of a root key
+	Issuer string
+	// the name of the owner of the key
+	Subject string
+	// a static public key, or an ed25519 public key with KeyUsageCertSign
+	PublicKey []byte
+	// the certificate is only valid between these times
+	NotBefore, NotAfter time.Time
+	// the server names the key can be used for (see Config.ServerName)
+	Names []string
+	// what the key can be used for
+	KeyUsage KeyUsage
+
+	// set by ParseCertificate
+	Signature []byte
+	signed    []byte
+}
+
+// CreateCertificate signs a certificate for the fields of template with the
+// ed25519 private key of the issuer (a root key, or the key of an intermediate
+// certificate) and returns it in its encoded form.
+func CreateCertificate(template *Certificate, issuerPrivateKey ed25519.PrivateKey) ([]byte, error) {
+	if len(issuerPrivateKey) != ed25519.PrivateKeySize {
+		return nil, newError(ErrInvalidKey, "disco: the issuer's private key should be an ed25519 private key")
+	}
+	if !template.NotAfter.After(template.NotBefore) {
+		return nil, newError(ErrInvalidCertificate, "disco: the certificate should have a validity period")
+	}
+	if template.KeyUsage&KeyUsageCertSign != 0 && len(template.PublicKey) != ed25519.PublicKeySize {
+		return nil, newError(ErrInvalidCertificate, "disco: a certificate signing other certificates should have an ed25519 public key")
+	}
+	if len(template.Names) > 255 {
+		return nil, newError(ErrInvalidCertificate, "disco: a certificate can have 255 names at most")
+	}
+	for _, field := range append([]string{template.Issuer, template.Subject, string(template.PublicKey)}, template.Names...) {
+		if len(field) > 0xffff {
+			return nil, newError(ErrInvalidCertificate, "disco: the fields of a certificate should be shorter than 65536 bytes")
+		}
+	}
+
+	// [version(1), keyUsage(1), notBefore(8), notAfter(8), issuer, subject, publicKey, numNames(1), names, signature]
+	// where the variable-length fields are preceded by their 2-byte length
+	certificate := []byte{certificateVersion, byte(template.KeyUsage)}
+	var validity [16]byte
+	binary.BigEndian.PutUint64(validity[:8], uint64(template.NotBefore.Unix()))
+	binary.BigEndian.PutUint64(validity[8:], uint64(template.NotAfter.Unix()))
+	certificate = append(certificate, validity[:]...)
+	certificate = appendField(certificate, []byte(template.Issuer))
+	certificate = appendField(certificate, []byte(template.Subject))
+	certificate = appendField(certificate, template.PublicKey)
+	certificate = append(certificate, byte(len(template.Names)))
+	for _, name := range template.Names {
+		certificate = appendField(certificate, []byte(name))
+	}
+
+	signature := ed25519.Sign(issuerPrivateKey, append([]byte(certificateContext), certificate...))
+	return appendField(certificate, signature), nil
+}
+
+// ParseCertificate parses a certificate created by CreateCertificate. The
+// signature is not verified, see VerifyCertificateProof.
+func ParseCertificate(data []byte) (*Certificate, error) {
+	malformed := newError(ErrInvalidCertificate, "disco: the certificate is malformed")
+	if len(data) < 18 || data[0] != certificateVersion {
+		return nil, malformed
+	}
+	certificate := &Certificate{
+		KeyUsage:  KeyUsage(data[1]),
+		NotBefore: time.Unix(int64(binary.BigEndian.Uint64(data[2:10])), 0),
+		NotAfter:  time.Unix(int64(binary.BigEndian.Uint64(data[10:18])), 0),
+	}
+	rest := data[18:]
+	readField := func() ([]byte, bool) {
+		if len(rest) < 2 || len(rest) < 2+int(binary.BigEndian.Uint16(rest)) {
+			return nil, false
+		}
+		length := 2 + int(binary.BigEndian.Uint16(rest))
+		field := rest[2:length]
+		rest = rest[length:]
+		return append([]byte(nil), field...), true
+	}
+
+	issuer, ok1 := readField()
+	subject, ok2 := readField()
+	publicKey, ok3 := readField()
+	if !ok1 || !ok2 || !ok3 || len(rest) < 1 {
+		return nil, malformed
+	}
+	certificate.Issuer, certificate.Subject, certificate.PublicKey = string(issuer), string(subject), publicKey
+	numNames := int(rest[0])
+	rest = rest[1:]
+	for i := 0; i < numNames; i++ {
+		name, ok := readField()
+		if !ok {
+			return nil, malformed
+		}
+		certificate.Names = append(certificate.Names, string(name))
+	}
+	certificate.signed = append([]byte(certificateContext), data[:len(data)-len(rest)]...)
+	signature, ok := readField()
+	if !ok || len(signature) != ed25519.SignatureSize || len(rest) != 0 {
+		return nil, malformed
+	}
+	certificate.Signature = signature
+	return certificate, nil
+}
+
+// CreateCertificateProof returns a StaticPublicKeyProof made of the leaf
+// certificate of the static key, followed by the intermediate certificates
+// leading to a root key (each one signing the previous one).
+func CreateCertificateProof(leaf []byte, intermediates ...[]byte) []byte {
+	var proof []byte
+	for _, certificate := range append([][]byte{leaf}, intermediates...) {
+		proof = appendField(proof, certificate)
+	}
+	return proof
+}
+
+// ParseCertificateProof parses a proof created by CreateCertificateProof
+// and returns the chain of certificates, starting with the leaf.
+func ParseCertificateProof(proof []byte) ([]*Certificate, error) {
+	var chain []*Certificate
+	for len(proof) > 0 {
+		if len(proof) < 2 || len(proof) < 2+int(binary.BigEndian.Uint16(proof)) {
+			return nil, newError(ErrInvalidCertificate, "disco: the certificate chain is malformed")
+		}
+		length := 2 + int(binary.BigEndian.Uint16(proof))
+		certificate, err := ParseCertificate(proof[2:length])
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, certificate)
+		proof = proof[length:]
+	}
+	if len(chain) == 0 {
+		return nil, newError(ErrInvalidCertificate, "disco: the certificate chain is empty")
+	}
+	return chain, nil
+}
+
+// CertificatePool is a set of trusted root keys
+type CertificatePool struct {
+	roots map[string][]ed25519.PublicKey
+}
+
+// NewCertificatePool returns an empty pool
+func NewCertificatePool() *CertificatePool {
+	return &CertificatePool{roots: make(map[string][]ed25519.PublicKey)}
+}
+
+// AddRoot trusts the certificates issued by name and signed by publicKey
+func (pool *CertificatePool) AddRoot(name string, publicKey ed25519.PublicKey) {
+	pool.roots[name] = append(pool.roots[name], publicKey)
+}
+
+// CertificateVerifyOptions are the requirements checked by VerifyCertificateProof
+type CertificateVerifyOptions struct {
+	// the root keys the chain must lead to
+	Roots *CertificatePool
+	// the time at which the certificates must be valid, the current time if zero
+	CurrentTime time.Time
+	// if set, one of the names of the leaf certificate (usually the server name)
+	Name string
+	// the usages the leaf certificate must allow, for example KeyUsageServer
+	// for the certificate of a server
+	KeyUsage KeyUsage
+}
+
+// VerifyCertificateProof verifies that proof is a chain of certificates for
+// publicKey that leads to a root of opts.Roots, and returns the chain. The
+// returned error matches ErrCertificateExpired if a certificate is not valid
+// at the current time, or ErrInvalidCertificate otherwise.
+func VerifyCertificateProof(publicKey, proof []byte, opts CertificateVerifyOptions) ([]*Certificate, error) {
+	chain, err := ParseCertificateProof(proof)
+	if err != nil {
+		return nil, err
+	}
+	leaf := chain[0]
+	if !bytes.Equal(leaf.PublicKey, publicKey) {
+		return nil, newError(ErrInvalidCertificate, "disco: the certificate is for another public key")
+	}
+	if leaf.KeyUsage&opts.KeyUsage != opts.KeyUsage {
+		return nil, newError(ErrInvalidCertificate, "disco: the certificate cannot be used for this key usage")
+	}
+	if opts.Name != "" && !leaf.hasName(opts.Name) {
+		return nil, newError(ErrInvalidCertificate, "disco: the certificate is not valid for the name "+strconv.Quote(opts.Name))
+	}
+
+	currentTime := opts.CurrentTime
+	if currentTime.IsZero() {
+		currentTime = time.Now()
+	}
+	for idx, certificate := range chain {
+		if currentTime.Before(certificate.NotBefore) || currentTime.After(certificate.NotAfter) {
+			return nil, newError(ErrCertificateExpired, "disco: the certificate of "+strconv.Quote(certificate.Subject)+" is not valid at the current time")
+		}
+		// the last certificate is signed by a root key
+		if idx == len(chain)-1 {
+			if opts.Roots == nil || !certificate.signedByRoot(opts.Roots) {
+				return nil, newError(ErrInvalidCertificate, "disco: the certificate of "+strconv.Quote(certificate.Subject)+" is not signed by a trusted root")
+			}
+			break
+		}
+		issuer := chain[idx+1]
+		if issuer.Subject != certificate.Issuer || issuer.KeyUsage&KeyUsageCertSign == 0 ||
+			len(issuer.PublicKey) != ed25519.PublicKeySize ||
+			!ed25519.Verify(issuer.PublicKey, certificate.signed, certificate.Signature) {
+			return nil, newError(ErrInvalidCertificate, "disco: the certificate of "+strconv.Quote(certificate.Subject)+" is not signed by "+strconv.Quote(issuer.Subject))
+		}
+	}
+	return chain, nil
+}
+
+// CreateCertificateVerifier returns a VerifyPublicKey callback (see Config)
+// that accepts the static keys authenticated by a chain of certificates (see
+// CreateCertificateProof). The handshake fails with the error returned by
+// VerifyCertificateProof, which matches ErrCertificateExpired or
+// ErrInvalidCertificate.
+func CreateCertificateVerifier(opts CertificateVerifyOptions) func(publicKey, proof []byte) error {
+	return func(publicKey, proof []byte) error {
+		_, err := VerifyCertificateProof(publicKey, proof, opts)
+		return err
+	}
+}
+
+// hasName returns true if name is one of the names of the certificate
+func (certificate *Certificate) hasName(name string) bool {
+	for _, certificateName := range certificate.Names {
+		if certificateName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// signedByRoot returns true if the certificate is signed by one of the roots named after its issuer
+func (certificate *Certificate) signedByRoot(pool *CertificatePool) bool {
+	for _, root := range pool.roots[certificate.Issuer] {
+		if len(root) == ed25519.PublicKeySize && ed25519.Verify(root, certificate.signed, certificate.Signature) {
+			return true
+		}
+	}
+	return false
+}
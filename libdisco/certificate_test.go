@@ -0,0 +1,178 @@
+package libdisco
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// testChain is a root key, an intermediate certificate and a leaf certificate
+type testChain struct {
+	roots        *CertificatePool
+	intermediate []byte
+	leaf         []byte
+	keyPair      *KeyPair
+}
+
+func newTestChain(t *testing.T, names []string, usage KeyUsage) *testChain {
+	rootPublicKey, rootPrivateKey, _ := ed25519.GenerateKey(rand.Reader)
+	intermediatePublicKey, intermediatePrivateKey, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Now()
+	intermediate, err := CreateCertificate(&Certificate{
+		Issuer:    "root",
+		Subject:   "intermediate",
+		PublicKey: intermediatePublicKey,
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(24 * time.Hour),
+		KeyUsage:  KeyUsageCertSign,
+	}, rootPrivateKey)
+	if err != nil {
+		t.Fatal("cannot create the intermediate certificate", err)
+	}
+	keyPair := GenerateKeypair(nil)
+	leaf, err := CreateCertificate(&Certificate{
+		Issuer:    "intermediate",
+		Subject:   "server",
+		PublicKey: keyPair.PublicKey,
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(time.Hour),
+		Names:     names,
+		KeyUsage:  usage,
+	}, intermediatePrivateKey)
+	if err != nil {
+		t.Fatal("cannot create the leaf certificate", err)
+	}
+	roots := NewCertificatePool()
+	roots.AddRoot("root", rootPublicKey)
+	return &testChain{roots: roots, intermediate: intermediate, leaf: leaf, keyPair: keyPair}
+}
+
+func TestCertificateChain(t *testing.T) {
+	chain := newTestChain(t, []string{"example.com", "www.example.com"}, KeyUsageServer)
+	proof := CreateCertificateProof(chain.leaf, chain.intermediate)
+	opts := CertificateVerifyOptions{Roots: chain.roots, Name: "www.example.com", KeyUsage: KeyUsageServer}
+
+	certificates, err := VerifyCertificateProof(chain.keyPair.PublicKey, proof, opts)
+	if err != nil {
+		t.Fatal("the chain should be valid", err)
+	}
+	if len(certificates) != 2 || certificates[0].Subject != "server" || certificates[1].Subject != "intermediate" {
+		t.Fatal("unexpected chain", certificates)
+	}
+
+	tampered := append([]byte(nil), proof...)
+	tampered[30] ^= 1
+	otherRoots := NewCertificatePool()
+	otherRoot, _, _ := ed25519.GenerateKey(rand.Reader)
+	otherRoots.AddRoot("root", otherRoot)
+
+	for _, test := range []struct {
+		name      string
+		publicKey []byte
+		proof     []byte
+		opts      CertificateVerifyOptions
+		err       error
+	}{
+		{"wrong name", chain.keyPair.PublicKey, proof, CertificateVerifyOptions{Roots: chain.roots, Name: "evil.com"}, ErrInvalidCertificate},
+		{"wrong usage", chain.keyPair.PublicKey, proof, CertificateVerifyOptions{Roots: chain.roots, KeyUsage: KeyUsageClient}, ErrInvalidCertificate},
+		{"wrong key", GenerateKeypair(nil).PublicKey, proof, opts, ErrInvalidCertificate},
+		{"untrusted root", chain.keyPair.PublicKey, proof, CertificateVerifyOptions{Roots: otherRoots}, ErrInvalidCertificate},
+		{"no roots", chain.keyPair.PublicKey, proof, CertificateVerifyOptions{}, ErrInvalidCertificate},
+		{"missing intermediate", chain.keyPair.PublicKey, CreateCertificateProof(chain.leaf), opts, ErrInvalidCertificate},
+		{"tampered", chain.keyPair.PublicKey, tampered, opts, ErrInvalidCertificate},
+		{"malformed", chain.keyPair.PublicKey, proof[:len(proof)-1], opts, ErrInvalidCertificate},
+		{"empty", chain.keyPair.PublicKey, nil, opts, ErrInvalidCertificate},
+		{"expired", chain.keyPair.PublicKey, proof, CertificateVerifyOptions{Roots: chain.roots, CurrentTime: time.Now().Add(2 * time.Hour)}, ErrCertificateExpired},
+		{"not yet valid", chain.keyPair.PublicKey, proof, CertificateVerifyOptions{Roots: chain.roots, CurrentTime: time.Now().Add(-2 * time.Hour)}, ErrCertificateExpired},
+	} {
+		if _, err := VerifyCertificateProof(test.publicKey, test.proof, test.opts); !errors.Is(err, test.err) {
+			t.Fatal(test.name, "expected", test.err, "got", err)
+		}
+	}
+
+	// an intermediate needs KeyUsageCertSign to sign certificates
+	leafSignedByLeaf := newTestChain(t, nil, KeyUsageServer)
+	if _, err := VerifyCertificateProof(leafSignedByLeaf.keyPair.PublicKey, CreateCertificateProof(leafSignedByLeaf.leaf, chain.leaf, chain.intermediate), CertificateVerifyOptions{Roots: chain.roots}); !errors.Is(err, ErrInvalidCertificate) {
+		t.Fatal("a certificate without KeyUsageCertSign should not sign certificates", err)
+	}
+}
+
+func TestCreateCertificate(t *testing.T) {
+	_, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	template := &Certificate{
+		Issuer:    "root",
+		Subject:   "client",
+		PublicKey: GenerateKeypair(nil).PublicKey,
+		NotBefore: time.Unix(1000, 0),
+		NotAfter:  time.Unix(2000, 0),
+		Names:     []string{"a", "b"},
+		KeyUsage:  KeyUsageClient | KeyUsageServer,
+	}
+	data, err := CreateCertificate(template, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := ParseCertificate(data)
+	if err != nil {
+		t.Fatal("cannot parse the certificate", err)
+	}
+	if certificate.Issuer != template.Issuer || certificate.Subject != template.Subject ||
+		!certificate.NotBefore.Equal(template.NotBefore) || !certificate.NotAfter.Equal(template.NotAfter) ||
+		len(certificate.Names) != 2 || certificate.Names[1] != "b" || certificate.KeyUsage != template.KeyUsage {
+		t.Fatal("the parsed certificate does not match", certificate)
+	}
+
+	template.NotAfter = template.NotBefore
+	if _, err := CreateCertificate(template, privateKey); !errors.Is(err, ErrInvalidCertificate) {
+		t.Fatal("a certificate needs a validity period", err)
+	}
+	template.NotAfter = time.Unix(2000, 0)
+	template.KeyUsage = KeyUsageCertSign
+	template.PublicKey = make([]byte, 56)
+	if _, err := CreateCertificate(template, privateKey); !errors.Is(err, ErrInvalidCertificate) {
+		t.Fatal("a certificate signing other certificates needs an ed25519 key", err)
+	}
+}
+
+func TestCertificateConn(t *testing.T) {
+	chain := newTestChain(t, []string{"example.com"}, KeyUsageServer)
+	clientConfig, serverConfig := configsForPattern(NoiseNX)
+	serverConfig.KeyPair = chain.keyPair
+	serverConfig.StaticPublicKeyProof = CreateCertificateProof(chain.leaf, chain.intermediate)
+	clientConfig.PublicKeyVerifier = nil
+	clientConfig.VerifyPublicKey = CreateCertificateVerifier(CertificateVerifyOptions{
+		Roots: chain.roots, Name: "example.com", KeyUsage: KeyUsageServer,
+	})
+	client, server, clientErr, serverErr := connPair(clientConfig, serverConfig)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal("the handshake failed", clientErr, serverErr)
+	}
+	certificates, err := ParseCertificateProof(client.ConnectionState().RemoteProof)
+	if err != nil || certificates[0].Subject != "server" {
+		t.Fatal("the client should receive the certificates of the server", err)
+	}
+	go func() {
+		// wait for the client to close the connection
+		server.Read(make([]byte, 1))
+	}()
+	client.Close()
+
+	// a certificate for another name is rejected
+	clientConfig.VerifyPublicKey = CreateCertificateVerifier(CertificateVerifyOptions{
+		Roots: chain.roots, Name: "evil.com", KeyUsage: KeyUsageServer,
+	})
+	if _, _, clientErr, _ := connPair(clientConfig, serverConfig); !errors.Is(clientErr, ErrInvalidCertificate) {
+		t.Fatal("expected ErrInvalidCertificate", clientErr)
+	}
+
+	// an expired certificate is reported as such
+	clientConfig.VerifyPublicKey = CreateCertificateVerifier(CertificateVerifyOptions{
+		Roots: chain.roots, Name: "example.com", KeyUsage: KeyUsageServer, CurrentTime: time.Now().Add(2 * time.Hour),
+	})
+	if _, _, clientErr, _ := connPair(clientConfig, serverConfig); !errors.Is(clientErr, ErrCertificateExpired) {
+		t.Fatal("expected ErrCertificateExpired", clientErr)
+	}
+}
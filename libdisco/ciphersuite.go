@@ -0,0 +1,408 @@
+package libdisco
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+//
+// Cipher suites
+//
+
+// By default, Disco uses Strobe for all the symmetric cryptography of a protocol.
+// To talk to peers implementing the standard Noise specification, a CipherSuite
+// can select one of the Noise cipher functions and hash functions instead
+// (see section 12 of the Noise specification).
+
+// a symmetricCipher is Strobe, or the cipher function of a Noise cipher suite
+type symmetricCipher uint8
+
+const (
+	// CipherStrobe uses Strobe for all the symmetric cryptography (the default)
+	CipherStrobe symmetricCipher = iota
+	// CipherChaChaPoly is the ChaCha20-Poly1305 AEAD
+	CipherChaChaPoly
+	// CipherAESGCM is the AES-256-GCM AEAD
+	CipherAESGCM
+)
+
+// a hashFunction is the hash function of a Noise cipher suite
+type hashFunction uint8
+
+const (
+	// HashNone is used with CipherStrobe, which does not need a hash function
+	HashNone hashFunction = iota
+	// HashSHA256 is SHA-256
+	HashSHA256
+	// HashSHA512 is SHA-512
+	HashSHA512
+	// HashBLAKE2s is BLAKE2s with a 32-byte output
+	HashBLAKE2s
+	// HashBLAKE2b is BLAKE2b with a 64-byte output
+	HashBLAKE2b
+)
+
+var cipherNames = map[symmetricCipher]string{
+	CipherChaChaPoly: "ChaChaPoly",
+	CipherAESGCM:     "AESGCM",
+}
+
+var hashNames = map[hashFunction]string{
+	HashSHA256:  "SHA256",
+	HashSHA512:  "SHA512",
+	HashBLAKE2s: "BLAKE2s",
+	HashBLAKE2b: "BLAKE2b",
+}
+
+// CipherSuite selects the cryptography of a protocol. The zero value uses
+// X25519 and Strobe, other suites can use another DH function and combine a
+// Noise cipher function and hash function, for example
+// CipherSuite{Cipher: CipherChaChaPoly, Hash: HashSHA256}.
+type CipherSuite struct {
+	// DH is the Diffie-Hellman function, DH25519 if nil
+	DH     DHFunction
+	Cipher symmetricCipher
+	Hash   hashFunction
+}
+
+// dh returns the DH function of the suite
+func (suite CipherSuite) dh() DHFunction {
+	if suite.DH == nil {
+		return DH25519
+	}
+	return suite.DH
+}
+
+// String returns the name of the suite as it appears in protocol names,
+// for example "25519_STROBEv1.0.2" or "448_ChaChaPoly_SHA256".
+func (suite CipherSuite) String() string {
+	if suite.Cipher == CipherStrobe {
+		return suite.dh().String() + "_" + StrobeVersion
+	}
+	return suite.dh().String() + "_" + cipherNames[suite.Cipher] + "_" + hashNames[suite.Hash]
+}
+
+// check returns an error if the suite is not supported
+func (suite CipherSuite) check() error {
+	if suite.dh().DHLen() < 32 {
+		return newError(ErrUnknownCipherSuite, "disco: the DH function "+strconv.Quote(suite.dh().String())+" has outputs shorter than 32 bytes")
+	}
+	if suite.Cipher == CipherStrobe {
+		if suite.Hash != HashNone {
+			return newError(ErrUnknownCipherSuite, "disco: Strobe cannot be used with a hash function")
+		}
+		return nil
+	}
+	if _, ok := cipherNames[suite.Cipher]; !ok {
+		return newError(ErrUnknownCipherSuite, "disco: cipher "+strconv.Itoa(int(suite.Cipher))+" is not supported")
+	}
+	if _, ok := hashNames[suite.Hash]; !ok {
+		return newError(ErrUnknownCipherSuite, "disco: hash function "+strconv.Itoa(int(suite.Hash))+" is not supported")
+	}
+	return nil
+}
+
+// parseCipherSuite parses the cryptographic part of a protocol name, for
+// example "25519_STROBEv1.0.2" or "448_ChaChaPoly_SHA256"
+func parseCipherSuite(name string) (CipherSuite, error) {
+	var suite CipherSuite
+	fields := strings.SplitN(name, "_", 2)
+	dh, ok := dhFunctions[fields[0]]
+	if !ok || len(fields) != 2 {
+		return CipherSuite{}, newError(ErrUnknownCipherSuite, "disco: DH function "+strconv.Quote(fields[0])+" is not supported")
+	}
+	// the default DH function is the zero value
+	if dh != DH25519 {
+		suite.DH = dh
+	}
+	if fields[1] == StrobeVersion {
+		return suite, nil
+	}
+	symmetric := strings.Split(fields[1], "_")
+	if len(symmetric) == 2 {
+		for cipher, cipherName := range cipherNames {
+			if cipherName == symmetric[0] {
+				suite.Cipher = cipher
+			}
+		}
+		for hash, hashName := range hashNames {
+			if hashName == symmetric[1] {
+				suite.Hash = hash
+			}
+		}
+		if suite.Cipher != CipherStrobe && suite.Hash != HashNone {
+			return suite, nil
+		}
+	}
+	return CipherSuite{}, newError(ErrUnknownCipherSuite, "disco: symmetric protocol "+strconv.Quote(fields[1])+" is not supported")
+}
+
+// newHash returns a new instance of the hash function
+func (suite CipherSuite) newHash() hash.Hash {
+	switch suite.Hash {
+	case HashSHA256:
+		return sha256.New()
+	case HashSHA512:
+		return sha512.New()
+	case HashBLAKE2s:
+		h, _ := blake2s.New256(nil)
+		return h
+	default:
+		h, _ := blake2b.New512(nil)
+		return h
+	}
+}
+
+// newAEAD returns an instance of the cipher function keyed with key
+func (suite CipherSuite) newAEAD(key []byte) cipher.AEAD {
+	if suite.Cipher == CipherAESGCM {
+		block, _ := aes.NewCipher(key)
+		aead, _ := cipher.NewGCM(block)
+		return aead
+	}
+	aead, _ := chacha20poly1305.New(key)
+	return aead
+}
+
+// newSymmetricState returns the symmetric state of a handshake using the suite
+func (suite CipherSuite) newSymmetricState(protocolName string) symmetricState {
+	if suite.Cipher == CipherStrobe {
+		s := &strobeSymmetricState{}
+		s.initializeSymmetric(protocolName)
+		return s
+	}
+	s := &noiseSymmetricState{suite: suite}
+	s.initializeSymmetric(protocolName)
+	return s
+}
+
+//
+// Noise SymmetricState (section 5.2 of the Noise specification)
+//
+
+type noiseSymmetricState struct {
+	suite CipherSuite
+	ck, h []byte
+	cs    noiseCipherState
+}
+
+func (s *noiseSymmetricState) initializeSymmetric(protocolName string) {
+	hashLen := s.suite.newHash().Size()
+	if len(protocolName) <= hashLen {
+		s.h = make([]byte, hashLen)
+		copy(s.h, protocolName)
+	} else {
+		s.h = s.hash([]byte(protocolName))
+	}
+	s.ck = append([]byte{}, s.h...)
+}
+
+// hash returns HASH(data...)
+func (s *noiseSymmetricState) hash(data ...[]byte) []byte {
+	h := s.suite.newHash()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// hkdf returns numOutputs outputs of HKDF(chainingKey, inputKeyMaterial)
+func (s *noiseSymmetricState) hkdf(inputKeyMaterial []byte, numOutputs int) [][]byte {
+	mac := hmac.New(s.suite.newHash, s.ck)
+	mac.Write(inputKeyMaterial)
+	tempKey := mac.Sum(nil)
+
+	outputs := make([][]byte, numOutputs)
+	var previous []byte
+	for i := range outputs {
+		mac = hmac.New(s.suite.newHash, tempKey)
+		mac.Write(previous)
+		mac.Write([]byte{byte(i + 1)})
+		outputs[i] = mac.Sum(nil)
+		previous = outputs[i]
+	}
+	return outputs
+}
+
+func (s *noiseSymmetricState) mixKey(inputKeyMaterial []byte) {
+	outputs := s.hkdf(inputKeyMaterial, 2)
+	s.ck = outputs[0]
+	s.cs = newNoiseCipherState(s.suite, outputs[1][:32])
+}
+
+func (s *noiseSymmetricState) mixHash(data []byte) {
+	s.h = s.hash(s.h, data)
+}
+
+func (s *noiseSymmetricState) mixKeyAndHash(inputKeyMaterial []byte) {
+	outputs := s.hkdf(inputKeyMaterial, 3)
+	s.ck = outputs[0]
+	s.mixHash(outputs[1])
+	s.cs = newNoiseCipherState(s.suite, outputs[2][:32])
+}
+
+func (s *noiseSymmetricState) hasKey() bool {
+	return s.cs.aead != nil
+}
+
+func (s *noiseSymmetricState) GetHandshakeHash() []byte {
+	return append([]byte{}, s.h...)
+}
+
+func (s *noiseSymmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	ciphertext := plaintext
+	if s.hasKey() {
+		ciphertext = s.cs.seal(s.cs.n, s.h, plaintext)
+		s.cs.n++
+	}
+	s.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (s *noiseSymmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext := ciphertext
+	if s.hasKey() {
+		var err error
+		if plaintext, err = s.cs.open(s.cs.n, s.h, ciphertext); err != nil {
+			return nil, err
+		}
+		s.cs.n++
+	}
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+func (s *noiseSymmetricState) Split() (c1, c2 *CipherState) {
+	outputs := s.hkdf(nil, 2)
+	cs1 := newNoiseCipherState(s.suite, outputs[0][:32])
+	cs2 := newNoiseCipherState(s.suite, outputs[1][:32])
+	return &CipherState{cipher: &cs1}, &CipherState{cipher: &cs2}
+}
+
+// splitDatagram returns the CipherStates of Split, the cipher functions of
+// Noise cipher suites are already used with explicit nonces
+func (s *noiseSymmetricState) splitDatagram() (c1, c2 *CipherState) {
+	return s.Split()
+}
+
+// serialize returns [noiseStateMarker, cipher, hash, ck, h, k, n], as the
+// state of a Noise suite is made of hash outputs the size of each field is known
+func (s *noiseSymmetricState) serialize() []byte {
+	serialized := []byte{noiseStateMarker, byte(s.suite.Cipher), byte(s.suite.Hash)}
+	serialized = append(serialized, s.ck...)
+	serialized = append(serialized, s.h...)
+	serialized = append(serialized, s.cs.key[:]...)
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], s.cs.n)
+	return append(serialized, n[:]...)
+}
+
+// noiseStateMarker starts a serialized Noise symmetric state, it cannot start
+// a serialized Strobe state (see validStrobeState)
+const noiseStateMarker = 0xff
+
+// recoverNoiseSymmetricState parses a state serialized by serialize
+func recoverNoiseSymmetricState(serialized []byte, hasKey bool) (*noiseSymmetricState, error) {
+	if len(serialized) < 3 || serialized[0] != noiseStateMarker {
+		return nil, newError(ErrMalformedState, "disco: the serialized symmetric state is malformed")
+	}
+	s := &noiseSymmetricState{suite: CipherSuite{Cipher: symmetricCipher(serialized[1]), Hash: hashFunction(serialized[2])}}
+	if s.suite.Cipher == CipherStrobe || s.suite.check() != nil {
+		return nil, newError(ErrMalformedState, "disco: the serialized cipher suite is not supported")
+	}
+	hashLen := s.suite.newHash().Size()
+	serialized = serialized[3:]
+	if len(serialized) != 2*hashLen+32+8 {
+		return nil, newError(ErrMalformedState, "disco: the serialized symmetric state is malformed")
+	}
+	s.ck = append([]byte{}, serialized[:hashLen]...)
+	s.h = append([]byte{}, serialized[hashLen:2*hashLen]...)
+	if hasKey {
+		s.cs = newNoiseCipherState(s.suite, serialized[2*hashLen:2*hashLen+32])
+	}
+	s.cs.n = binary.BigEndian.Uint64(serialized[2*hashLen+32:])
+	return s, nil
+}
+
+//
+// Noise CipherState (section 5.1 of the Noise specification)
+//
+
+type noiseCipherState struct {
+	suite CipherSuite
+	key   [32]byte
+	aead  cipher.AEAD
+	n     uint64
+}
+
+func newNoiseCipherState(suite CipherSuite, key []byte) noiseCipherState {
+	cs := noiseCipherState{suite: suite}
+	copy(cs.key[:], key)
+	cs.aead = suite.newAEAD(cs.key[:])
+	return cs
+}
+
+// nonce encodes n as specified by the cipher function
+func (cs *noiseCipherState) nonce(n uint64) []byte {
+	nonce := make([]byte, 12)
+	if cs.suite.Cipher == CipherAESGCM {
+		binary.BigEndian.PutUint64(nonce[4:], n)
+	} else {
+		binary.LittleEndian.PutUint64(nonce[4:], n)
+	}
+	return nonce
+}
+
+func (cs *noiseCipherState) seal(n uint64, ad, plaintext []byte) []byte {
+	return cs.aead.Seal(nil, cs.nonce(n), plaintext, ad)
+}
+
+func (cs *noiseCipherState) open(n uint64, ad, ciphertext []byte) ([]byte, error) {
+	plaintext, err := cs.aead.Open(nil, cs.nonce(n), ciphertext, ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+func (cs *noiseCipherState) encrypt(plaintext []byte) []byte {
+	ciphertext := cs.seal(cs.n, nil, plaintext)
+	cs.n++
+	return ciphertext
+}
+
+func (cs *noiseCipherState) decrypt(ciphertext []byte) ([]byte, error) {
+	plaintext, err := cs.open(cs.n, nil, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	cs.n++
+	return plaintext, nil
+}
+
+func (cs *noiseCipherState) encryptWithNonce(nonce uint64, plaintext []byte) []byte {
+	return cs.seal(nonce, nil, plaintext)
+}
+
+func (cs *noiseCipherState) decryptWithNonce(nonce uint64, ciphertext []byte) ([]byte, error) {
+	return cs.open(nonce, nil, ciphertext)
+}
+
+// rekey sets the key to the first 32 bytes of the encryption of 32 zeros
+// under the maximum nonce (section 4.2 of the Noise specification)
+func (cs *noiseCipherState) rekey() {
+	key := cs.seal(^uint64(0), nil, make([]byte, 32))
+	copy(cs.key[:], key[:32])
+	cs.aead = cs.suite.newAEAD(cs.key[:])
+}
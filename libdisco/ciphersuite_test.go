@@ -0,0 +1,246 @@
+package libdisco
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// noiseVector is a test vector of testdata/noise_vectors.txt
+type noiseVector struct {
+	protocolName                 string
+	initStatic, respStatic       *KeyPair
+	initEphemeral, respEphemeral *KeyPair
+	prologue, psk                []byte
+	payloads, ciphertexts        [][]byte
+	// the ML-KEM seed and encapsulation randomness of hfs patterns
+	kemSeed, kemRandom []byte
+}
+
+// readNoiseVectors parses the test vectors of a file in the cacophony format
+func readNoiseVectors(t *testing.T, file string) []*noiseVector {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var vectors []*noiseVector
+	var vector *noiseVector
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 {
+			t.Fatal("malformed line", line)
+		}
+		if fields[0] == "handshake" {
+			vector = &noiseVector{protocolName: fields[1]}
+			vectors = append(vectors, vector)
+			continue
+		}
+		value, err := hex.DecodeString(fields[1])
+		if err != nil || vector == nil {
+			t.Fatal("malformed line", line)
+		}
+		keyPair := func() *KeyPair {
+			var privateKey [32]byte
+			copy(privateKey[:], value)
+			return GenerateKeypair(&privateKey)
+		}
+		switch {
+		case fields[0] == "init_static":
+			vector.initStatic = keyPair()
+		case fields[0] == "resp_static":
+			vector.respStatic = keyPair()
+		case fields[0] == "gen_init_ephemeral":
+			vector.initEphemeral = keyPair()
+		case fields[0] == "gen_resp_ephemeral":
+			vector.respEphemeral = keyPair()
+		case fields[0] == "prologue":
+			vector.prologue = value
+		case fields[0] == "preshared_key":
+			vector.psk = value
+		case fields[0] == "gen_kem_seed":
+			vector.kemSeed = value
+		case fields[0] == "gen_kem_random":
+			vector.kemRandom = value
+		case strings.HasSuffix(fields[0], "_payload"):
+			vector.payloads = append(vector.payloads, value)
+		case strings.HasSuffix(fields[0], "_ciphertext"):
+			vector.ciphertexts = append(vector.ciphertexts, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return vectors
+}
+
+func TestNoiseVectors(t *testing.T) {
+	vectors := readNoiseVectors(t, "testdata/noise_vectors.txt")
+	if len(vectors) == 0 {
+		t.Fatal("no test vectors found")
+	}
+	for _, vector := range vectors {
+		testNoiseVector(t, vector)
+	}
+}
+
+// testNoiseVector runs the handshake and the transport messages of a vector
+func testNoiseVector(t *testing.T, vector *noiseVector) {
+	config, err := ParseProtocolName(vector.protocolName)
+	if err != nil {
+		t.Fatal("cannot parse", vector.protocolName, err)
+	}
+	pattern, err := getPattern(config.HandshakePattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the remote static keys are only used if they are pre-messages
+	initiator, err := InitializeWithCipherSuite(config.CipherSuite, config.HandshakePattern, true, vector.prologue, vector.initStatic, nil, vector.respStatic, nil, vector.psk)
+	if err != nil {
+		t.Fatal(vector.protocolName, err)
+	}
+	responder, err := InitializeWithCipherSuite(config.CipherSuite, config.HandshakePattern, false, vector.prologue, vector.respStatic, nil, vector.initStatic, nil, vector.psk)
+	if err != nil {
+		t.Fatal(vector.protocolName, err)
+	}
+	initiator.debugEphemeral = vector.initEphemeral
+	responder.debugEphemeral = vector.respEphemeral
+
+	var writeCiphers, readCiphers [2]*CipherState
+	for i, payload := range vector.payloads {
+		var ciphertext []byte
+		if i < len(pattern.messagePatterns) {
+			// handshake messages
+			writer, reader := initiator, responder
+			if i%2 != 0 {
+				writer, reader = responder, initiator
+			}
+			writeCiphers[0], writeCiphers[1], err = writer.WriteMessage(payload, &ciphertext)
+			if err != nil {
+				t.Fatal(vector.protocolName, "message", i, err)
+			}
+			var received []byte
+			readCiphers[0], readCiphers[1], err = reader.ReadMessage(ciphertext, &received)
+			if err != nil || !bytes.Equal(received, payload) {
+				t.Fatal(vector.protocolName, "message", i, "cannot be read", err)
+			}
+		} else {
+			// transport messages alternate between both directions
+			direction := (i - len(pattern.messagePatterns)) % 2
+			ciphertext = writeCiphers[direction].Encrypt(payload)
+			received, err := readCiphers[direction].Decrypt(ciphertext)
+			if err != nil || !bytes.Equal(received, payload) {
+				t.Fatal(vector.protocolName, "message", i, "cannot be decrypted", err)
+			}
+		}
+		if !bytes.Equal(ciphertext, vector.ciphertexts[i]) {
+			t.Fatalf("%s message %d: got %x expected %x", vector.protocolName, i, ciphertext, vector.ciphertexts[i])
+		}
+	}
+	if !bytes.Equal(initiator.HandshakeHash(), responder.HandshakeHash()) {
+		t.Fatal(vector.protocolName, "handshake hashes do not match")
+	}
+}
+
+func TestCipherSuiteConn(t *testing.T) {
+	for _, suite := range []CipherSuite{
+		{Cipher: CipherChaChaPoly, Hash: HashSHA256},
+		{Cipher: CipherAESGCM, Hash: HashBLAKE2b},
+	} {
+		clientConfig, serverConfig := configsForPattern(NoiseXX)
+		clientConfig.CipherSuite, serverConfig.CipherSuite = suite, suite
+		client, server, clientErr, serverErr := connPair(clientConfig, serverConfig)
+		if clientErr != nil || serverErr != nil {
+			t.Fatal("the handshake failed", clientErr, serverErr)
+		}
+		expected := "Noise_XX_" + suite.String()
+		if state := server.ConnectionState(); state.ProtocolName != expected {
+			t.Fatal("unexpected protocol name", state.ProtocolName, expected)
+		}
+
+		go func() {
+			buf := make([]byte, 100)
+			n, _ := server.Read(buf)
+			server.Rekey()
+			server.Write(buf[:n])
+			// wait for the client to close the connection
+			server.Read(buf)
+		}()
+		if _, err := client.Write([]byte("hello")); err != nil {
+			t.Fatal("client can't write", err)
+		}
+		buf := make([]byte, 100)
+		n, err := client.Read(buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			t.Fatal("client can't read", err)
+		}
+		client.Close()
+	}
+
+	// peers using different suites cannot talk
+	clientConfig, serverConfig := configsForPattern(NoiseNN)
+	clientConfig.CipherSuite = CipherSuite{Cipher: CipherChaChaPoly, Hash: HashSHA256}
+	if _, _, clientErr, serverErr := connPair(clientConfig, serverConfig); clientErr == nil && serverErr == nil {
+		t.Fatal("the handshake should fail")
+	}
+
+	// a suite needs both a cipher and a hash function
+	clientConfig.CipherSuite = CipherSuite{Cipher: CipherChaChaPoly}
+	if err := checkRequirements(true, clientConfig); !errors.Is(err, ErrUnknownCipherSuite) {
+		t.Fatal("expected ErrUnknownCipherSuite", err)
+	}
+}
+
+func TestCipherSuiteSerialize(t *testing.T) {
+	suite := CipherSuite{Cipher: CipherAESGCM, Hash: HashSHA512}
+	initiatorKeyPair, responderKeyPair := GenerateKeypair(nil), GenerateKeypair(nil)
+	initiator, err := InitializeWithCipherSuite(suite, NoiseIK, true, nil, initiatorKeyPair, nil, responderKeyPair, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := InitializeWithCipherSuite(suite, NoiseIK, false, nil, responderKeyPair, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message []byte
+	if _, _, err = initiator.WriteMessage([]byte("hey"), &message); err != nil {
+		t.Fatal(err)
+	}
+	var payload []byte
+	if _, _, err = responder.ReadMessage(message, &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	// the responder is serialized in the middle of the handshake
+	responder, err = RecoverState(responder.Serialize(), nil, responderKeyPair)
+	if err != nil {
+		t.Fatal("cannot recover the state", err)
+	}
+	message = message[:0]
+	responderCipher, _, err := responder.WriteMessage(nil, &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiatorCipher, _, err := initiator.ReadMessage(message, &payload)
+	if err != nil {
+		t.Fatal("cannot read the message of a recovered state", err)
+	}
+	plaintext, err := responderCipher.Decrypt(initiatorCipher.Encrypt([]byte("hello")))
+	if err != nil || string(plaintext) != "hello" {
+		t.Fatal("cannot decrypt", err)
+	}
+	if len(initiator.HandshakeHash()) != 64 {
+		t.Fatal("the handshake hash should be the size of the hash function's output")
+	}
+}
@@ -1,9 +1,19 @@
 package libdisco
 
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
 // The following constants represent the details of this implementation of the Noise specification.
 const (
 	DiscoDraftVersion = "3"
 	NoiseDH           = "25519"
+	NoiseKEM          = "MLKEM768"
+	StrobeVersion     = "STROBEv1.0.2"
 )
 
 // The following constants are taken directly from the Noise specification.
@@ -18,8 +28,16 @@ const (
 type Config struct {
 	// the type of Noise protocol that the client and the server will go through
 	HandshakePattern noiseHandshakeType
+	// the symmetric cryptography of the protocol, Strobe by default. Other
+	// suites can be used to talk to peers implementing the standard Noise specification.
+	CipherSuite CipherSuite
 	// the current peer's keyPair
 	KeyPair *KeyPair
+	// GetKeyPair, if set, is called at the start of each handshake and returns
+	// the key pair and the proof to use instead of KeyPair and StaticPublicKeyProof.
+	// This allows rotating static keys without restarting a listener, connections
+	// that are already established keep using their keys (see KeyPairReloader).
+	GetKeyPair func() (keyPair *KeyPair, proof []byte, err error)
 	// the other peer's public key
 	RemoteKey []byte
 	// any messages that the client and the server previously exchanged in clear
@@ -32,7 +50,11 @@ type Config struct {
 	// static public key as part of the handshake, this callback is mandatory in
 	// order to validate it
 	PublicKeyVerifier func(publicKey, proof []byte) bool
-	// a pre-shared key for handshake patterns including a `psk` token
+	// VerifyPublicKey can be set instead of, or in addition to, PublicKeyVerifier
+	// to validate the remote peer's static key. The error it returns fails the
+	// handshake and is returned by Handshake as is (see KnownHosts).
+	VerifyPublicKey func(publicKey, proof []byte) error
+	// a 32-byte pre-shared key for handshake patterns including a `psk` modifier
 	PreSharedKey []byte
 	// by default a noise protocol is full-duplex, meaning that both the client
 	// and the server can write on the channel at the same time. Setting this value
@@ -44,4 +66,239 @@ type Config struct {
 	// to circumvent this issue, set the following flag. After that,
 	// `net.Conn`'s `RemoteAddress().String()` will return a tuple `ip:port:pubkey`
 	RemoteAddrContainsRemotePubkey bool
+	// NoisePipes can be set with the NoiseIK handshake pattern to use Noise Pipes.
+	// A client that does not know the server's static key (RemoteKey is nil) goes
+	// through a full XX handshake. A client that knows it attempts a IK handshake,
+	// and if the server fails to decrypt it (for example because its key changed)
+	// both peers fall back to XXfallback re-using the client's ephemeral key.
+	// Both peers need a PublicKeyVerifier and a StaticPublicKeyProof.
+	NoisePipes bool
+	// RemoteKeyUpdated is called on a Noise Pipes client when it learns a new static
+	// key for the server (after a XX or a XXfallback handshake). The client should
+	// cache it and use it as RemoteKey for its next connections.
+	RemoteKeyUpdated func(publicKey []byte)
+	// HandshakePayload, if set, is called before writing each handshake message
+	// and returns application data to attach to it. messageIndex is 0 for the
+	// first message of the handshake, 1 for the second one, etc.
+	// Attached data do not benefit from the security of the finished handshake, depending
+	// on the pattern and on the position of the message they might not be encrypted,
+	// the sender might not be authenticated, and they might be replayed.
+	// For example for the main patterns (source authentication / destination
+	// confidentiality as defined in section 7.7 of the Noise specification):
+	//
+	//	       message 0        message 1        message 2
+	//	NN     none / none      none / 1         -
+	//	NK     none / 2         2 / 1            -
+	//	NX     none / none      2 / 1            -
+	//	XN     none / none      none / 1         2 / 1
+	//	XK     none / 2         2 / 1            2 / 5
+	//	XX     none / none      2 / 1            2 / 5
+	//	KN     none / none      none / 3         -
+	//	KK     1 / 2            2 / 4            -
+	//	KX     none / none      2 / 3            -
+	//	IN     none / none      none / 3         -
+	//	IK     1 / 2            2 / 4            -
+	//	IX     none / none      2 / 3            -
+	//
+	// Source 1 means that the sender is authenticated, but the authentication is
+	// vulnerable to key-compromise impersonation, 2 means that it is not.
+	// Destination 1 means encryption to an ephemeral recipient (only resists passive
+	// attackers), 2 means encryption to a known recipient, forward secret only if the
+	// sender is compromised and replayable (0-RTT data), 3 and 4 add weak forward secrecy,
+	// and 5 means strong forward secrecy.
+	// "none" for destination means that the data is sent in clear.
+	HandshakePayload func(messageIndex int) []byte
+	// HandshakePayloadReceived, if set, is called with the application data attached
+	// by the peer to each handshake message (see HandshakePayload).
+	// It is called during the handshake, before the peer's static key has been verified.
+	// Returning an error aborts the handshake.
+	HandshakePayloadReceived func(messageIndex int, payload []byte) error
+	// RekeyAfterBytes, if not zero, makes the peer automatically rekey its
+	// outgoing messages after having sent that many bytes of application data.
+	// (see Conn.Rekey)
+	RekeyAfterBytes uint64
+	// RekeyAfterRecords, if not zero, makes the peer automatically rekey its
+	// outgoing messages after having sent that many transport messages.
+	RekeyAfterRecords uint64
+	// RekeyInterval, if not zero, makes the peer automatically rekey its outgoing
+	// messages when that much time has passed since the last rekey. This is only
+	// checked when writing on the connection.
+	RekeyInterval time.Duration
+	// DiscoSocket makes the peers use the DiscoSocket framing, modeled after
+	// NoiseSocket: each handshake message is preceded by negotiation data, which
+	// lets a server pick the protocol of each client (see ListenPatterns), and the
+	// payloads of handshake and transport messages are preceded by their length
+	// and followed by padding. Both peers need to set it. It cannot be used with
+	// Noise Pipes. It is specific to Disco and does not interoperate with NoiseSocket peers.
+	DiscoSocket bool
+	// NegotiationData is sent by a DiscoSocket client with its first handshake
+	// message to tell the server which protocol it is speaking.
+	// It defaults to the protocol name of the Config (see Config.ProtocolName).
+	// It is sent in clear, and is authenticated by the handshake.
+	NegotiationData []byte
+	// SwitchPatterns are the handshake patterns that a DiscoSocket client accepts
+	// to restart the handshake with, if the server asks it to.
+	SwitchPatterns []noiseHandshakeType
+	// Negotiate, if set, is called by a DiscoSocket server with the negotiation
+	// data received from the client. It decides to accept the client's handshake,
+	// to switch to another pattern or to reject the client.
+	// By default, the server accepts clients whose negotiation data is the
+	// protocol name of its Config and rejects the others.
+	Negotiate func(negotiationData []byte) Negotiation
+	// Padding, if not zero, makes a DiscoSocket peer pad the payloads of its
+	// messages to a multiple of Padding bytes, to hide their exact length.
+	Padding int
+	// ServerName is sent by the client with its first handshake message to tell
+	// the server which service it is connecting to, for servers hosting several
+	// services behind the same address (see GetConfigForClient).
+	// It is encrypted if the server's static key is known in advance by the client
+	// (for example with NoiseNK, NoiseXK or NoiseIK), and sent in clear otherwise.
+	// Servers that do not set GetConfigForClient ignore it.
+	ServerName string
+	// GetConfigForClient, if set, is called by the server with the name of the
+	// server sent by the client (see ServerName), which is empty if the client did not set it.
+	// It returns the Config to use for the rest of the handshake, or nil to keep the
+	// current one. The returned Config must use the same handshake pattern.
+	// It can provide a different KeyPair, StaticPublicKeyProof and PublicKeyVerifier,
+	// except for keys that the handshake already used: the server's KeyPair if the
+	// client knew it in advance, the RemoteKey and the PreSharedKey.
+	// Returning an error aborts the handshake.
+	GetConfigForClient func(*ClientHelloInfo) (*Config, error)
+}
+
+// ClientHelloInfo contains information about the first handshake message of a
+// client, passed to the GetConfigForClient callback.
+type ClientHelloInfo struct {
+	// the name of the server requested by the client, empty if it did not set one
+	ServerName string
+	// the underlying connection to the client
+	Conn net.Conn
+}
+
+// Negotiation is the decision of a DiscoSocket server after receiving the
+// negotiation data of a client (see Config.Negotiate).
+type Negotiation struct {
+	// Config, if not nil, replaces the configuration of the server for this
+	// connection. It must also have DiscoSocket set.
+	Config *Config
+	// Switch, if set, asks the client to restart the handshake with this pattern
+	// instead of the one it started with. The client must list it in its SwitchPatterns.
+	Switch noiseHandshakeType
+	// Reject makes the server refuse the connection, Reason is then sent to the client.
+	Reject bool
+	Reason string
+}
+
+// ConnectionState records basic details about a Disco connection.
+type ConnectionState struct {
+	// true once the handshake has completed, the other fields are only set after that
+	HandshakeComplete bool
+	// the handshake pattern that was used, with Noise Pipes it can differ from the
+	// one in the Config (NoiseXX, NoiseIK or NoiseXX|NoiseFallback)
+	HandshakePattern noiseHandshakeType
+	// the full protocol name of the handshake, for example "Noise_XX_25519_STROBEv1.0.2"
+	ProtocolName string
+	// the name of the server sent by the client (see Config.ServerName)
+	ServerName string
+	// true if the remote peer's static key was known in advance or verified
+	RemoteAuthenticated bool
+	// the remote peer's static public key, if it has been authenticated
+	RemotePublicKey []byte
+	// the proof sent by the remote peer along with its static key, if any
+	RemoteProof []byte
+	// a value uniquely identifying the session (see Conn.ChannelBinding)
+	ChannelBinding []byte
+	// true if the same keys are used to encrypt messages in both directions,
+	// peers must then take turns to write on the connection
+	HalfDuplex bool
+	// true if a Noise Pipes client reused a cached server key to go through
+	// a successful IK handshake
+	DidResume bool
+	// number of times the keys used in each direction have been updated (see Conn.Rekey)
+	RekeysSent, RekeysReceived uint64
+	// time at which the last answer to a ping was received (see Conn.Ping)
+	LastPong time.Time
+}
+
+// resolveKeyPair returns the config, or a copy of it using the key pair and the
+// proof returned by GetKeyPair if it is set
+func (config *Config) resolveKeyPair() (*Config, error) {
+	if config.GetKeyPair == nil {
+		return config, nil
+	}
+	keyPair, proof, err := config.GetKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if keyPair == nil {
+		return nil, newError(ErrInvalidKey, "disco: GetKeyPair did not return a key pair")
+	}
+	resolved := *config
+	resolved.KeyPair = keyPair
+	resolved.StaticPublicKeyProof = proof
+	resolved.GetKeyPair = nil
+	return &resolved, nil
+}
+
+// hasVerifier returns true if the config can validate the remote peer's static key
+func (config *Config) hasVerifier() bool {
+	return config.PublicKeyVerifier != nil || config.VerifyPublicKey != nil
+}
+
+// ProtocolName returns the full protocol name of the Config,
+// for example "Noise_IKpsk2_25519_STROBEv1.0.2" or "Noise_XX_25519_ChaChaPoly_SHA256".
+// This is the name used to initialize the handshake, both peers must
+// agree on it.
+func (config *Config) ProtocolName() (string, error) {
+	pattern, err := getPattern(config.HandshakePattern)
+	if err != nil {
+		return "", err
+	}
+	if err := config.CipherSuite.check(); err != nil {
+		return "", err
+	}
+	return protocolName(pattern, config.CipherSuite), nil
+}
+
+// protocolName builds a full protocol name out of a pattern and a cipher suite
+func protocolName(pattern handshakePattern, suite CipherSuite) string {
+	suiteName := suite.String()
+	if pattern.hfs {
+		// the KEM follows the DH function, for example "25519+MLKEM768_STROBEv1.0.2"
+		suiteName = strings.Replace(suiteName, "_", "+"+NoiseKEM+"_", 1)
+	}
+	return "Noise_" + pattern.name + "_" + suiteName
+}
+
+// ParseProtocolName parses a full protocol name like "Noise_IKpsk2_25519_STROBEv1.0.2"
+// or "Noise_XX_448_AESGCM_SHA256" and returns a new Config with the corresponding
+// HandshakePattern and CipherSuite.
+// The rest of the configuration (keys, proofs, verifiers, etc.) still needs to be filled.
+// An error is returned if the protocol name is malformed or not supported by this implementation.
+func ParseProtocolName(protocolName string) (*Config, error) {
+	fields := strings.SplitN(protocolName, "_", 3)
+	if len(fields) != 3 {
+		return nil, errors.New("disco: protocol name " + strconv.Quote(protocolName) + " should be of the form Noise_<pattern>_<DH>_<symmetric>")
+	}
+	if fields[0] != "Noise" {
+		return nil, errors.New("disco: protocol name " + strconv.Quote(protocolName) + " should start with Noise_")
+	}
+	handshakeType, err := parseHandshakePattern(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	suiteName := fields[2]
+	if handshakeType&NoiseHFS != 0 {
+		// the KEM follows the DH function, for example "25519+MLKEM768_STROBEv1.0.2"
+		dhName := strings.SplitN(suiteName, "_", 2)[0]
+		if !strings.HasSuffix(dhName, "+"+NoiseKEM) {
+			return nil, newError(ErrUnknownCipherSuite, "disco: hfs patterns should use the KEM "+NoiseKEM)
+		}
+		suiteName = strings.TrimSuffix(dhName, "+"+NoiseKEM) + suiteName[len(dhName):]
+	}
+	suite, err := parseCipherSuite(suiteName)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{HandshakePattern: handshakeType, CipherSuite: suite}, nil
 }
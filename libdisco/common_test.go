@@ -0,0 +1,73 @@
+package libdisco
+
+import "testing"
+
+func TestParseProtocolName(t *testing.T) {
+	validNames := []struct {
+		name          string
+		handshakeType noiseHandshakeType
+		suite         CipherSuite
+	}{
+		{"Noise_XX_25519_STROBEv1.0.2", NoiseXX, CipherSuite{}},
+		{"Noise_IKpsk2_25519_STROBEv1.0.2", NoiseIK | NoisePSK2, CipherSuite{}},
+		{"Noise_NNpsk0+psk2_25519_STROBEv1.0.2", NoiseNN | NoisePSK0 | NoisePSK2, CipherSuite{}},
+		{"Noise_N_25519_STROBEv1.0.2", NoiseN, CipherSuite{}},
+		{"Noise_XX_25519_ChaChaPoly_SHA256", NoiseXX, CipherSuite{Cipher: CipherChaChaPoly, Hash: HashSHA256}},
+		{"Noise_IK_25519_AESGCM_BLAKE2b", NoiseIK, CipherSuite{Cipher: CipherAESGCM, Hash: HashBLAKE2b}},
+		{"Noise_XX_448_STROBEv1.0.2", NoiseXX, CipherSuite{DH: DH448}},
+		{"Noise_NK_ristretto255_ChaChaPoly_BLAKE2s", NoiseNK, CipherSuite{DH: DHRistretto255, Cipher: CipherChaChaPoly, Hash: HashBLAKE2s}},
+		{"Noise_XXhfs_25519+MLKEM768_STROBEv1.0.2", NoiseXXhfs, CipherSuite{}},
+		{"Noise_IKhfs+psk2_448+MLKEM768_ChaChaPoly_SHA256", NoiseIKhfs | NoisePSK2, CipherSuite{DH: DH448, Cipher: CipherChaChaPoly, Hash: HashSHA256}},
+	}
+	for _, valid := range validNames {
+		config, err := ParseProtocolName(valid.name)
+		if err != nil {
+			t.Fatal("valid protocol name rejected", valid.name, err)
+		}
+		if config.HandshakePattern != valid.handshakeType || config.CipherSuite != valid.suite {
+			t.Fatal("protocol name", valid.name, "parsed as", config.HandshakePattern, config.CipherSuite)
+		}
+		// round trip
+		protocolName, err := config.ProtocolName()
+		if err != nil || protocolName != valid.name {
+			t.Fatal("protocol name", valid.name, "does not round trip", protocolName, err)
+		}
+	}
+
+	invalidNames := []string{
+		"",
+		"Noise_XX_25519",
+		"Disco_XX_25519_STROBEv1.0.2",
+		"Noise_ZZ_25519_STROBEv1.0.2",
+		"Noise_XXpsk9_25519_STROBEv1.0.2",
+		"Noise_XXpsk_25519_STROBEv1.0.2",
+		"Noise_XXfoo_25519_STROBEv1.0.2",
+		"Noise_NNpsk2+psk0_25519_STROBEv1.0.2",
+		"Noise_NKpsk3_25519_STROBEv1.0.2",
+		"Noise_XX_P256_STROBEv1.0.2",
+		"Noise_XX_448",
+		"Noise_XXhfs_25519_STROBEv1.0.2",
+		"Noise_XX_25519+MLKEM768_STROBEv1.0.2",
+		"Noise_Nhfs_25519+MLKEM768_STROBEv1.0.2",
+		"Noise_XXhfs_25519+MLKEM1024_STROBEv1.0.2",
+		"Noise_XX_25519_STROBEv1.0.1",
+		"Noise_XX_25519_ChaChaPoly",
+		"Noise_XX_25519_ChaChaPoly_MD5",
+		"Noise_XX_25519_STROBEv1.0.2_SHA256",
+		"Noise_XX_25519_SHA256_ChaChaPoly",
+	}
+	for _, name := range invalidNames {
+		if _, err := ParseProtocolName(name); err == nil {
+			t.Fatal("invalid protocol name accepted", name)
+		}
+	}
+}
+
+func TestHandshakeTypeString(t *testing.T) {
+	if NoiseNNpsk2.String() != "NNpsk2" {
+		t.Fatal("unexpected name for NNpsk2", NoiseNNpsk2.String())
+	}
+	if (NoiseXX | NoisePSK0 | NoisePSK3).String() != "XXpsk0+psk3" {
+		t.Fatal("unexpected name for XXpsk0+psk3", (NoiseXX | NoisePSK0 | NoisePSK3).String())
+	}
+}
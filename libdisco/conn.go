@@ -2,42 +2,92 @@ package libdisco
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"io"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/mimoo/StrobeGo/strobe"
 )
 
 // A Conn represents a secured connection.
 // It implements the net.Conn interface.
 type Conn struct {
+	// number of rekeys in each direction, accessed atomically
+	// (first in the struct to be 64-bit aligned)
+	rekeysSent, rekeysReceived uint64
+	// time of the last pong received, in nanoseconds since the Unix epoch, accessed atomically
+	lastPong int64
+
 	conn     net.Conn
 	isClient bool
 
 	// handshake
-	config            *Config // configuration passed to constructor
+	config            *Config // configuration passed to constructor, the handshake might replace it (see getConfig)
 	handshakeComplete bool
 	handshakeMutex    sync.Mutex
+	// same as handshakeComplete, but can be read atomically without holding handshakeMutex
+	handshakeDone int32
 
 	// Authentication thingies
 	isRemoteAuthenticated bool
 	remotePublicKey       string
+	remoteProof           []byte
+
+	// the name of the server sent by the client (see Config.ServerName)
+	serverName string
+
+	// number of handshake messages sent and received so far
+	handshakeMessageIndex int
+	// the handshake pattern that was actually used
+	handshakePattern noiseHandshakeType
+
+	// channel binding
+	handshakeHash []byte
 
 	// input/output
-	in, out         *strobe.Strobe
+	in, out         *CipherState
 	inLock, outLock sync.Mutex
 	inputBuffer     []byte
 
 	// half duplex
 	isHalfDuplex   bool
 	halfDuplexLock sync.Mutex
+
+	// close notifications and alerts
+	shutdownSent        bool  // a close notification or an alert has been sent, protected by the write lock
+	closeNotifyReceived bool  // protected by the read lock
+	readErr             error // an alert received or a fatal error, protected by the read lock
+
+	// rekey: what has been sent since the last rekey
+	outBytes, outRecords uint64
+	lastRekey            time.Time
 }
 
+// Each transport message carries a record: a record type byte followed by its content
+const (
+	recordTypeData  byte = 0 // application data
+	recordTypeRekey byte = 1 // the sender rekeyed its outgoing CipherState after this record
+	recordTypeClose byte = 2 // the sender will not send anything else
+	recordTypePing  byte = 3 // the receiver should answer with a pong
+	recordTypePong  byte = 4 // answer to a ping
+	recordTypeAlert byte = 5 // alert code (1 byte) followed by a description, the sender will not send anything else
+
+	maxRecordDataSize = NoiseMaxPlaintextSize - 1
+	// with DiscoSocket, records are preceded by their 2-byte length
+	maxDiscoSocketRecordDataSize = maxRecordDataSize - 2
+
+	// how long Close waits for the close notification to be sent
+	closeNotifyTimeout = 5 * time.Second
+	// how long a failed handshake waits for the alert to be sent,
+	// so that the error is not delayed by a peer that is not reading
+	alertTimeout = 100 * time.Millisecond
+)
+
 // Access to net.Conn methods.
 // Cannot just embed net.Conn because that would
 // export the struct field too.
@@ -65,7 +115,7 @@ func (a Addr) String() string {
 
 // RemoteAddr returns the remote network address.
 func (c *Conn) RemoteAddr() net.Addr {
-	if c.config.RemoteAddrContainsRemotePubkey && c.handshakeComplete {
+	if atomic.LoadInt32(&c.handshakeDone) == 1 && c.config.RemoteAddrContainsRemotePubkey {
 		return &Addr{
 			network: "tcp",
 			address: c.conn.RemoteAddr().String() + ":" + c.remotePublicKey,
@@ -98,14 +148,18 @@ func (c *Conn) SetWriteDeadline(t time.Time) error {
 func (c *Conn) Write(b []byte) (int, error) {
 
 	//
-	if hp := c.config.HandshakePattern; !c.isClient && (hp == NoiseN || hp == NoiseK || hp == NoiseX) {
-		panic("disco: a server should not write on one-way patterns")
+	if !c.isClient && c.getConfig().HandshakePattern.isOneWay() {
+		return 0, newError(ErrOneWay, "disco: a server should not write on one-way patterns")
 	}
 
 	// Make sure to go through the handshake first
 	if err := c.Handshake(); err != nil {
 		return 0, err
 	}
+	// a DiscoSocket server might only know the pattern after the negotiation
+	if !c.canWrite() {
+		return 0, newError(ErrOneWay, "disco: a server should not write on one-way patterns")
+	}
 
 	// Lock the write socket
 	if c.isHalfDuplex {
@@ -116,28 +170,31 @@ func (c *Conn) Write(b []byte) (int, error) {
 		defer c.outLock.Unlock()
 	}
 
+	if c.shutdownSent {
+		return 0, ErrShutdown
+	}
+
 	// process the data in a loop
 	var n int
 	data := b
 	buf := bytes.NewBuffer(data)
 	for buf.Len() > 0 {
-		// fragment the data
-		fragment := buf.Next(NoiseMaxPlaintextSize)
-
-		// Encrypt
-		ciphertext := c.out.Send_ENC_unauthenticated(false, fragment)
-		ciphertext = append(ciphertext, c.out.Send_MAC(false, 16)...)
+		// automatic rekey
+		if c.shouldRekey() {
+			if err := c.rekey(); err != nil {
+				return n, err
+			}
+		}
 
-		// header (length)
-		length := make([]byte, 2)
-		binary.BigEndian.PutUint16(length, uint16(len(ciphertext)))
+		// fragment the data
+		fragment := buf.Next(c.maxFragmentSize())
 
 		// Send data
-		_, err := c.conn.Write(append(length, ciphertext...))
-		if err != nil {
+		if err := c.writeRecord(recordTypeData, fragment); err != nil {
 			return n, err
 		}
 		n += len(fragment)
+		c.outBytes += uint64(len(fragment))
 		/*
 			// TODO: should we test if we sent the correct number of bytes?
 			if _ != len(ciphertext) {
@@ -149,8 +206,174 @@ func (c *Conn) Write(b []byte) (int, error) {
 	return n, nil
 }
 
+// writeRecord encrypts and sends a single record, the caller must hold the write lock
+func (c *Conn) writeRecord(recordType byte, data []byte) error {
+	// Encrypt
+	plaintext := append([]byte{recordType}, data...)
+	if c.config.DiscoSocket {
+		plaintext = discoSocketBody(plaintext, c.config.Padding)
+	}
+	ciphertext := c.out.Encrypt(plaintext)
+
+	// header (length)
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(ciphertext)))
+
+	_, err := c.conn.Write(append(length, ciphertext...))
+	c.outRecords++
+	return err
+}
+
+// maxFragmentSize returns the maximum size of the data carried by a single record
+func (c *Conn) maxFragmentSize() int {
+	if c.config.DiscoSocket {
+		return maxDiscoSocketRecordDataSize
+	}
+	return maxRecordDataSize
+}
+
+// shouldRekey returns true if one of the automatic rekey thresholds has been reached
+func (c *Conn) shouldRekey() bool {
+	return (c.config.RekeyAfterBytes > 0 && c.outBytes >= c.config.RekeyAfterBytes) ||
+		(c.config.RekeyAfterRecords > 0 && c.outRecords >= c.config.RekeyAfterRecords) ||
+		(c.config.RekeyInterval > 0 && time.Since(c.lastRekey) >= c.config.RekeyInterval)
+}
+
+// rekey signals the peer and rekeys the outgoing CipherState, the caller must hold the write lock
+func (c *Conn) rekey() error {
+	if err := c.writeRecord(recordTypeRekey, nil); err != nil {
+		return err
+	}
+	c.out.Rekey()
+	atomic.AddUint64(&c.rekeysSent, 1)
+	c.outBytes, c.outRecords = 0, 0
+	c.lastRekey = time.Now()
+	return nil
+}
+
+// Rekey updates the key used to encrypt the messages sent to the peer.
+// The peer is notified in-band and rekeys its own receiving side when it reads the
+// notification, messages sent in the other direction are not affected (the peer can
+// call Rekey on its side as well).
+// Rekeying regularly on long-lived connections limits the amount of data that
+// a compromised key can decrypt. See also the Rekey options of Config to do this automatically.
+func (c *Conn) Rekey() error {
+	if !c.isClient && c.getConfig().HandshakePattern.isOneWay() {
+		return newError(ErrOneWay, "disco: a server should not write on one-way patterns")
+	}
+
+	// Make sure to go through the handshake first
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	if !c.canWrite() {
+		return newError(ErrOneWay, "disco: a server should not write on one-way patterns")
+	}
+
+	// Lock the write socket
+	if c.isHalfDuplex {
+		c.halfDuplexLock.Lock()
+		defer c.halfDuplexLock.Unlock()
+	} else {
+		c.outLock.Lock()
+		defer c.outLock.Unlock()
+	}
+
+	if c.shutdownSent {
+		return ErrShutdown
+	}
+	return c.rekey()
+}
+
+// Ping sends a ping to the peer, which answers with a pong as soon as it reads it.
+// It can be used to keep an idle connection alive, the time of the last pong
+// received (by Read) is available in ConnectionState.
+// Both peers need to be able to write, so it cannot be used on one-way patterns.
+func (c *Conn) Ping() error {
+	if c.getConfig().HandshakePattern.isOneWay() {
+		return newError(ErrOneWay, "disco: pings cannot be answered on one-way patterns")
+	}
+
+	// Make sure to go through the handshake first
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	if c.config.HandshakePattern.isOneWay() {
+		return newError(ErrOneWay, "disco: pings cannot be answered on one-way patterns")
+	}
+
+	// Lock the write socket
+	if c.isHalfDuplex {
+		c.halfDuplexLock.Lock()
+		defer c.halfDuplexLock.Unlock()
+	} else {
+		c.outLock.Lock()
+		defer c.outLock.Unlock()
+	}
+
+	if c.shutdownSent {
+		return ErrShutdown
+	}
+	return c.writeRecord(recordTypePing, nil)
+}
+
+// SendAlert sends an alert to the peer, which will receive it as an *AlertError
+// from Read, and shuts down the connection for writing.
+// The description is optional and sent along with the code.
+func (c *Conn) SendAlert(code AlertCode, description string) error {
+	// Make sure to go through the handshake first
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	if !c.canWrite() {
+		return newError(ErrOneWay, "disco: a server should not write on one-way patterns")
+	}
+
+	// Lock the write socket
+	if c.isHalfDuplex {
+		c.halfDuplexLock.Lock()
+		defer c.halfDuplexLock.Unlock()
+	} else {
+		c.outLock.Lock()
+		defer c.outLock.Unlock()
+	}
+
+	if c.shutdownSent {
+		return ErrShutdown
+	}
+	return c.sendAlertLocked(code, description)
+}
+
+// sendAlertLocked sends an alert, the caller must hold the write lock
+func (c *Conn) sendAlertLocked(code AlertCode, description string) error {
+	if len(description) > c.maxFragmentSize()-1 {
+		description = description[:c.maxFragmentSize()-1]
+	}
+	c.shutdownSent = true
+	return c.writeRecord(recordTypeAlert, append([]byte{byte(code)}, description...))
+}
+
+// writeRecordFromRead writes a record in answer to a record received, the
+// caller must hold the read lock (which is also the write lock in half-duplex)
+func (c *Conn) writeRecordFromRead(recordType byte, data []byte) error {
+	if !c.isHalfDuplex {
+		c.outLock.Lock()
+		defer c.outLock.Unlock()
+	}
+	if c.shutdownSent {
+		return ErrShutdown
+	}
+	if recordType == recordTypeAlert {
+		return c.sendAlertLocked(AlertCode(data[0]), string(data[1:]))
+	}
+	return c.writeRecord(recordType, data)
+}
+
 // Read can be made to time out and return a net.Error with Timeout() == true
 // after a fixed time limit; see SetDeadline and SetReadDeadline.
+// Read returns io.EOF once the peer has closed the connection (see Close and CloseWrite).
+// If the connection ends without the peer having sent a close notification,
+// Read returns an error matching ErrTruncated instead.
 func (c *Conn) Read(b []byte) (n int, err error) {
 	// Make sure to go through the handshake first
 	if err = c.Handshake(); err != nil {
@@ -164,8 +387,8 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 	}
 
 	// If this is a one-way pattern, do some checks
-	if hp := c.config.HandshakePattern; c.isClient && (hp == NoiseN || hp == NoiseK || hp == NoiseX) {
-		panic("disco: a client should not read on one-way patterns")
+	if c.isClient && c.config.HandshakePattern.isOneWay() {
+		return 0, newError(ErrOneWay, "disco: a client should not read on one-way patterns")
 	}
 
 	// Lock the read socket
@@ -189,36 +412,56 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 		c.inputBuffer = c.inputBuffer[:0]
 	}
 
-	// read header from socket
-	bufHeader := make([]byte, 2)
-	if _, err := io.ReadFull(c.conn, bufHeader); err != nil {
-		return readSoFar, err
+	// the peer will not send anything else
+	if c.closeNotifyReceived {
+		return readSoFar, io.EOF
 	}
-	length := binary.BigEndian.Uint16(bufHeader)
-	if length > NoiseMessageLength {
-		return readSoFar, errors.New("disco: Disco message received exceeds DiscoMessageLength")
+	if c.readErr != nil {
+		return readSoFar, c.readErr
 	}
 
-	// read noise message from socket
-	noiseMessage := make([]byte, length)
-	if _, err := io.ReadFull(c.conn, noiseMessage); err != nil {
-		return readSoFar, err
-	}
-
-	// decrypt
-	if length < 16 {
-		return readSoFar, errors.New("disco: the received payload is shorter 16 bytes")
-	}
-
-	plaintext := c.in.Recv_ENC_unauthenticated(false, noiseMessage[:len(noiseMessage)-16])
-	ok := c.in.Recv_MAC(false, noiseMessage[len(noiseMessage)-16:])
-	if !ok {
-		return readSoFar, errors.New("disco: cannot decrypt the payload")
+	// read records until we receive application data
+	for len(c.inputBuffer) == 0 {
+		recordType, data, err := c.readRecord()
+		if err != nil {
+			// let the peer know why the connection failed
+			if errors.Is(err, ErrDecrypt) {
+				c.readErr = err
+				c.writeRecordFromRead(recordTypeAlert, []byte{byte(AlertDecryptError)})
+			}
+			return readSoFar, err
+		}
+		switch recordType {
+		case recordTypeData:
+			// append to the input buffer
+			c.inputBuffer = append(c.inputBuffer, data...)
+		case recordTypeRekey:
+			c.in.Rekey()
+			atomic.AddUint64(&c.rekeysReceived, 1)
+		case recordTypeClose:
+			c.closeNotifyReceived = true
+			return readSoFar, io.EOF
+		case recordTypePing:
+			if c.canWrite() {
+				if err := c.writeRecordFromRead(recordTypePong, nil); err != nil && err != ErrShutdown {
+					return readSoFar, err
+				}
+			}
+		case recordTypePong:
+			atomic.StoreInt64(&c.lastPong, time.Now().UnixNano())
+		case recordTypeAlert:
+			if len(data) == 0 {
+				data = []byte{byte(AlertUnexpectedMessage)}
+			}
+			c.readErr = &AlertError{Code: AlertCode(data[0]), Description: string(data[1:])}
+			return readSoFar, c.readErr
+		default:
+			c.readErr = newError(ErrMalformedMessage, "disco: received a record of unknown type")
+			c.writeRecordFromRead(recordTypeAlert, []byte{byte(AlertUnexpectedMessage)})
+			return readSoFar, c.readErr
+		}
 	}
 
-	// append to the input buffer
-	c.inputBuffer = append(c.inputBuffer, plaintext...)
-
 	// read whatever we can read
 	rest := len(b) - readSoFar
 	copy(b[readSoFar:], c.inputBuffer)
@@ -236,9 +479,125 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 
 }
 
+// readRecord reads and decrypts the next transport message, the caller must hold the read lock
+func (c *Conn) readRecord() (recordType byte, data []byte, err error) {
+	// read header from socket
+	bufHeader := make([]byte, 2)
+	if _, err := io.ReadFull(c.conn, bufHeader); err != nil {
+		return 0, nil, truncationError(err)
+	}
+	length := binary.BigEndian.Uint16(bufHeader)
+	if length > NoiseMessageLength {
+		return 0, nil, newError(ErrMessageTooLarge, "disco: Disco message received exceeds DiscoMessageLength")
+	}
+
+	// read noise message from socket
+	noiseMessage := make([]byte, length)
+	if _, err := io.ReadFull(c.conn, noiseMessage); err != nil {
+		return 0, nil, truncationError(err)
+	}
+
+	// decrypt
+	plaintext, err := c.in.Decrypt(noiseMessage)
+	if err != nil {
+		return 0, nil, err
+	}
+	if c.config.DiscoSocket {
+		if plaintext, err = parseDiscoSocketBody(plaintext); err != nil {
+			return 0, nil, err
+		}
+	}
+	if len(plaintext) == 0 {
+		return 0, nil, newError(ErrMalformedMessage, "disco: received an empty record")
+	}
+
+	return plaintext[0], plaintext[1:], nil
+}
+
+// truncationError converts the end of the underlying connection into ErrTruncated,
+// as a legitimate end of the connection is announced by a close notification
+func truncationError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
+
 // Close closes the connection.
+// If the handshake has completed, an authenticated close notification is
+// sent to the peer first, so that it can tell the end of the connection
+// apart from a truncation (see Read).
 func (c *Conn) Close() error {
-	return c.conn.Close()
+	var notifyErr error
+	if atomic.LoadInt32(&c.handshakeDone) == 1 && c.canWrite() {
+		// do not wait forever on a pending Write
+		c.conn.SetWriteDeadline(time.Now().Add(closeNotifyTimeout))
+		notifyErr = c.closeNotify()
+	}
+	if err := c.conn.Close(); err != nil {
+		return err
+	}
+	return notifyErr
+}
+
+// CloseWrite shuts down the writing side of the connection: a close notification
+// is sent to the peer, which will then read io.EOF, and further writes fail with ErrShutdown.
+// If the underlying connection supports it (like a *net.TCPConn), its writing side is closed as well.
+// It should only be called once the handshake has completed.
+func (c *Conn) CloseWrite() error {
+	if atomic.LoadInt32(&c.handshakeDone) == 0 {
+		return ErrHandshakeIncomplete
+	}
+	if !c.canWrite() {
+		return newError(ErrOneWay, "disco: a server should not write on one-way patterns")
+	}
+	if err := c.closeNotify(); err != nil {
+		return err
+	}
+	if conn, ok := c.conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return nil
+}
+
+// getConfig returns the configuration of the connection. Until the handshake
+// completes, the handshake might replace it (see Config.GetKeyPair,
+// Config.GetConfigForClient and Config.DiscoSocket).
+func (c *Conn) getConfig() *Config {
+	if atomic.LoadInt32(&c.handshakeDone) == 1 {
+		return c.config
+	}
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	return c.config
+}
+
+// canWrite returns false for a server using a one-way pattern, the caller
+// must hold handshakeMutex or have completed the handshake
+func (c *Conn) canWrite() bool {
+	return c.isClient || !c.config.HandshakePattern.isOneWay()
+}
+
+// closeNotify sends a close notification to the peer if it has not already been sent
+func (c *Conn) closeNotify() error {
+	// Lock the write socket
+	if c.isHalfDuplex {
+		c.halfDuplexLock.Lock()
+		defer c.halfDuplexLock.Unlock()
+	} else {
+		c.outLock.Lock()
+		defer c.outLock.Unlock()
+	}
+
+	if c.shutdownSent {
+		return nil
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(closeNotifyTimeout))
+	err := c.writeRecord(recordTypeClose, nil)
+	c.shutdownSent = true
+	// any further write fails
+	c.conn.SetWriteDeadline(time.Now())
+	return err
 }
 
 //
@@ -249,7 +608,65 @@ func (c *Conn) Close() error {
 // it has not yet been run.
 // Most uses of this package need not call Handshake explicitly:
 // the first Read or Write will call it automatically.
+// For control over canceling or setting a timeout on a handshake, use HandshakeContext.
 func (c *Conn) Handshake() error {
+	return c.HandshakeContext(context.Background())
+}
+
+// HandshakeContext runs the client or server handshake protocol if
+// it has not yet been run.
+// If the context is cancelled or expires before the handshake completes, the
+// handshake is interrupted, the underlying connection is closed and the
+// context's error is returned. Once the handshake has completed, cancellation
+// of the context does not affect the connection.
+func (c *Conn) HandshakeContext(ctx context.Context) error {
+	if ctx.Done() == nil {
+		return c.handshake(nil)
+	}
+
+	c.handshakeMutex.Lock()
+	complete := c.handshakeComplete
+	c.handshakeMutex.Unlock()
+	if complete {
+		return nil
+	}
+
+	// close the connection if the context is done during the handshake,
+	// the handshake and the interruption cannot both succeed (see handshake)
+	var state int32
+	done := make(chan struct{})
+	interrupted := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if atomic.CompareAndSwapInt32(&state, handshakeRunning, handshakeInterrupted) {
+				c.conn.Close()
+				interrupted <- ctx.Err()
+				return
+			}
+			interrupted <- nil
+		case <-done:
+			interrupted <- nil
+		}
+	}()
+	err := c.handshake(&state)
+	close(done)
+	if ctxErr := <-interrupted; ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// states of a handshake run by HandshakeContext
+const (
+	handshakeRunning int32 = iota
+	handshakeCompleted
+	handshakeInterrupted
+)
+
+// handshake runs the handshake. If state is not nil, the handshake only completes
+// if it can move state from handshakeRunning to handshakeCompleted.
+func (c *Conn) handshake(state *int32) error {
 
 	// Locking the handshakeMutex
 	c.handshakeMutex.Lock()
@@ -260,70 +677,42 @@ func (c *Conn) Handshake() error {
 		return nil
 	}
 
-	// Disco.initialize(handshakePattern string, initiator bool, prologue []byte, s, e, rs, re *KeyPair) (h handshakeState)
-	var remoteKeyPair *KeyPair
-	if c.config.RemoteKey != nil {
-		if len(c.config.RemoteKey) != 32 {
-			return errors.New("disco: the provided remote key is not 32-byte")
-		}
-		remoteKeyPair = &KeyPair{}
-		copy(remoteKeyPair.PublicKey[:], c.config.RemoteKey)
+	// the current key pair, if it is obtained dynamically
+	config, err := c.config.resolveKeyPair()
+	if err != nil {
+		return err
 	}
-	hs := Initialize(c.config.HandshakePattern, c.isClient, c.config.Prologue, c.config.KeyPair, nil, remoteKeyPair, nil)
+	c.config = config
 
-	// pre-shared key
-	hs.psk = c.config.PreSharedKey
+	// Disco.initialize(handshakePattern string, initiator bool, prologue []byte, s, e, rs, re *KeyPair, psk []byte) (h *HandshakeState, err error)
+	remoteKeyPair, err := c.remoteKeyPair()
+	if err != nil {
+		return err
+	}
 
 	// start handshake
-	var c1, c2 *strobe.Strobe
-	var err error
-	var receivedPayload []byte
-ContinueHandshake:
-	if hs.shouldWrite {
-		// we're writing the next message pattern
-		// if it's the message pattern and we're sending a static key, we also send a proof
-		// TODO: is this the best way of sending a proof :/ ?
-		var bufToWrite []byte
-		var proof []byte
-		if len(hs.messagePatterns) <= 2 {
-			proof = c.config.StaticPublicKeyProof
-		}
-		c1, c2, err = hs.WriteMessage(proof, &bufToWrite)
-		if err != nil {
-			return err
-		}
-		// header (length)
-		length := make([]byte, 2)
-		binary.BigEndian.PutUint16(length, uint16(len(bufToWrite)))
-		// write
-		_, err = c.conn.Write(append(length, bufToWrite...))
-		if err != nil {
-			return err
+	var hs *HandshakeState
+	var c1, c2 *CipherState
+	if c.config.NoisePipes {
+		hs, c1, c2, err = c.noisePipesHandshake(remoteKeyPair)
+	} else if c.config.DiscoSocket {
+		hs, c1, c2, err = c.discoSocketHandshake()
+		if err == nil {
+			// the negotiation might have changed the configuration
+			remoteKeyPair, err = c.remoteKeyPair()
 		}
-
 	} else {
-		// we're reading the next message pattern, as well as reacting to any received data
-		bufHeader := make([]byte, 2) // length header
-		if _, err := io.ReadFull(c.conn, bufHeader); err != nil {
-			return err
-		}
-		length := binary.BigEndian.Uint16(bufHeader)
-		if length > NoiseMessageLength {
-			return errors.New("disco: Disco message received exceeds DiscoMessageLength")
-		}
-		noiseMessage := make([]byte, length) // noise message
-		if _, err := io.ReadFull(c.conn, noiseMessage); err != nil {
-			return err
-		}
-		c1, c2, err = hs.ReadMessage(noiseMessage, &receivedPayload)
+		c.handshakePattern = c.config.HandshakePattern
+		hs, err = InitializeWithCipherSuite(c.config.CipherSuite, c.config.HandshakePattern, c.isClient, c.prologue(), c.config.KeyPair, nil, remoteKeyPair, nil, c.config.PreSharedKey)
 		if err != nil {
 			return err
 		}
+		// over datagrams, the transport messages carry explicit nonces
+		_, hs.datagram = c.conn.(*handshakeTransport)
+		c1, c2, err = c.continueHandshake(hs)
 	}
-
-	// handshake not finished
-	if c1 == nil {
-		goto ContinueHandshake
+	if err != nil {
+		return err
 	}
 
 	// setup the Write and Read secure channels
@@ -331,8 +720,29 @@ ContinueHandshake:
 		return errors.New("noise: the handshake did not return a secure channel to Write and Read from")
 	}
 
+	// Processing the final handshake message returns two CipherState objects
+	// the first for encrypting transport messages from initiator to responder
+	// and the second for messages in the other direction.
+	if c2 != nil {
+		if c.isClient {
+			c.out, c.in = c1, c2
+		} else {
+			c.out, c.in = c2, c1
+		}
+	} else {
+		c.isHalfDuplex = true
+		c.in = c1
+		c.out = c1
+	}
+
+	// a remote static key that was known prior to the handshake is authenticated
+	if remoteKeyPair != nil && bytes.Equal(remoteKeyPair.PublicKey, hs.rs.PublicKey) {
+		c.isRemoteAuthenticated = true
+		c.remotePublicKey = hex.EncodeToString(hs.rs.PublicKey[:])
+	}
+
 	// Has the other peer been authenticated so far?
-	if !c.isRemoteAuthenticated && c.config.PublicKeyVerifier != nil {
+	if !c.isRemoteAuthenticated && c.config.hasVerifier() {
 		// test if remote static key is empty
 		isRemoteStaticKeySet := byte(0)
 		for _, val := range hs.rs.PublicKey {
@@ -340,8 +750,15 @@ ContinueHandshake:
 		}
 		if isRemoteStaticKeySet != 0 {
 			// a remote static key has been received. Verify it
-			if !c.config.PublicKeyVerifier(hs.rs.PublicKey[:], receivedPayload) {
-				return errors.New("disco: the received public key could not be authenticated")
+			if err := c.verifyPublicKey(hs.rs.PublicKey, c.remoteProof); err != nil {
+				// let the peer know, unless it cannot read (one-way patterns)
+				// or the transport does not carry records (datagrams)
+				if _, isDatagram := c.conn.(*handshakeTransport); c.canWrite() && !isDatagram {
+					c.conn.SetWriteDeadline(time.Now().Add(alertTimeout))
+					c.sendAlertLocked(AlertAuthFailed, "the static public key could not be verified")
+					c.conn.SetWriteDeadline(time.Time{})
+				}
+				return err
 			}
 			// authenticated!
 			c.isRemoteAuthenticated = true
@@ -349,47 +766,456 @@ ContinueHandshake:
 		}
 	}
 
-	// Processing the final handshake message returns two CipherState objects
-	// the first for encrypting transport messages from initiator to responder
-	// and the second for messages in the other direction.
-	if c2 != nil {
-		if c.isClient {
-			c.out, c.in = c1, c2
-		} else {
-			c.out, c.in = c2, c1
-		}
-	} else {
-		c.isHalfDuplex = true
-		c.in = c1
-		c.out = c1
+	// Noise Pipes: let the client cache the server's static key for the next IK handshake
+	if c.config.NoisePipes && c.isClient && c.config.RemoteKeyUpdated != nil &&
+		(remoteKeyPair == nil || !bytes.Equal(remoteKeyPair.PublicKey, hs.rs.PublicKey)) {
+		c.config.RemoteKeyUpdated(append([]byte{}, hs.rs.PublicKey[:]...))
 	}
 
-	// TODO: preserve c.hs.symmetricState.h
 	// At that point the HandshakeState should be deleted except for the hash value h, which may be used for post-handshake channel binding (see Section 11.2).
+	c.handshakeHash = hs.HandshakeHash()
 	hs.clear()
 
+	c.lastRekey = time.Now()
+
+	// HandshakeContext might have closed the connection in the meantime
+	if state != nil && !atomic.CompareAndSwapInt32(state, handshakeRunning, handshakeCompleted) {
+		return errors.New("disco: the handshake was interrupted")
+	}
+
 	// no errors :)
 	c.handshakeComplete = true
+	atomic.StoreInt32(&c.handshakeDone, 1)
+	return nil
+}
+
+// verifyPublicKey validates the remote static key with PublicKeyVerifier and VerifyPublicKey
+func (c *Conn) verifyPublicKey(publicKey, proof []byte) error {
+	if c.config.PublicKeyVerifier != nil && !c.config.PublicKeyVerifier(publicKey, proof) {
+		return ErrAuthFailed
+	}
+	if c.config.VerifyPublicKey != nil {
+		return c.config.VerifyPublicKey(publicKey, proof)
+	}
+	return nil
+}
+
+// remoteKeyPair returns the remote static key set in the configuration, if any
+func (c *Conn) remoteKeyPair() (*KeyPair, error) {
+	if c.config.RemoteKey == nil {
+		return nil, nil
+	}
+	if dhLen := c.config.CipherSuite.dh().DHLen(); len(c.config.RemoteKey) != dhLen {
+		return nil, newError(ErrInvalidKey, "disco: the provided remote key is not "+strconv.Itoa(dhLen)+"-byte")
+	}
+	return &KeyPair{PublicKey: c.config.RemoteKey}, nil
+}
+
+// continueHandshake writes and reads handshake messages until the handshake is over
+func (c *Conn) continueHandshake(hs *HandshakeState) (c1, c2 *CipherState, err error) {
+	for c1 == nil {
+		if hs.shouldWrite {
+			// we're writing the next message pattern
+			c1, c2, err = c.writeHandshakeMessage(hs, nil)
+		} else {
+			// we're reading the next message pattern, as well as reacting to any received data
+			var noiseMessage []byte
+			_, noiseMessage, err = c.readHandshakeFrame()
+			if err != nil {
+				return
+			}
+			c1, c2, err = c.readHandshakeMessage(hs, noiseMessage)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// sendsStatic returns true if the next handshake message contains a static key
+func (hs *HandshakeState) sendsStatic() bool {
+	if len(hs.messagePatterns) == 0 {
+		return false
+	}
+	for _, token := range hs.messagePatterns[0] {
+		if token == token_s {
+			return true
+		}
+	}
+	return false
+}
+
+// writeHandshakeMessage writes the next handshake message, preceded by a prefix (if any).
+func (c *Conn) writeHandshakeMessage(hs *HandshakeState, prefix []byte) (c1, c2 *CipherState, err error) {
+	message, c1, c2, err := c.buildHandshakeMessage(hs, prefix)
+	if err != nil {
+		return
+	}
+	err = c.writeHandshakeFrame(nil, message)
+	return
+}
+
+// handshakePayloadFormat starts the prologue of the handshakes of a Conn. The
+// payloads of the handshake messages carry the server name and the proof
+// preceded by their lengths (see buildHandshakeMessage), while earlier versions
+// sent the proof alone: peers using different formats fail the handshake
+// instead of misreading the payloads.
+const handshakePayloadFormat = "DiscoPayload1"
+
+// prologue returns the prologue of the handshakes of the Conn
+func (c *Conn) prologue() []byte {
+	return append([]byte(handshakePayloadFormat), c.config.Prologue...)
+}
+
+// buildHandshakeMessage returns the next handshake message, preceded by a prefix (if any).
+// The payload of a message is made of the proof of the static key (if the message
+// contains one) preceded by its 2-byte length, followed by any application data.
+// The first message of a client starts with the name of the server preceded by
+// its 2-byte length, which is empty if it is not set (see Config.ServerName).
+func (c *Conn) buildHandshakeMessage(hs *HandshakeState, prefix []byte) (message []byte, c1, c2 *CipherState, err error) {
+	// the first message of a client carries the name of the server
+	var payload []byte
+	if c.isClient && c.handshakeMessageIndex == 0 {
+		payload = appendField(payload, []byte(c.config.ServerName))
+	}
+	// if we're sending a static key in this message, we also send a proof
+	if hs.sendsStatic() {
+		payload = appendField(payload, c.config.StaticPublicKeyProof)
+	}
+	// application data
+	if c.config.HandshakePayload != nil {
+		payload = append(payload, c.config.HandshakePayload(c.handshakeMessageIndex)...)
+	}
+	if c.config.DiscoSocket {
+		payload = discoSocketBody(payload, c.config.Padding)
+	}
+
+	message = append([]byte{}, prefix...)
+	c1, c2, err = hs.WriteMessage(payload, &message)
+	if err != nil {
+		return
+	}
+	if len(message) > NoiseMessageLength {
+		return nil, nil, nil, newError(ErrMessageTooLarge, "disco: handshake message exceeds DiscoMessageLength")
+	}
+	c.handshakeMessageIndex++
+	return
+}
+
+// writeHandshakeFrame writes a handshake message preceded by its 2-byte length.
+// With DiscoSocket, the message is itself preceded by the negotiation data and its 2-byte length.
+func (c *Conn) writeHandshakeFrame(negotiationData, message []byte) error {
+	var frame []byte
+	if c.config.DiscoSocket {
+		frame = appendField(frame, negotiationData)
+	}
+	_, err := c.conn.Write(appendField(frame, message))
+	return err
+}
+
+// readHandshakeMessage processes a handshake message received from the peer
+func (c *Conn) readHandshakeMessage(hs *HandshakeState, message []byte) (c1, c2 *CipherState, err error) {
+	sendsStatic := hs.sendsStatic()
+	var payload []byte
+	if c1, c2, err = hs.ReadMessage(message, &payload); err != nil {
+		return
+	}
+	err = c.receiveHandshakePayload(hs, sendsStatic, payload)
+	return
+}
+
+// receiveHandshakePayload parses the payload of a handshake message (see writeHandshakeMessage)
+func (c *Conn) receiveHandshakePayload(hs *HandshakeState, sendsStatic bool, payload []byte) error {
+	if c.config.DiscoSocket {
+		var err error
+		if payload, err = parseDiscoSocketBody(payload); err != nil {
+			return err
+		}
+	}
+	if !c.isClient && c.handshakeMessageIndex == 0 {
+		if len(payload) < 2 {
+			return newError(ErrMalformedMessage, "disco: the received handshake payload does not contain a server name")
+		}
+		nameLength := int(binary.BigEndian.Uint16(payload[:2]))
+		if len(payload[2:]) < nameLength {
+			return newError(ErrMalformedMessage, "disco: the received handshake payload does not contain a server name")
+		}
+		c.serverName = string(payload[2 : 2+nameLength])
+		payload = payload[2+nameLength:]
+		if c.config.GetConfigForClient != nil {
+			if err := c.getConfigForClient(hs); err != nil {
+				return err
+			}
+		}
+	}
+	if sendsStatic {
+		if len(payload) < 2 {
+			return newError(ErrMalformedMessage, "disco: the received handshake payload does not contain a proof")
+		}
+		proofLength := int(binary.BigEndian.Uint16(payload[:2]))
+		if len(payload[2:]) < proofLength {
+			return newError(ErrMalformedMessage, "disco: the received handshake payload does not contain a proof")
+		}
+		c.remoteProof = payload[2 : 2+proofLength]
+		payload = payload[2+proofLength:]
+	}
+	messageIndex := c.handshakeMessageIndex
+	c.handshakeMessageIndex++
+	if c.config.HandshakePayloadReceived != nil {
+		return c.config.HandshakePayloadReceived(messageIndex, payload)
+	}
+	return nil
+}
+
+// getConfigForClient replaces the configuration of the server with the one
+// returned by GetConfigForClient for the server name sent by the client.
+// Only the keys that have not been used yet by the handshake can be replaced.
+func (c *Conn) getConfigForClient(hs *HandshakeState) error {
+	config, err := c.config.GetConfigForClient(&ClientHelloInfo{ServerName: c.serverName, Conn: c.conn})
+	if err != nil || config == nil {
+		return err
+	}
+	if config.HandshakePattern != c.config.HandshakePattern || config.DiscoSocket != c.config.DiscoSocket ||
+		config.CipherSuite.String() != c.config.CipherSuite.String() {
+		return errors.New("disco: the Config returned by GetConfigForClient should use the same handshake pattern and cipher suite")
+	}
+	if err := checkRequirements(false, config); err != nil {
+		return err
+	}
+	if config, err = config.resolveKeyPair(); err != nil {
+		return err
+	}
+	if config.KeyPair == nil {
+		return newError(ErrInvalidKey, "disco: the Config returned by GetConfigForClient has no KeyPair")
+	}
+	pattern, _ := getPattern(config.HandshakePattern)
+	if len(pattern.preMessagePatterns[1]) > 0 && !bytes.Equal(config.KeyPair.PublicKey, hs.s.PublicKey) {
+		return newError(ErrInvalidKey, "disco: the server's static key is known by the client, it cannot be changed by GetConfigForClient")
+	}
+	if len(pattern.preMessagePatterns[0]) > 0 && !bytes.Equal(config.RemoteKey, hs.rs.PublicKey[:]) {
+		return newError(ErrInvalidKey, "disco: the client's static key is known in advance, it cannot be changed by GetConfigForClient")
+	}
+	if config.HandshakePattern.hasPSK() && !bytes.Equal(config.PreSharedKey, hs.psk) {
+		return newError(ErrInvalidPSK, "disco: the pre-shared key cannot be changed by GetConfigForClient")
+	}
+	hs.s = config.KeyPair.copy()
+	c.config = config
 	return nil
 }
 
+// readHandshakeFrame reads the next handshake message from the socket,
+// and with DiscoSocket the negotiation data preceding it
+func (c *Conn) readHandshakeFrame() (negotiationData, message []byte, err error) {
+	if c.config.DiscoSocket {
+		if negotiationData, err = c.readHandshakeField(); err != nil {
+			return
+		}
+	}
+	message, err = c.readHandshakeField()
+	return
+}
+
+// readHandshakeField reads a field preceded by its 2-byte length from the socket
+func (c *Conn) readHandshakeField() ([]byte, error) {
+	bufHeader := make([]byte, 2) // length header
+	if _, err := io.ReadFull(c.conn, bufHeader); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint16(bufHeader)
+	if length > NoiseMessageLength {
+		return nil, newError(ErrMessageTooLarge, "disco: Disco message received exceeds DiscoMessageLength")
+	}
+	field := make([]byte, length)
+	if _, err := io.ReadFull(c.conn, field); err != nil {
+		return nil, err
+	}
+	return field, nil
+}
+
+//
+// Noise Pipes
+//
+
+// In Noise Pipes, the first message of the client and the first message of the server
+// are preceded by one of the following bytes, indicating which pattern is being used.
+const (
+	pipeXX byte = iota
+	pipeIK
+	pipeXXfallback
+)
+
+// noisePipesHandshake runs the client or server side of Noise Pipes.
+// A client that does not know the server's static key goes through a XX handshake.
+// A client that knows the server's static key attempts a IK handshake, if the server
+// fails to decrypt the first message both peers switch to XXfallback.
+func (c *Conn) noisePipesHandshake(remoteKeyPair *KeyPair) (hs *HandshakeState, c1, c2 *CipherState, err error) {
+	// client side
+	if c.isClient {
+		// no known key for the server: XX
+		if remoteKeyPair == nil {
+			c.handshakePattern = NoiseXX
+			if hs, err = InitializeWithCipherSuite(c.config.CipherSuite, NoiseXX, true, c.prologue(), c.config.KeyPair, nil, nil, nil, nil); err != nil {
+				return
+			}
+			if _, _, err = c.writeHandshakeMessage(hs, []byte{pipeXX}); err != nil {
+				return
+			}
+			c1, c2, err = c.continueHandshake(hs)
+			return
+		}
+
+		// attempt IK
+		c.handshakePattern = NoiseIK
+		if hs, err = InitializeWithCipherSuite(c.config.CipherSuite, NoiseIK, true, c.prologue(), c.config.KeyPair, nil, remoteKeyPair, nil, nil); err != nil {
+			return
+		}
+		if _, _, err = c.writeHandshakeMessage(hs, []byte{pipeIK}); err != nil {
+			return
+		}
+		var message []byte
+		_, message, err = c.readHandshakeFrame()
+		if err != nil {
+			return
+		}
+		if len(message) == 0 {
+			err = newError(ErrMalformedMessage, "disco: received an empty Noise Pipes message")
+			return
+		}
+		switch message[0] {
+		case pipeIK:
+			c1, c2, err = c.readHandshakeMessage(hs, message[1:])
+		case pipeXXfallback:
+			// the server couldn't decrypt our message, switch to XXfallback re-using our ephemeral key
+			ephemeral := hs.e.copy()
+			hs.clear()
+			c.handshakePattern = NoiseXX | NoiseFallback
+			if hs, err = InitializeWithCipherSuite(c.config.CipherSuite, NoiseXX|NoiseFallback, true, c.prologue(), c.config.KeyPair, &ephemeral, nil, nil, nil); err != nil {
+				return
+			}
+			ephemeral.clear()
+			if c1, c2, err = c.readHandshakeMessage(hs, message[1:]); err != nil {
+				return
+			}
+			if c1 == nil {
+				c1, c2, err = c.continueHandshake(hs)
+			}
+		default:
+			err = newError(ErrMalformedMessage, "disco: received an unknown Noise Pipes message")
+		}
+		return
+	}
+
+	// server side
+	var message []byte
+	_, message, err = c.readHandshakeFrame()
+	if err != nil {
+		return
+	}
+	if len(message) == 0 {
+		err = newError(ErrMalformedMessage, "disco: received an empty Noise Pipes message")
+		return
+	}
+	switch message[0] {
+	case pipeXX:
+		c.handshakePattern = NoiseXX
+		if hs, err = InitializeWithCipherSuite(c.config.CipherSuite, NoiseXX, false, c.prologue(), c.config.KeyPair, nil, nil, nil, nil); err != nil {
+			return
+		}
+		if _, _, err = c.readHandshakeMessage(hs, message[1:]); err != nil {
+			return
+		}
+		c1, c2, err = c.continueHandshake(hs)
+	case pipeIK:
+		c.handshakePattern = NoiseIK
+		if hs, err = InitializeWithCipherSuite(c.config.CipherSuite, NoiseIK, false, c.prologue(), c.config.KeyPair, nil, nil, nil, nil); err != nil {
+			return
+		}
+		var payload []byte
+		if _, _, err = hs.ReadMessage(message[1:], &payload); err == nil {
+			if err = c.receiveHandshakePayload(hs, true, payload); err != nil {
+				return
+			}
+			c1, c2, err = c.writeHandshakeMessage(hs, []byte{pipeIK})
+			return
+		}
+		// we could not decrypt the message, switch to XXfallback re-using the client's ephemeral key
+		dhLen := c.config.CipherSuite.dh().DHLen()
+		if len(message[1:]) < dhLen {
+			return
+		}
+		hs.clear()
+		// the payload of the first message is lost
+		c.handshakeMessageIndex++
+		c.handshakePattern = NoiseXX | NoiseFallback
+		remoteEphemeral := KeyPair{PublicKey: message[1 : 1+dhLen]}
+		if hs, err = InitializeWithCipherSuite(c.config.CipherSuite, NoiseXX|NoiseFallback, false, c.prologue(), c.config.KeyPair, nil, nil, &remoteEphemeral, nil); err != nil {
+			return
+		}
+		if _, _, err = c.writeHandshakeMessage(hs, []byte{pipeXXfallback}); err != nil {
+			return
+		}
+		c1, c2, err = c.continueHandshake(hs)
+	default:
+		err = newError(ErrMalformedMessage, "disco: received an unknown Noise Pipes message")
+	}
+	return
+}
+
 // IsRemoteAuthenticated can be used to check if the remote peer has been properly authenticated. It serves no real purpose for the moment as the handshake will not go through if a peer is not properly authenticated in patterns where the peer needs to be authenticated.
 func (c *Conn) IsRemoteAuthenticated() bool {
-	return c.isRemoteAuthenticated
+	return atomic.LoadInt32(&c.handshakeDone) == 1 && c.isRemoteAuthenticated
 }
 
 // RemotePublicKey returns the static key of the remote peer. It is useful in case the
 // static key is only transmitted during the handshake.
 func (c *Conn) RemotePublicKey() (string, error) {
-	if !c.handshakeComplete {
-		return "", errors.New("disco: handshake not completed")
+	if atomic.LoadInt32(&c.handshakeDone) == 0 {
+		return "", ErrHandshakeIncomplete
 	}
 	return c.remotePublicKey, nil
 }
 
-/*
-TODO: Do we need such a function? (this comes from go.TLS)
+// ChannelBinding returns a 32-byte value that uniquely identifies the session.
+// Both peers obtain the same value at the end of the handshake, and it depends
+// on everything that happened during the handshake. It can be used to bind
+// application-level tokens or signatures to this specific connection.
+// Note that it is not secret.
+func (c *Conn) ChannelBinding() ([]byte, error) {
+	if atomic.LoadInt32(&c.handshakeDone) == 0 {
+		return nil, ErrHandshakeIncomplete
+	}
+	return append([]byte{}, c.handshakeHash...), nil
+}
+
 // ConnectionState returns basic Disco details about the connection.
 func (c *Conn) ConnectionState() ConnectionState {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
+	var state ConnectionState
+	state.HandshakeComplete = c.handshakeComplete
+	if !c.handshakeComplete {
+		return state
+	}
+	state.HandshakePattern = c.handshakePattern
+	if pattern, err := getPattern(c.handshakePattern); err == nil {
+		state.ProtocolName = protocolName(pattern, c.config.CipherSuite)
+	}
+	state.ServerName = c.serverName
+	if c.isClient {
+		state.ServerName = c.config.ServerName
+	}
+	state.RemoteAuthenticated = c.isRemoteAuthenticated
+	state.RemotePublicKey, _ = hex.DecodeString(c.remotePublicKey)
+	state.RemoteProof = append([]byte{}, c.remoteProof...)
+	state.ChannelBinding = append([]byte{}, c.handshakeHash...)
+	state.HalfDuplex = c.isHalfDuplex
+	state.DidResume = c.config.NoisePipes && c.handshakePattern == NoiseIK
+	state.RekeysSent = atomic.LoadUint64(&c.rekeysSent)
+	state.RekeysReceived = atomic.LoadUint64(&c.rekeysReceived)
+	if lastPong := atomic.LoadInt64(&c.lastPong); lastPong != 0 {
+		state.LastPong = time.Unix(0, lastPong)
+	}
+	return state
 }
-*/
@@ -2,10 +2,13 @@ package libdisco
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"strings"
 	"testing"
+	"time"
 )
 
 // TODO: add more tests from tls/conn_test.go
@@ -240,3 +243,560 @@ func TestRemotePublicKey(t *testing.T) {
 	clientSocket.Close()
 
 }
+
+func TestHandshakePayloads(t *testing.T) {
+	serverKeyPair := GenerateKeypair(nil)
+	clientKeyPair := GenerateKeypair(nil)
+
+	// IK: 0-RTT data from the client, and an answer from the server
+	var serverReceived, clientReceived []string
+	serverConfig := Config{
+		KeyPair:           serverKeyPair,
+		HandshakePattern:  NoiseIK,
+		PublicKeyVerifier: publicKeyVerifier,
+		HandshakePayload: func(messageIndex int) []byte {
+			return []byte(fmt.Sprintf("server payload %d", messageIndex))
+		},
+		HandshakePayloadReceived: func(messageIndex int, payload []byte) error {
+			serverReceived = append(serverReceived, fmt.Sprintf("%d:%s", messageIndex, payload))
+			return nil
+		},
+	}
+	clientConfig := Config{
+		KeyPair:              clientKeyPair,
+		HandshakePattern:     NoiseIK,
+		RemoteKey:            serverKeyPair.PublicKey[:],
+		StaticPublicKeyProof: createProof(clientKeyPair.PublicKey[:]),
+		HandshakePayload: func(messageIndex int) []byte {
+			return []byte(fmt.Sprintf("client payload %d", messageIndex))
+		},
+		HandshakePayloadReceived: func(messageIndex int, payload []byte) error {
+			clientReceived = append(clientReceived, fmt.Sprintf("%d:%s", messageIndex, payload))
+			return nil
+		},
+	}
+	testHelloCaVa(t, &clientConfig, &serverConfig)
+	if strings.Join(serverReceived, ",") != "0:client payload 0" {
+		t.Fatal("server received unexpected payloads", serverReceived)
+	}
+	if strings.Join(clientReceived, ",") != "1:server payload 1" {
+		t.Fatal("client received unexpected payloads", clientReceived)
+	}
+
+	// XX: metadata in the third message only, next to the proof
+	serverReceived = nil
+	client, server := configsForPattern(NoiseXX)
+	client.HandshakePayload = func(messageIndex int) []byte {
+		if messageIndex == 2 {
+			return []byte("metadata")
+		}
+		return nil
+	}
+	server.HandshakePayloadReceived = func(messageIndex int, payload []byte) error {
+		serverReceived = append(serverReceived, fmt.Sprintf("%d:%s", messageIndex, payload))
+		return nil
+	}
+	testHelloCaVa(t, client, server)
+	if strings.Join(serverReceived, ",") != "0:,2:metadata" {
+		t.Fatal("server received unexpected payloads", serverReceived)
+	}
+}
+
+func TestHandshakePayloadRejected(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseNN)
+	clientConfig.HandshakePayload = func(int) []byte { return []byte("not welcome") }
+	serverConfig.HandshakePayloadReceived = func(int, []byte) error {
+		return errors.New("payload rejected")
+	}
+
+	listener, err := Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverSocket, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer serverSocket.Close()
+		serverErr <- serverSocket.(*Conn).Handshake()
+	}()
+
+	clientSocket, err := Dial("tcp", listener.Addr().String(), clientConfig)
+	if err == nil {
+		clientSocket.Close()
+		t.Fatal("the client should not complete the handshake")
+	}
+	if err := <-serverErr; err == nil || err.Error() != "payload rejected" {
+		t.Fatal("the server should have rejected the payload", err)
+	}
+}
+
+func TestChannelBinding(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseXX)
+
+	listener, err := Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+
+	serverBindings := make(chan []byte, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			serverSocket, err := listener.Accept()
+			if err != nil {
+				serverBindings <- nil
+				return
+			}
+			// the binding can be polled while the handshake is running
+			go serverSocket.(*Conn).Handshake()
+			binding, err := serverSocket.(*Conn).ChannelBinding()
+			for err == ErrHandshakeIncomplete {
+				time.Sleep(time.Millisecond)
+				binding, err = serverSocket.(*Conn).ChannelBinding()
+			}
+			serverBindings <- binding
+			serverSocket.Close()
+		}
+	}()
+
+	var previous []byte
+	for i := 0; i < 2; i++ {
+		conn, err := Dial("tcp", listener.Addr().String(), clientConfig)
+		if err != nil {
+			t.Fatal("client can't connect to server", err)
+		}
+		clientBinding, err := conn.(*Conn).ChannelBinding()
+		if err != nil || len(clientBinding) != 32 {
+			t.Fatal("cannot obtain the channel binding", err)
+		}
+		if !bytes.Equal(clientBinding, <-serverBindings) {
+			t.Fatal("client and server channel bindings do not match")
+		}
+		if bytes.Equal(clientBinding, previous) {
+			t.Fatal("two sessions have the same channel binding")
+		}
+		previous = clientBinding
+		conn.Close()
+	}
+
+	// not available before the handshake
+	if _, err := Client(nil, clientConfig).ChannelBinding(); err == nil {
+		t.Fatal("channel binding should not be available before the handshake")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseXX)
+	clientConfig.RekeyAfterRecords = 3
+	serverConfig.RekeyAfterBytes = 1000
+
+	listener, err := Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+
+	// echo server that also rekeys manually from time to time
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		serverSocket, err := listener.Accept()
+		if err != nil {
+			t.Error("a server cannot accept()")
+			return
+		}
+		defer serverSocket.Close()
+		buf := make([]byte, 100000)
+		for i := 0; ; i++ {
+			n, err := serverSocket.Read(buf)
+			if err != nil {
+				if err != io.EOF {
+					t.Error("server can't read on socket", err)
+				}
+				return
+			}
+			if i%5 == 0 {
+				if err := serverSocket.(*Conn).Rekey(); err != nil {
+					t.Error("server can't rekey", err)
+					return
+				}
+			}
+			if _, err := serverSocket.Write(buf[:n]); err != nil {
+				t.Error("server can't write on socket", err)
+				return
+			}
+		}
+	}()
+
+	clientSocket, err := Dial("tcp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal("client can't connect to server", err)
+	}
+	// messages bigger than a record are split, and rekeyed in between
+	for _, size := range []int{10, 300, 2000, NoiseMaxPlaintextSize + 10} {
+		for i := 0; i < 10; i++ {
+			if i == 7 {
+				if err := clientSocket.(*Conn).Rekey(); err != nil {
+					t.Fatal("client can't rekey", err)
+				}
+			}
+			message := bytes.Repeat([]byte{byte(i)}, size)
+			if _, err := clientSocket.Write(message); err != nil {
+				t.Fatal("client can't write on socket", err)
+			}
+			received := make([]byte, size)
+			if _, err := io.ReadFull(clientSocket, received); err != nil {
+				t.Fatal("client can't read on socket", err)
+			}
+			if !bytes.Equal(received, message) {
+				t.Fatal("received message not as expected")
+			}
+		}
+	}
+	clientSocket.Close()
+	<-serverDone
+}
+
+func TestConnectionState(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseXX)
+
+	listener, err := Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+
+	serverStates := make(chan ConnectionState, 1)
+	go func() {
+		serverSocket, err := listener.Accept()
+		if err != nil {
+			t.Error("a server cannot accept()")
+			return
+		}
+		defer serverSocket.Close()
+		var buf [10]byte
+		if _, err := serverSocket.Read(buf[:]); err != nil {
+			t.Error("server can't read on socket", err)
+		}
+		serverStates <- serverSocket.(*Conn).ConnectionState()
+	}()
+
+	if state := Client(nil, clientConfig).ConnectionState(); state.HandshakeComplete {
+		t.Fatal("the handshake should not be complete")
+	}
+
+	clientSocket, err := Dial("tcp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal("client can't connect to server", err)
+	}
+	defer clientSocket.Close()
+	clientConn := clientSocket.(*Conn)
+	if err := clientConn.Rekey(); err != nil {
+		t.Fatal("client can't rekey", err)
+	}
+	if _, err := clientConn.Write([]byte("hello")); err != nil {
+		t.Fatal("client can't write on socket", err)
+	}
+
+	state := clientConn.ConnectionState()
+	binding, _ := clientConn.ChannelBinding()
+	if !state.HandshakeComplete || state.HandshakePattern != NoiseXX ||
+		state.ProtocolName != "Noise_XX_25519_STROBEv1.0.2" ||
+		!state.RemoteAuthenticated || state.HalfDuplex || state.DidResume ||
+		!bytes.Equal(state.RemotePublicKey, serverConfig.KeyPair.PublicKey[:]) ||
+		!bytes.Equal(state.RemoteProof, serverConfig.StaticPublicKeyProof) ||
+		!bytes.Equal(state.ChannelBinding, binding) ||
+		state.RekeysSent != 1 || state.RekeysReceived != 0 {
+		t.Fatal("client connection state not as expected", state)
+	}
+
+	serverState := <-serverStates
+	if !bytes.Equal(serverState.RemotePublicKey, clientConfig.KeyPair.PublicKey[:]) ||
+		!bytes.Equal(serverState.ChannelBinding, binding) ||
+		serverState.RekeysSent != 0 || serverState.RekeysReceived != 1 {
+		t.Fatal("server connection state not as expected", serverState)
+	}
+}
+
+func TestCloseNotify(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseXX)
+
+	// a closed connection ends with io.EOF, a truncated one with ErrTruncated
+	for _, truncate := range []bool{false, true} {
+		serverConn, clientConn := net.Pipe()
+		server := Server(serverConn, serverConfig)
+		client := Client(clientConn, clientConfig)
+
+		go func() {
+			client.Write([]byte("hello"))
+			if truncate {
+				clientConn.Close()
+			} else {
+				client.Close()
+			}
+		}()
+
+		received, err := io.ReadAll(server)
+		if string(received) != "hello" {
+			t.Fatal("received message not as expected")
+		}
+		if truncate && !errors.Is(err, ErrTruncated) {
+			t.Fatal("expected ErrTruncated", err)
+		} else if !truncate && err != nil {
+			t.Fatal("expected io.EOF", err)
+		}
+		server.Close()
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseXX)
+
+	listener, err := Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+
+	// the server answers once the client is done writing
+	go func() {
+		serverSocket, err := listener.Accept()
+		if err != nil {
+			t.Error("a server cannot accept()")
+			return
+		}
+		defer serverSocket.Close()
+		request, err := io.ReadAll(serverSocket)
+		if err != nil {
+			t.Error("server can't read on socket", err)
+			return
+		}
+		if _, err := serverSocket.Write(append([]byte("received "), request...)); err != nil {
+			t.Error("server can't write on socket", err)
+		}
+	}()
+
+	clientSocket, err := Dial("tcp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal("client can't connect to server", err)
+	}
+	defer clientSocket.Close()
+	clientConn := clientSocket.(*Conn)
+	if _, err := clientConn.Write([]byte("hello")); err != nil {
+		t.Fatal("client can't write on socket", err)
+	}
+	if err := clientConn.CloseWrite(); err != nil {
+		t.Fatal("client can't close the connection for writing", err)
+	}
+	if _, err := clientConn.Write([]byte("hello")); !errors.Is(err, ErrShutdown) {
+		t.Fatal("expected ErrShutdown", err)
+	}
+	response, err := io.ReadAll(clientConn)
+	if err != nil || string(response) != "received hello" {
+		t.Fatal("server response not as expected", err)
+	}
+
+	if err := Client(nil, clientConfig).CloseWrite(); !errors.Is(err, ErrHandshakeIncomplete) {
+		t.Fatal("expected ErrHandshakeIncomplete", err)
+	}
+}
+
+func TestPingAndAlerts(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseNX)
+
+	// pongs are written while reading, this requires a buffered connection (not net.Pipe)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("client can't connect to server", err)
+	}
+	defer clientConn.Close()
+	serverConn, err := listener.Accept()
+	if err != nil {
+		t.Fatal("a server cannot accept()", err)
+	}
+	defer serverConn.Close()
+	server := Server(serverConn, serverConfig)
+	client := Client(clientConn, clientConfig)
+
+	// the server answers the ping while reading, then gives up with an alert
+	serverErr := make(chan error, 1)
+	go func() {
+		var buf [10]byte
+		n, err := server.Read(buf[:])
+		if err != nil || string(buf[:n]) != "hello" {
+			serverErr <- fmt.Errorf("server can't read on socket: %v", err)
+			return
+		}
+		if err := server.SendAlert(AlertApplication+1, "going away"); err != nil {
+			serverErr <- err
+			return
+		}
+		if _, err := server.Write([]byte("hello")); !errors.Is(err, ErrShutdown) {
+			serverErr <- fmt.Errorf("expected ErrShutdown: %v", err)
+			return
+		}
+		serverErr <- nil
+	}()
+
+	if err := client.Ping(); err != nil {
+		t.Fatal("client can't ping", err)
+	}
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal("client can't write on socket", err)
+	}
+	var alert *AlertError
+	if _, err := client.Read(make([]byte, 10)); !errors.As(err, &alert) ||
+		alert.Code != AlertApplication+1 || alert.Description != "going away" {
+		t.Fatal("expected an alert", err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatal(err)
+	}
+	if client.ConnectionState().LastPong.IsZero() {
+		t.Fatal("the client did not receive a pong")
+	}
+	// the alert is returned again
+	if _, err := client.Read(make([]byte, 10)); !errors.As(err, &alert) {
+		t.Fatal("expected an alert", err)
+	}
+
+	if err := Client(nil, &Config{HandshakePattern: NoiseN}).Ping(); !errors.Is(err, ErrOneWay) {
+		t.Fatal("expected ErrOneWay", err)
+	}
+}
+
+// recordingConn records what is written on a connection
+func TestHandshakePayloadFormat(t *testing.T) {
+	// a peer using the prologue of earlier versions, which sent the proof
+	// alone in the payloads, cannot complete the handshake
+	for _, prologue := range []string{handshakePayloadFormat + "prologue", "prologue"} {
+		_, serverConfig := configsForPattern(NoiseNN)
+		serverConfig.Prologue = []byte("prologue")
+		clientSocket, serverSocket := net.Pipe()
+		go Server(serverSocket, serverConfig).Handshake()
+
+		client, err := Initialize(NoiseNN, true, []byte(prologue), nil, nil, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// -> e, with an empty server name
+		var message []byte
+		if _, _, err := client.WriteMessage(appendField(nil, nil), &message); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := clientSocket.Write(appendField(nil, message)); err != nil {
+			t.Fatal(err)
+		}
+		// <- e, ee
+		response := make([]byte, 2+32+tagSize)
+		if _, err := io.ReadFull(clientSocket, response); err != nil {
+			t.Fatal(err)
+		}
+		var payload []byte
+		_, _, err = client.ReadMessage(response[2:], &payload)
+		if prologue == "prologue" && !errors.Is(err, ErrDecrypt) {
+			t.Fatal("expected ErrDecrypt", err)
+		} else if prologue != "prologue" && err != nil {
+			t.Fatal("the handshake failed", err)
+		}
+		clientSocket.Close()
+	}
+}
+
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.written.Write(b)
+	return c.Conn.Write(b)
+}
+
+func TestServerName(t *testing.T) {
+	for _, handshakeType := range []noiseHandshakeType{NoiseXX, NoiseNK} {
+		clientConfig, serverConfig := configsForPattern(handshakeType)
+		clientConfig.ServerName = "service.example.com"
+
+		// the service has its own keys if the client does not know the server's key
+		serviceConfig := *serverConfig
+		if handshakeType == NoiseXX {
+			serviceConfig.KeyPair = GenerateKeypair(nil)
+			serviceConfig.StaticPublicKeyProof = createProof(serviceConfig.KeyPair.PublicKey[:])
+		}
+		serverConfig.GetConfigForClient = func(info *ClientHelloInfo) (*Config, error) {
+			if info.ServerName != "service.example.com" {
+				return nil, errors.New("unknown server name")
+			}
+			return &serviceConfig, nil
+		}
+
+		clientSocket, serverSocket := net.Pipe()
+		recorder := &recordingConn{Conn: clientSocket}
+		client := Client(recorder, clientConfig)
+		server := Server(serverSocket, serverConfig)
+		done := make(chan error, 1)
+		go func() { done <- server.Handshake() }()
+		if err := client.Handshake(); err != nil {
+			t.Fatal("the handshake failed", err)
+		}
+		if err := <-done; err != nil {
+			t.Fatal("the handshake failed", err)
+		}
+
+		if server.ConnectionState().ServerName != "service.example.com" {
+			t.Fatal("the server did not receive the server name")
+		}
+		if !bytes.Equal(client.ConnectionState().RemotePublicKey, serviceConfig.KeyPair.PublicKey[:]) {
+			t.Fatal("the client did not receive the key of the service")
+		}
+		// the name is encrypted when the client knows the server's static key
+		if bytes.Contains(recorder.written.Bytes(), []byte("service.example.com")) != (handshakeType == NoiseXX) {
+			t.Fatal("the server name should only be sent in clear if it cannot be encrypted")
+		}
+		client.Close()
+		server.Close()
+	}
+
+	// the server's key cannot be changed if the client already knows it
+	clientConfig, serverConfig := configsForPattern(NoiseNK)
+	clientConfig.ServerName = "service.example.com"
+	serverConfig.GetConfigForClient = func(info *ClientHelloInfo) (*Config, error) {
+		serviceConfig := *serverConfig
+		serviceConfig.KeyPair = GenerateKeypair(nil)
+		return &serviceConfig, nil
+	}
+	clientSocket, serverSocket := net.Pipe()
+	defer clientSocket.Close()
+	go Client(clientSocket, clientConfig).Handshake()
+	if err := Server(serverSocket, serverConfig).Handshake(); !errors.Is(err, ErrInvalidKey) {
+		t.Fatal("expected ErrInvalidKey", err)
+	}
+
+	// the server name is optional on both sides
+	clientConfig, serverConfig = configsForPattern(NoiseXX)
+	clientConfig.ServerName = "service.example.com"
+	if _, _, clientErr, serverErr := connPair(clientConfig, serverConfig); clientErr != nil || serverErr != nil {
+		t.Fatal("a server without GetConfigForClient should ignore the server name", clientErr, serverErr)
+	}
+	clientConfig.ServerName = ""
+	serverName := "not called"
+	serverConfig.GetConfigForClient = func(info *ClientHelloInfo) (*Config, error) {
+		serverName = info.ServerName
+		return nil, nil
+	}
+	if _, _, clientErr, serverErr := connPair(clientConfig, serverConfig); clientErr != nil || serverErr != nil || serverName != "" {
+		t.Fatal("GetConfigForClient should receive an empty server name", clientErr, serverErr, serverName)
+	}
+}
@@ -0,0 +1,824 @@
+package libdisco
+
+// This file implements Disco over unreliable transports like UDP, where packets
+// can be lost, duplicated or delivered out of order.
+//
+// Every packet starts with a type byte.
+// A handshake packet is followed by the index of the handshake message (0 for the first
+// message, 1 for the second, etc.) and the handshake message.
+// The first handshake message also carries a cookie, prefixed by its length, right
+// after the index.
+// A data packet is followed by an 8-byte big-endian nonce and the encrypted payload.
+// A retry packet is sent by a server to a client that did not send a valid cookie,
+// and is followed by a new cookie.
+// Handshake messages are retransmitted until the peer answers, and data packets
+// are decrypted independently of each other (see CipherState.EncryptWithNonce).
+//
+// A server does not keep any state or send anything bigger than what it received
+// until the client has proven that it receives the packets sent to its address, by
+// echoing the cookie of a retry packet: spoofed packets cannot fill the server's
+// memory or use it to flood a third party.
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	packetTypeHandshake byte = 0
+	packetTypeData      byte = 1
+	packetTypeRetry     byte = 2
+
+	// largest UDP payload
+	maxDatagramSize = 65507
+	// MaxDatagramPayloadSize is the largest amount of application data
+	// that can be written at once on a DatagramConn
+	MaxDatagramPayloadSize = maxDatagramSize - 1 - 8 - NoiseTagLength
+
+	// a handshake message is sent again if the peer did not answer after
+	// datagramRetransmitTimeout, then after twice that time, etc.
+	datagramRetransmitTimeout    = 500 * time.Millisecond
+	datagramMaxRetransmitTimeout = 4 * time.Second
+	// the whole handshake fails if it does not complete in that time
+	datagramHandshakeTimeout = 30 * time.Second
+
+	// number of received packets waiting to be read
+	datagramQueueLength = 64
+	// number of data packets that can be received before the end of the handshake
+	datagramMaxEarlyPackets = 16
+
+	// number of handshakes a DatagramListener runs at the same time,
+	// new clients are ignored above that
+	datagramMaxPendingHandshakes = 128
+	// number of connections waiting to be accepted by a DatagramListener,
+	// new connections are closed above that
+	datagramAcceptQueueLength = 16
+	// a DatagramListener closes the connections that did not receive
+	// anything for that long
+	datagramIdleTimeout = 5 * time.Minute
+	// a cookie is an 8-byte timestamp followed by a MAC of the timestamp
+	// and of the address of the client
+	datagramCookieSize     = 8 + tagSize
+	datagramCookieLifetime = time.Minute
+)
+
+// A DatagramConn represents a secured connection over a net.PacketConn,
+// for example over UDP. It implements the net.Conn interface.
+// Each Write sends a single packet that might be lost, duplicated or reordered
+// on the way. Each Read returns the content of a single authenticated packet,
+// duplicates are discarded.
+type DatagramConn struct {
+	pconn    net.PacketConn
+	raddr    net.Addr
+	isClient bool
+	config   *Config
+
+	// the handshake is run by a Conn over handshakeTransport
+	conn          *Conn
+	transport     *handshakeTransport
+	handshakeDone int32
+
+	// packets received from the peer
+	incoming  chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+	// time of the last packet received, in nanoseconds since the Unix epoch
+	lastReceived int64
+
+	// input/output
+	outLock      sync.Mutex
+	outNonce     uint64
+	inLock       sync.Mutex
+	replay       replayWindow
+	readDeadline atomic.Value // time.Time
+}
+
+func newDatagramConn(pconn net.PacketConn, raddr net.Addr, config *Config, isClient bool) *DatagramConn {
+	c := &DatagramConn{
+		pconn:    pconn,
+		raddr:    raddr,
+		isClient: isClient,
+		config:   config,
+		incoming: make(chan []byte, datagramQueueLength),
+		closed:   make(chan struct{}),
+	}
+	c.transport = &handshakeTransport{c: c}
+	c.conn = &Conn{conn: c.transport, config: config, isClient: isClient}
+	c.readDeadline.Store(time.Time{})
+	c.lastReceived = time.Now().UnixNano()
+	return c
+}
+
+// DatagramClient returns a new Disco client side connection to raddr
+// using pconn as the underlying transport. pconn should not be used by
+// anything else, and is closed when the DatagramConn is closed.
+func DatagramClient(pconn net.PacketConn, raddr net.Addr, config *Config) *DatagramConn {
+	c := newDatagramConn(pconn, raddr, config, true)
+	c.onClose = func() { pconn.Close() }
+	go func() {
+		buf := make([]byte, maxDatagramSize+1)
+		for {
+			n, addr, err := pconn.ReadFrom(buf)
+			if err != nil {
+				c.Close()
+				return
+			}
+			if addr.String() == raddr.String() {
+				c.deliver(append([]byte{}, buf[:n]...))
+			}
+		}
+	}()
+	return c
+}
+
+// DialDatagram connects to the given address on a UDP network ("udp", "udp4" or "udp6")
+// and then initiates a Disco handshake, returning the resulting Disco connection.
+func DialDatagram(network, addr string, config *Config) (*DatagramConn, error) {
+	if config == nil {
+		return nil, ErrNoConfig
+	}
+	if err := checkDatagramRequirements(true, config); err != nil {
+		return nil, err
+	}
+	raddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	pconn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn := DatagramClient(pconn, raddr, config)
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// checkDatagramRequirements checks the config like checkRequirements and
+// also rejects options that are not supported over datagrams
+func checkDatagramRequirements(isClient bool, config *Config) error {
+	if config.NoisePipes {
+		return errors.New("disco: Noise Pipes are not supported over datagrams")
+	}
+	if config.DiscoSocket {
+		return errors.New("disco: DiscoSocket is not supported over datagrams")
+	}
+	return checkRequirements(isClient, config)
+}
+
+// deliver queues a packet received from the peer
+func (c *DatagramConn) deliver(packet []byte) {
+	if len(packet) == 0 {
+		return
+	}
+	atomic.StoreInt64(&c.lastReceived, time.Now().UnixNano())
+	if packet[0] != packetTypeData && atomic.LoadInt32(&c.handshakeDone) == 1 {
+		c.handleLateHandshakePacket(packet)
+		return
+	}
+	select {
+	case c.incoming <- packet:
+	default:
+		// the queue is full, drop the packet
+	}
+}
+
+// handleLateHandshakePacket reacts to a handshake packet received after the end of
+// the handshake: if we sent the last handshake message, the peer did not receive it
+// and retransmitted its previous message. On one-way patterns, the first message
+// is also the last one and the server might ask for it again with a retry packet.
+func (c *DatagramConn) handleLateHandshakePacket(packet []byte) {
+	t := c.transport
+	switch {
+	case packet[0] == packetTypeRetry:
+		if t.acceptsRetry(packet) {
+			c.pconn.WriteTo(t.firstPacket(packet[1:]), c.raddr)
+		}
+	case packet[0] == packetTypeHandshake && len(packet) >= 2 && t.wroteLast && packet[1] < t.lastIndex:
+		c.pconn.WriteTo(t.last, c.raddr)
+	}
+}
+
+// Handshake runs the client or server handshake protocol if
+// it has not yet been run. Lost handshake messages are retransmitted.
+// The first Read or Write will call it automatically.
+func (c *DatagramConn) Handshake() error {
+	if err := c.conn.Handshake(); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&c.handshakeDone, 1)
+	return nil
+}
+
+// Write encrypts b and sends it to the peer in a single packet.
+// b cannot be longer than MaxDatagramPayloadSize.
+func (c *DatagramConn) Write(b []byte) (int, error) {
+	if !c.isClient && c.config.HandshakePattern.isOneWay() {
+		return 0, newError(ErrOneWay, "disco: a server should not write on one-way patterns")
+	}
+	if len(b) > MaxDatagramPayloadSize {
+		return 0, newError(ErrMessageTooLarge, "disco: data is too large to fit in a single packet")
+	}
+
+	// Make sure to go through the handshake first
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+
+	// every packet is encrypted under a different nonce
+	c.outLock.Lock()
+	if c.outNonce == math.MaxUint64 {
+		c.outLock.Unlock()
+		return 0, errors.New("disco: no more nonces available for this connection")
+	}
+	nonce := c.outNonce
+	c.outNonce++
+	c.outLock.Unlock()
+
+	packet := make([]byte, 9, 9+len(b)+NoiseTagLength)
+	packet[0] = packetTypeData
+	binary.BigEndian.PutUint64(packet[1:9], nonce)
+	packet = append(packet, c.conn.out.EncryptWithNonce(nonce, b)...)
+
+	if _, err := c.pconn.WriteTo(packet, c.raddr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read reads the next packet sent by the peer into b.
+// If b is too small to hold the packet's content, the rest of it is discarded.
+// Packets that cannot be authenticated and replayed packets are silently discarded.
+func (c *DatagramConn) Read(b []byte) (int, error) {
+	if c.isClient && c.config.HandshakePattern.isOneWay() {
+		return 0, newError(ErrOneWay, "disco: a client should not read on one-way patterns")
+	}
+
+	// Make sure to go through the handshake first
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+
+	c.inLock.Lock()
+	defer c.inLock.Unlock()
+
+	for {
+		var packet []byte
+		if len(c.transport.early) > 0 {
+			packet = c.transport.early[0]
+			c.transport.early = c.transport.early[1:]
+		} else {
+			var err error
+			if packet, err = c.nextPacket(c.readDeadline.Load().(time.Time)); err != nil {
+				return 0, err
+			}
+		}
+
+		if packet[0] != packetTypeData {
+			c.handleLateHandshakePacket(packet)
+			continue
+		}
+		if len(packet) < 9+NoiseTagLength {
+			continue
+		}
+		nonce := binary.BigEndian.Uint64(packet[1:9])
+		if !c.replay.check(nonce) {
+			continue
+		}
+		plaintext, err := c.conn.in.DecryptWithNonce(nonce, packet[9:])
+		if err != nil {
+			continue
+		}
+		c.replay.update(nonce)
+
+		return copy(b, plaintext), nil
+	}
+}
+
+// nextPacket waits for the next packet sent by the peer
+func (c *DatagramConn) nextPacket(deadline time.Time) ([]byte, error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case packet := <-c.incoming:
+		return packet, nil
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the connection. On the server side, the underlying
+// net.PacketConn is shared with the DatagramListener and stays open.
+func (c *DatagramConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+// LocalAddr returns the local network address.
+func (c *DatagramConn) LocalAddr() net.Addr {
+	return c.pconn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (c *DatagramConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// SetDeadline sets the read deadline associated with the connection.
+// Writes do not block waiting for the peer and are not affected.
+func (c *DatagramConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline on the connection, it also
+// applies to the handshake. It is only taken into account by the next
+// calls to Read.
+func (c *DatagramConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Store(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes do not block waiting for the peer.
+func (c *DatagramConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// IsRemoteAuthenticated can be used to check if the remote peer has been properly authenticated.
+func (c *DatagramConn) IsRemoteAuthenticated() bool {
+	return c.conn.IsRemoteAuthenticated()
+}
+
+// RemotePublicKey returns the static key of the remote peer.
+func (c *DatagramConn) RemotePublicKey() (string, error) {
+	return c.conn.RemotePublicKey()
+}
+
+// ChannelBinding returns a 32-byte value that uniquely identifies the session (see Conn.ChannelBinding).
+func (c *DatagramConn) ChannelBinding() ([]byte, error) {
+	return c.conn.ChannelBinding()
+}
+
+// ConnectionState returns basic Disco details about the connection.
+func (c *DatagramConn) ConnectionState() ConnectionState {
+	return c.conn.ConnectionState()
+}
+
+//
+// Handshake over datagrams
+//
+
+// handshakeTransport is the net.Conn used by a Conn to run the handshake of a
+// DatagramConn. It turns every length-prefixed handshake message written by the Conn
+// into a handshake packet, and takes care of retransmissions when reading.
+type handshakeTransport struct {
+	c *DatagramConn
+
+	// index of the next handshake message, sent or received
+	index byte
+	// first handshake message written by a client, sent again with
+	// the cookie of a retry packet
+	first []byte
+	// last handshake packet sent, retransmitted if the peer does not answer
+	last      []byte
+	lastIndex byte
+	wroteLast bool
+	// what is left of the handshake message being read
+	readBuf []byte
+	// data packets received before the end of the handshake
+	early [][]byte
+}
+
+func (t *handshakeTransport) Write(b []byte) (int, error) {
+	if len(b) < 2 || int(binary.BigEndian.Uint16(b[:2])) != len(b)-2 {
+		return 0, errors.New("disco: malformed handshake message")
+	}
+	if len(b)+1+datagramCookieSize > maxDatagramSize {
+		return 0, newError(ErrMessageTooLarge, "disco: handshake message is too large to fit in a single packet")
+	}
+	// replace the length by the packet type and the message index
+	var packet []byte
+	if t.c.isClient && t.index == 0 {
+		// no cookie until the server asks for one
+		t.first = append([]byte{}, b[2:]...)
+		packet = t.firstPacket(nil)
+	} else {
+		packet = append([]byte{packetTypeHandshake, t.index}, b[2:]...)
+	}
+	t.last, t.lastIndex, t.wroteLast = packet, t.index, true
+	t.index++
+	if _, err := t.c.pconn.WriteTo(packet, t.c.raddr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (t *handshakeTransport) Read(b []byte) (int, error) {
+	if len(t.readBuf) == 0 {
+		message, err := t.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		// present the message to the Conn with a length header
+		t.readBuf = make([]byte, 2, 2+len(message))
+		binary.BigEndian.PutUint16(t.readBuf, uint16(len(message)))
+		t.readBuf = append(t.readBuf, message...)
+	}
+	n := copy(b, t.readBuf)
+	t.readBuf = t.readBuf[n:]
+	return n, nil
+}
+
+// readMessage waits for the next handshake message, retransmitting the
+// last handshake message sent if the peer takes too long to answer or if
+// the peer retransmits its own previous message.
+func (t *handshakeTransport) readMessage() ([]byte, error) {
+	deadline := t.c.readDeadline.Load().(time.Time)
+	if deadline.IsZero() {
+		deadline = time.Now().Add(datagramHandshakeTimeout)
+	}
+	retransmitTimeout := datagramRetransmitTimeout
+	for {
+		wait := deadline
+		if t.last != nil && time.Until(deadline) > retransmitTimeout {
+			wait = time.Now().Add(retransmitTimeout)
+		}
+		packet, err := t.c.nextPacket(wait)
+		if err == os.ErrDeadlineExceeded && wait.Before(deadline) {
+			// the peer did not answer in time
+			t.c.pconn.WriteTo(t.last, t.c.raddr)
+			if retransmitTimeout *= 2; retransmitTimeout > datagramMaxRetransmitTimeout {
+				retransmitTimeout = datagramMaxRetransmitTimeout
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case packet[0] == packetTypeData:
+			// the peer finished the handshake before us, keep the packet for later
+			if len(t.early) < datagramMaxEarlyPackets {
+				t.early = append(t.early, packet)
+			}
+		case packet[0] == packetTypeRetry:
+			// the server wants a proof that we own our address
+			if t.acceptsRetry(packet) {
+				t.last = t.firstPacket(packet[1:])
+				t.c.pconn.WriteTo(t.last, t.c.raddr)
+			}
+		case packet[0] != packetTypeHandshake || len(packet) < 2:
+			// not for us
+		case packet[1] == t.index:
+			message := packet[2:]
+			if !t.c.isClient && t.index == 0 {
+				// skip the cookie, already verified by the listener
+				if len(message) < 1 || len(message) < 1+int(message[0]) {
+					continue
+				}
+				message = message[1+int(message[0]):]
+			}
+			t.index++
+			t.wroteLast = false
+			return message, nil
+		case packet[1] < t.index && t.last != nil && packet[1] < t.lastIndex:
+			// the peer did not receive our last message
+			t.c.pconn.WriteTo(t.last, t.c.raddr)
+		}
+	}
+}
+
+// firstPacket returns the first handshake packet of a client, carrying cookie
+func (t *handshakeTransport) firstPacket(cookie []byte) []byte {
+	packet := make([]byte, 0, 3+len(cookie)+len(t.first))
+	packet = append(packet, packetTypeHandshake, 0, byte(len(cookie)))
+	packet = append(packet, cookie...)
+	return append(packet, t.first...)
+}
+
+// acceptsRetry returns true if packet is a retry packet that a client waiting
+// for an answer to its first handshake message should act on
+func (t *handshakeTransport) acceptsRetry(packet []byte) bool {
+	return t.c.isClient && t.wroteLast && t.lastIndex == 0 && len(packet) > 1 && len(packet) <= 256
+}
+
+func (t *handshakeTransport) Close() error                     { return t.c.Close() }
+func (t *handshakeTransport) LocalAddr() net.Addr              { return t.c.LocalAddr() }
+func (t *handshakeTransport) RemoteAddr() net.Addr             { return t.c.RemoteAddr() }
+func (t *handshakeTransport) SetDeadline(time.Time) error      { return nil }
+func (t *handshakeTransport) SetReadDeadline(time.Time) error  { return nil }
+func (t *handshakeTransport) SetWriteDeadline(time.Time) error { return nil }
+
+//
+// Replay protection
+//
+
+// replayWindowSize is the number of nonces below the highest nonce received that
+// are still accepted, packets delayed more than that are discarded
+const replayWindowSize = 64
+
+// replayWindow keeps track of the nonces received recently
+type replayWindow struct {
+	// highest nonce received, plus one (zero means that nothing has been received)
+	next uint64
+	// bit i is set if nonce next-1-i has been received
+	bitmap uint64
+}
+
+// check returns true if a packet with the given nonce has not been received yet
+// and is not too old to be accepted
+func (w *replayWindow) check(nonce uint64) bool {
+	if nonce >= w.next {
+		return true
+	}
+	offset := w.next - 1 - nonce
+	if offset >= replayWindowSize {
+		return false
+	}
+	return w.bitmap&(1<<offset) == 0
+}
+
+// update marks a nonce as received, it must be called after the
+// packet has been authenticated
+func (w *replayWindow) update(nonce uint64) {
+	if nonce >= w.next {
+		shift := nonce - w.next + 1
+		if shift >= replayWindowSize {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= shift
+		}
+		w.bitmap |= 1
+		w.next = nonce + 1
+		return
+	}
+	w.bitmap |= 1 << (w.next - 1 - nonce)
+}
+
+//
+// Listener
+//
+
+// DatagramListener accepts Disco connections over a single net.PacketConn.
+// Packets are dispatched to connections according to their source address.
+// Connections that are not accepted fast enough, or that do not receive
+// anything for five minutes, are closed.
+type DatagramListener struct {
+	pconn  net.PacketConn
+	config *Config
+
+	// key of the MACs in cookies
+	cookieKey []byte
+
+	connsLock sync.Mutex
+	conns     map[string]*DatagramConn
+	pending   int // number of handshakes in progress
+
+	accept    chan *DatagramConn
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error // error that stopped the listener, protected by connsLock
+}
+
+// NewDatagramListener creates a Disco listener accepting connections on pconn.
+// The configuration config must be non-nil.
+func NewDatagramListener(pconn net.PacketConn, config *Config) (*DatagramListener, error) {
+	if config == nil {
+		return nil, ErrNoConfig
+	}
+	if err := checkDatagramRequirements(false, config); err != nil {
+		return nil, err
+	}
+	cookieKey := make([]byte, 32)
+	if _, err := rand.Read(cookieKey); err != nil {
+		return nil, err
+	}
+	l := &DatagramListener{
+		pconn:     pconn,
+		config:    config,
+		cookieKey: cookieKey,
+		conns:     make(map[string]*DatagramConn),
+		accept:    make(chan *DatagramConn, datagramAcceptQueueLength),
+		closed:    make(chan struct{}),
+	}
+	go l.serve()
+	go l.expireIdleConns()
+	return l, nil
+}
+
+// ListenDatagram creates a Disco listener accepting connections on the
+// given address of a packet-oriented network (for example "udp") using net.ListenPacket.
+// The configuration config must be non-nil.
+func ListenDatagram(network, laddr string, config *Config) (*DatagramListener, error) {
+	if config == nil {
+		return nil, ErrNoConfig
+	}
+	if err := checkDatagramRequirements(false, config); err != nil {
+		return nil, err
+	}
+	pconn, err := net.ListenPacket(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return NewDatagramListener(pconn, config)
+}
+
+// serve reads packets and dispatches them to the connections
+func (l *DatagramListener) serve() {
+	buf := make([]byte, maxDatagramSize+1)
+	for {
+		n, addr, err := l.pconn.ReadFrom(buf)
+		if err != nil {
+			l.connsLock.Lock()
+			l.err = err
+			l.connsLock.Unlock()
+			l.Close()
+			return
+		}
+		packet := append([]byte{}, buf[:n]...)
+
+		l.connsLock.Lock()
+		conn, ok := l.conns[addr.String()]
+		l.connsLock.Unlock()
+		if !ok {
+			if conn = l.newConn(packet, addr); conn == nil {
+				continue
+			}
+		}
+
+		conn.deliver(packet)
+	}
+}
+
+// newConn returns a new connection for a client starting a handshake with packet,
+// or nil if the packet is ignored
+func (l *DatagramListener) newConn(packet []byte, addr net.Addr) *DatagramConn {
+	// only the first handshake message can start a new connection
+	if len(packet) < 3 || packet[0] != packetTypeHandshake || packet[1] != 0 {
+		return nil
+	}
+	// nothing is kept until the client proves that it owns its address
+	cookieLength := int(packet[2])
+	if len(packet) < 3+cookieLength || !l.verifyCookie(packet[3:3+cookieLength], addr) {
+		l.sendRetry(addr, len(packet))
+		return nil
+	}
+
+	l.connsLock.Lock()
+	defer l.connsLock.Unlock()
+	if l.pending >= datagramMaxPendingHandshakes {
+		return nil
+	}
+	conn := newDatagramConn(l.pconn, addr, l.config, false)
+	key := addr.String()
+	conn.onClose = func() {
+		l.connsLock.Lock()
+		if l.conns[key] == conn {
+			delete(l.conns, key)
+		}
+		l.connsLock.Unlock()
+	}
+	l.conns[key] = conn
+	l.pending++
+	go l.handshake(conn)
+	return conn
+}
+
+// cookie returns a cookie for the address addr, valid for datagramCookieLifetime after now
+func (l *DatagramListener) cookie(addr net.Addr, now time.Time) []byte {
+	cookie := make([]byte, 8, datagramCookieSize)
+	binary.BigEndian.PutUint64(cookie, uint64(now.Unix()))
+	tag := ProtectIntegrity(l.cookieKey, append(cookie[:8:8], addr.String()...))
+	return append(cookie, tag[len(tag)-tagSize:]...)
+}
+
+// verifyCookie returns true if cookie was created by the listener for addr and has not expired
+func (l *DatagramListener) verifyCookie(cookie []byte, addr net.Addr) bool {
+	if len(cookie) != datagramCookieSize {
+		return false
+	}
+	created := time.Unix(int64(binary.BigEndian.Uint64(cookie[:8])), 0)
+	if now := time.Now(); created.After(now) || now.Sub(created) > datagramCookieLifetime {
+		return false
+	}
+	message := append(append(cookie[:8:8], addr.String()...), cookie[8:]...)
+	_, err := VerifyIntegrity(l.cookieKey, message)
+	return err == nil
+}
+
+// sendRetry asks the client at addr to send its first handshake message again
+// with a cookie. Nothing is sent if the retry packet would be larger than the
+// packet received, which might have been sent with a spoofed address.
+func (l *DatagramListener) sendRetry(addr net.Addr, received int) {
+	retry := append([]byte{packetTypeRetry}, l.cookie(addr, time.Now())...)
+	if len(retry) <= received {
+		l.pconn.WriteTo(retry, addr)
+	}
+}
+
+// handshake runs the handshake of a new connection and makes it available to Accept
+func (l *DatagramListener) handshake(conn *DatagramConn) {
+	err := conn.Handshake()
+	l.connsLock.Lock()
+	l.pending--
+	l.connsLock.Unlock()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case l.accept <- conn:
+	default:
+		// the application does not accept the connections fast enough
+		conn.Close()
+	}
+}
+
+// expireIdleConns regularly closes the idle connections, until the listener is closed
+func (l *DatagramListener) expireIdleConns() {
+	ticker := time.NewTicker(datagramIdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			l.closeIdleConns(now)
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+// closeIdleConns closes the connections that did not receive anything
+// for datagramIdleTimeout before now, which removes them from the listener
+func (l *DatagramListener) closeIdleConns(now time.Time) {
+	var idle []*DatagramConn
+	l.connsLock.Lock()
+	for _, conn := range l.conns {
+		if now.Sub(time.Unix(0, atomic.LoadInt64(&conn.lastReceived))) > datagramIdleTimeout {
+			idle = append(idle, conn)
+		}
+	}
+	l.connsLock.Unlock()
+	for _, conn := range idle {
+		conn.Close()
+	}
+}
+
+// Accept waits for and returns the next Disco connection, once its handshake is complete.
+func (l *DatagramListener) Accept() (*DatagramConn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.closed:
+		l.connsLock.Lock()
+		defer l.connsLock.Unlock()
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener and the underlying net.PacketConn.
+// The connections accepted by the listener cannot be used afterwards.
+func (l *DatagramListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.pconn.Close()
+		l.connsLock.Lock()
+		conns := l.conns
+		l.conns = make(map[string]*DatagramConn)
+		l.connsLock.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return err
+}
+
+// Addr returns the listener's network address.
+func (l *DatagramListener) Addr() net.Addr {
+	return l.pconn.LocalAddr()
+}
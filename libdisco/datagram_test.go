@@ -0,0 +1,470 @@
+package libdisco
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mimoo/StrobeGo/strobe"
+)
+
+func TestDatagramConn(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseXX)
+
+	listener, err := ListenDatagram("udp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+
+	// echo server
+	serverBindings := make(chan []byte, 1)
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			t.Error("a server cannot accept()", err)
+			return
+		}
+		defer serverConn.Close()
+		binding, _ := serverConn.ChannelBinding()
+		serverBindings <- binding
+		buf := make([]byte, MaxDatagramPayloadSize)
+		for {
+			n, err := serverConn.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := serverConn.Write(buf[:n]); err != nil {
+				t.Error("server can't write", err)
+				return
+			}
+		}
+	}()
+
+	clientConn, err := DialDatagram("udp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal("client can't connect to server", err)
+	}
+	defer clientConn.Close()
+
+	if !clientConn.IsRemoteAuthenticated() {
+		t.Fatal("the server should be authenticated")
+	}
+	clientBinding, _ := clientConn.ChannelBinding()
+	if !bytes.Equal(clientBinding, <-serverBindings) {
+		t.Fatal("client and server channel bindings do not match")
+	}
+
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, MaxDatagramPayloadSize)
+	for _, size := range []int{0, 1, 1000, 10000} {
+		message := bytes.Repeat([]byte{byte(size)}, size)
+		if _, err := clientConn.Write(message); err != nil {
+			t.Fatal("client can't write", err)
+		}
+		n, err := clientConn.Read(buf)
+		if err != nil {
+			t.Fatal("client can't read", err)
+		}
+		if !bytes.Equal(buf[:n], message) {
+			t.Fatal("received message not as expected")
+		}
+	}
+
+	if _, err := clientConn.Write(make([]byte, MaxDatagramPayloadSize+1)); err == nil {
+		t.Fatal("data larger than a packet should not be written")
+	}
+}
+
+func TestDatagramListenerConns(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseXX)
+
+	listener, err := ListenDatagram("udp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+	numConns := func() int {
+		listener.connsLock.Lock()
+		defer listener.connsLock.Unlock()
+		return len(listener.conns)
+	}
+
+	// the connections are queued until they are accepted
+	var clients []*DatagramConn
+	for i := 0; i < 2; i++ {
+		clientConn, err := DialDatagram("udp", listener.Addr().String(), clientConfig)
+		if err != nil {
+			t.Fatal("client can't connect to server", err)
+		}
+		defer clientConn.Close()
+		clients = append(clients, clientConn)
+	}
+	first, err := listener.Accept()
+	if err != nil {
+		t.Fatal("a server cannot accept()", err)
+	}
+	second, err := listener.Accept()
+	if err != nil {
+		t.Fatal("a server cannot accept()", err)
+	}
+	if n := numConns(); n != 2 {
+		t.Fatal("the listener should have 2 connections, not", n)
+	}
+
+	// closed connections are removed
+	first.Close()
+	if n := numConns(); n != 1 {
+		t.Fatal("a closed connection should be removed from the listener", n)
+	}
+
+	// idle connections are closed and removed
+	listener.closeIdleConns(time.Now())
+	if n := numConns(); n != 1 {
+		t.Fatal("an active connection should not be removed from the listener", n)
+	}
+	listener.closeIdleConns(time.Now().Add(datagramIdleTimeout + time.Second))
+	if n := numConns(); n != 0 {
+		t.Fatal("an idle connection should be removed from the listener", n)
+	}
+	if _, err := second.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("an idle connection should be closed", err)
+	}
+}
+
+func TestDatagramAcceptQueue(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseXX)
+
+	listener, err := ListenDatagram("udp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+
+	// the connections above the length of the queue are dropped
+	for i := 0; i < datagramAcceptQueueLength+2; i++ {
+		clientConn, err := DialDatagram("udp", listener.Addr().String(), clientConfig)
+		if err != nil {
+			t.Fatal("client can't connect to server", err)
+		}
+		defer clientConn.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		listener.connsLock.Lock()
+		pending, numConns := listener.pending, len(listener.conns)
+		listener.connsLock.Unlock()
+		if pending == 0 && numConns == datagramAcceptQueueLength {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the listener should keep", datagramAcceptQueueLength, "connections, not", numConns)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(listener.accept) != datagramAcceptQueueLength {
+		t.Fatal("the accept queue should be full")
+	}
+}
+
+// lossyPacketConn drops the packets whose index is in drop, and records the other ones
+type lossyPacketConn struct {
+	net.PacketConn
+	sync.Mutex
+	drop    map[int]bool
+	written int
+	sent    [][]byte
+}
+
+func (c *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.Lock()
+	index := c.written
+	c.written++
+	if !c.drop[index] {
+		c.sent = append(c.sent, append([]byte{}, b...))
+	}
+	c.Unlock()
+	if c.drop[index] {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestDatagramLossyHandshake(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseXX)
+
+	listener, err := ListenDatagram("udp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			t.Error("a server cannot accept()", err)
+			return
+		}
+		defer serverConn.Close()
+		serverConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		buf := make([]byte, 100)
+		n, err := serverConn.Read(buf)
+		if err != nil {
+			t.Error("server can't read", err)
+		}
+		received <- buf[:n]
+	}()
+
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lose the first attempt of the first message, of the first message
+	// carrying a cookie, and of the last message
+	lossy := &lossyPacketConn{PacketConn: pconn, drop: map[int]bool{0: true, 2: true, 4: true}}
+	clientConn := DatagramClient(lossy, listener.Addr(), clientConfig)
+	defer clientConn.Close()
+	if err := clientConn.Handshake(); err != nil {
+		t.Fatal("client can't finish the handshake", err)
+	}
+	// the server has not finished the handshake yet, this packet is kept for later
+	if _, err := clientConn.Write([]byte("telemetry")); err != nil {
+		t.Fatal("client can't write", err)
+	}
+
+	select {
+	case message := <-received:
+		if string(message) != "telemetry" {
+			t.Fatal("received message not as expected")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the server never completed the handshake")
+	}
+}
+
+func TestDatagramReplay(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseNK)
+
+	listener, err := ListenDatagram("udp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &lossyPacketConn{PacketConn: pconn}
+	clientConn := DatagramClient(recorder, listener.Addr(), clientConfig)
+	defer clientConn.Close()
+	if err := clientConn.Handshake(); err != nil {
+		t.Fatal("client can't finish the handshake", err)
+	}
+	serverConn, err := listener.Accept()
+	if err != nil {
+		t.Fatal("a server cannot accept()", err)
+	}
+
+	// send packets out of order, then replay them
+	for i := 0; i < 3; i++ {
+		clientConn.Write([]byte{byte(i)})
+	}
+	recorder.Lock()
+	packets := recorder.sent[len(recorder.sent)-3:]
+	recorder.Unlock()
+	for _, i := range []int{2, 0, 2, 1, 0} {
+		pconn.WriteTo(packets[i], listener.Addr())
+	}
+
+	serverConn.SetReadDeadline(time.Now().Add(time.Second))
+	seen := make(map[byte]int)
+	buf := make([]byte, 10)
+	for {
+		n, err := serverConn.Read(buf)
+		if err == os.ErrDeadlineExceeded {
+			break
+		}
+		if err != nil || n != 1 {
+			t.Fatal("server can't read", err)
+		}
+		seen[buf[0]]++
+	}
+	if len(seen) != 3 || seen[0] != 1 || seen[1] != 1 || seen[2] != 1 {
+		t.Fatal("each packet should have been received once", seen)
+	}
+}
+
+func TestDatagramRetry(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseNK)
+
+	listener, err := ListenDatagram("udp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+	connections := func() int {
+		listener.connsLock.Lock()
+		defer listener.connsLock.Unlock()
+		return len(listener.conns)
+	}
+
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pconn.Close()
+	receive := func() []byte {
+		pconn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		buf := make([]byte, maxDatagramSize)
+		n, _, err := pconn.ReadFrom(buf)
+		if err != nil {
+			return nil
+		}
+		return buf[:n]
+	}
+
+	// a first message without a cookie only gets a retry packet back
+	first := append([]byte{packetTypeHandshake, 0, 0}, make([]byte, 32)...)
+	pconn.WriteTo(first, listener.Addr())
+	retry := receive()
+	if len(retry) != 1+datagramCookieSize || retry[0] != packetTypeRetry || len(retry) > len(first) {
+		t.Fatal("expected a retry packet", retry)
+	}
+	if connections() != 0 {
+		t.Fatal("no connection should be created without a cookie")
+	}
+	// unless the retry packet would be larger
+	pconn.WriteTo(first[:3], listener.Addr())
+	if packet := receive(); packet != nil {
+		t.Fatal("the server should not answer with a larger packet", packet)
+	}
+
+	// the cookie is only valid for the address it was sent to
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	withCookie := append([]byte{packetTypeHandshake, 0, byte(len(retry) - 1)}, retry[1:]...)
+	other.WriteTo(append(withCookie, first[3:]...), listener.Addr())
+	time.Sleep(100 * time.Millisecond)
+	if connections() != 0 {
+		t.Fatal("no connection should be created with the cookie of another address")
+	}
+
+	// the number of handshakes in progress is limited
+	listener.connsLock.Lock()
+	listener.pending = datagramMaxPendingHandshakes
+	listener.connsLock.Unlock()
+	clientConn := DatagramClient(pconn, listener.Addr(), clientConfig)
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := clientConn.Handshake(); err == nil {
+		t.Fatal("the handshake should not complete while too many handshakes are in progress")
+	}
+	if connections() != 0 {
+		t.Fatal("no connection should be created while too many handshakes are in progress")
+	}
+	listener.connsLock.Lock()
+	listener.pending = 0
+	listener.connsLock.Unlock()
+
+	clientConn, err = DialDatagram("udp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal("client can't connect to server", err)
+	}
+	defer clientConn.Close()
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	accept := func(nonce uint64) bool {
+		if !w.check(nonce) {
+			return false
+		}
+		w.update(nonce)
+		return true
+	}
+	for _, test := range []struct {
+		nonce    uint64
+		accepted bool
+	}{
+		{0, true}, {0, false}, {2, true}, {1, true}, {1, false}, {2, false},
+		{100, true}, {37, true}, {36, false}, {37, false}, {99, true},
+		{1000, true}, {999, true}, {1000 - replayWindowSize, false}, {1000 - replayWindowSize + 1, true},
+	} {
+		if accept(test.nonce) != test.accepted {
+			t.Fatal("unexpected result for nonce", test.nonce)
+		}
+	}
+}
+
+func TestDatagramSplit(t *testing.T) {
+	// Keccak-f[1600] of the zero state
+	state := make([]byte, 200)
+	keccakF1600(state)
+	if binary.LittleEndian.Uint64(state) != 0xF1258F7940E1DDE7 || binary.LittleEndian.Uint64(state[192:]) != 0xEAF1FF7B5CECA249 {
+		t.Fatal("Keccak-f[1600] does not match the reference permutation")
+	}
+
+	// meta_RATCHET(0) followed by a RATCHET of the same operation is a meta_RATCHET
+	for length := 0; length < 400; length += 7 {
+		state := strobe.InitStrobe("test", 128)
+		state.AD(false, make([]byte, length))
+		expected := state.Clone()
+		expected.Operate(true, "RATCHET", []byte{}, 32, false)
+		ratcheted := strobeMetaRatchet(&state)
+		ratcheted.Operate(true, "RATCHET", []byte{}, 32, true)
+		if !bytes.Equal(ratcheted.Serialize(), expected.Serialize()) {
+			t.Fatal("meta_RATCHET(0) does not match StrobeGo after", length, "bytes")
+		}
+	}
+
+	for _, suite := range []CipherSuite{{}, {Cipher: CipherChaChaPoly, Hash: HashSHA256}} {
+		initiator, _ := InitializeWithCipherSuite(suite, NoiseNN, true, nil, nil, nil, nil, nil, nil)
+		responder, _ := InitializeWithCipherSuite(suite, NoiseNN, false, nil, nil, nil, nil, nil, nil)
+		initiator.datagram, responder.datagram = true, true
+		streamInitiator, _ := InitializeWithCipherSuite(suite, NoiseNN, true, nil, nil, nil, nil, nil, nil)
+		streamInitiator.debugEphemeral = GenerateKeypair(nil)
+		initiator.debugEphemeral = streamInitiator.debugEphemeral
+
+		var message, streamMessage, payload []byte
+		initiator.WriteMessage(nil, &message)
+		streamInitiator.WriteMessage(nil, &streamMessage)
+		responder.ReadMessage(message, &payload)
+		message = message[:0]
+		responder.debugEphemeral = GenerateKeypair(nil)
+		c1, _, err := responder.WriteMessage(nil, &message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d1, _, err := initiator.ReadMessage(message, &payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s1, _, err := streamInitiator.ReadMessage(message, &payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ciphertext := d1.EncryptWithNonce(5, []byte("hello"))
+		if plaintext, err := c1.DecryptWithNonce(5, ciphertext); err != nil || string(plaintext) != "hello" {
+			t.Fatal("cannot decrypt", err)
+		}
+		// Strobe states are ratcheted before being used with nonces
+		if suite == (CipherSuite{}) && bytes.Equal(s1.EncryptWithNonce(5, []byte("hello")), ciphertext) {
+			t.Fatal("the datagram split should differ from the stream split")
+		}
+		// the last nonce is reserved
+		if _, err := c1.DecryptWithNonce(math.MaxUint64, d1.EncryptWithNonce(math.MaxUint64, nil)); !errors.Is(err, ErrDecrypt) {
+			t.Fatal("the nonce 2^64-1 should be rejected", err)
+		}
+	}
+}
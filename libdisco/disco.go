@@ -9,8 +9,13 @@ package libdisco
 
 import (
 	"bytes"
+	"crypto/mlkem"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
+	"math"
+	"math/bits"
+	"strconv"
 
 	"github.com/mimoo/StrobeGo/strobe"
 )
@@ -19,38 +24,64 @@ import (
 // SymmetricState object
 //
 
-type symmetricState struct {
+// symmetricState is the symmetric cryptography of a handshake. It is
+// implemented with Strobe, or with the cipher and hash functions of a Noise
+// cipher suite (see CipherSuite).
+type symmetricState interface {
+	mixKey(inputKeyMaterial []byte)
+	mixHash(data []byte)
+	mixKeyAndHash(inputKeyMaterial []byte)
+	// hasKey returns true once a key has been mixed in, handshake payloads are then encrypted
+	hasKey() bool
+	// GetHandshakeHash returns a value binding the whole transcript of the handshake so far.
+	// It does not modify the state.
+	GetHandshakeHash() []byte
+	encryptAndHash(plaintext []byte) ([]byte, error)
+	decryptAndHash(ciphertext []byte) ([]byte, error)
+	Split() (c1, c2 *CipherState)
+	// splitDatagram is the Split of handshakes over unreliable transports, the
+	// CipherStates are then only used with explicit nonces (see DatagramConn)
+	splitDatagram() (c1, c2 *CipherState)
+	// serialize returns the state, without the information returned by hasKey (see HandshakeState.Serialize)
+	serialize() []byte
+}
+
+type strobeSymmetricState struct {
 	strobeState strobe.Strobe
 	isKeyed     bool
 }
 
-func (s *symmetricState) initializeSymmetric(protocolName string) {
+func (s *strobeSymmetricState) initializeSymmetric(protocolName string) {
 	// initializing the Strobe state
 	s.strobeState = strobe.InitStrobe(protocolName, 128)
 }
 
-func (s *symmetricState) mixKey(inputKeyMaterial [32]byte) {
-	s.strobeState.AD(false, inputKeyMaterial[:])
+func (s *strobeSymmetricState) mixKey(inputKeyMaterial []byte) {
+	s.strobeState.AD(false, inputKeyMaterial)
 	s.isKeyed = true
 }
 
-func (s *symmetricState) mixHash(data []byte) {
+func (s *strobeSymmetricState) mixHash(data []byte) {
 	s.strobeState.AD(false, data)
 }
 
-func (s *symmetricState) mixKeyAndHash(inputKeyMaterial []byte) {
+func (s *strobeSymmetricState) mixKeyAndHash(inputKeyMaterial []byte) {
 	s.strobeState.AD(false, inputKeyMaterial)
 }
 
-// TODO: documentation
-// GetHandshakeHash
-func (s *symmetricState) GetHandshakeHash() []byte {
-	return s.strobeState.PRF(32)
+func (s *strobeSymmetricState) hasKey() bool {
+	return s.isKeyed
+}
+
+// GetHandshakeHash returns a value binding the whole transcript of the handshake so far.
+// It does not modify the state.
+func (s *strobeSymmetricState) GetHandshakeHash() []byte {
+	return s.strobeState.Clone().PRF(32)
 }
 
 // encrypts the plaintext and authenticates the hash
 // then insert the ciphertext in the running hash
-func (s *symmetricState) encryptAndHash(plaintext []byte) (ciphertext []byte, err error) {
+func (s *strobeSymmetricState) encryptAndHash(plaintext []byte) (ciphertext []byte, err error) {
 
 	if s.isKeyed {
 		ciphertext := s.strobeState.Send_ENC_unauthenticated(false, plaintext)
@@ -62,17 +93,17 @@ func (s *symmetricState) encryptAndHash(plaintext []byte) (ciphertext []byte, er
 }
 
 // decrypts the ciphertext and authenticates the hash
-func (s *symmetricState) decryptAndHash(ciphertext []byte) (plaintext []byte, err error) {
+func (s *strobeSymmetricState) decryptAndHash(ciphertext []byte) (plaintext []byte, err error) {
 
 	if s.isKeyed {
 		if len(ciphertext) < 16 {
-			return nil, errors.New("disco: the received payload is shorter 16 bytes")
+			return nil, newError(ErrDecrypt, "disco: the received payload is shorter than 16 bytes")
 		}
 
 		plaintext := s.strobeState.Recv_ENC_unauthenticated(false, ciphertext[:len(ciphertext)-16])
 		ok := s.strobeState.Recv_MAC(false, ciphertext[len(ciphertext)-16:])
 		if !ok {
-			return nil, errors.New("disco: cannot decrypt the payload")
+			return nil, ErrDecrypt
 		}
 		return plaintext, nil
 	}
@@ -80,23 +111,246 @@ func (s *symmetricState) decryptAndHash(ciphertext []byte) (plaintext []byte, er
 	return ciphertext, nil
 }
 
-func (s symmetricState) Split() (s1, s2 *strobe.Strobe) {
+func (s *strobeSymmetricState) Split() (s1, s2 *CipherState) {
+
+	initiatorState := s.strobeState.Clone()
+	initiatorState.AD(true, []byte("initiator"))
+	initiatorState.RATCHET(32)
 
-	s1 = s.strobeState.Clone()
-	s1.AD(true, []byte("initiator"))
-	s1.RATCHET(32)
+	responderState := s.strobeState.Clone()
+	responderState.AD(true, []byte("responder"))
+	responderState.RATCHET(32)
 
-	s2 = &s.strobeState
-	s2.AD(true, []byte("responder"))
-	s2.RATCHET(32)
+	return &CipherState{cipher: &strobeCipherState{initiatorState}}, &CipherState{cipher: &strobeCipherState{responderState}}
+}
+
+// splitDatagram applies meta_RATCHET(0) to both states returned by Split, as
+// required by the modified Split of Disco over unreliable transports (section 7.3.1)
+func (s *strobeSymmetricState) splitDatagram() (c1, c2 *CipherState) {
+	c1, c2 = s.Split()
+	for _, cs := range []*CipherState{c1, c2} {
+		cipher := cs.cipher.(*strobeCipherState)
+		cipher.strobeState = strobeMetaRatchet(cipher.strobeState)
+	}
 	return
 }
 
+// flags of the meta_RATCHET operation in Strobe: M | C
+const strobeMetaRatchetFlags = 0x10 | 0x04
+
+// strobeMetaRatchet returns the state after a meta_RATCHET(0) operation: the
+// beginning of the operation is absorbed and, as the operation has the C flag,
+// the permutation is run. StrobeGo does not accept operations of length 0, so
+// the operation is applied to the serialized state, which is
+// [security(1)|initialized(1)|I0(1)|curFlags(1)|posBegin(1)|pos(1)|[25]uint64 state]
+func strobeMetaRatchet(s *strobe.Strobe) *strobe.Strobe {
+	serialized := s.Serialize()
+	posBegin, pos := serialized[4], int(serialized[5])
+	state := serialized[6:]
+
+	// pad the block and run the permutation
+	runF := func() {
+		state[pos] ^= posBegin
+		state[pos+1] ^= 0x04
+		state[s.StrobeR+1] ^= 0x80
+		keccakF1600(state)
+		pos, posBegin = 0, 0
+	}
+	// begin_op: absorb the beginning of the previous operation and the flags
+	oldBegin := posBegin
+	posBegin = byte(pos + 1)
+	for _, b := range []byte{oldBegin, strobeMetaRatchetFlags} {
+		state[pos] ^= b
+		if pos++; pos == s.StrobeR {
+			runF()
+		}
+	}
+	if pos != 0 {
+		runF()
+	}
+
+	serialized[3], serialized[4], serialized[5] = strobeMetaRatchetFlags, posBegin, byte(pos)
+	recovered := strobe.RecoverState(serialized)
+	return &recovered
+}
+
+// keccakRoundConstants are the constants of the iota step of Keccak-f[1600]
+var keccakRoundConstants = [24]uint64{
+	0x0000000000000001, 0x0000000000008082, 0x800000000000808A, 0x8000000080008000,
+	0x000000000000808B, 0x0000000080000001, 0x8000000080008081, 0x8000000000008009,
+	0x000000000000008A, 0x0000000000000088, 0x0000000080008009, 0x000000008000000A,
+	0x000000008000808B, 0x800000000000008B, 0x8000000000008089, 0x8000000000008003,
+	0x8000000000008002, 0x8000000000000080, 0x000000000000800A, 0x800000008000000A,
+	0x8000000080008081, 0x8000000000008080, 0x0000000080000001, 0x8000000080008008,
+}
+
+// keccakRotations and keccakLanes are the rotations of the rho step, and the
+// lanes they are moved to by the pi step, in the order the lanes are visited
+var (
+	keccakRotations = [24]int{1, 3, 6, 10, 15, 21, 28, 36, 45, 55, 2, 14, 27, 41, 56, 8, 25, 43, 62, 18, 39, 61, 20, 44}
+	keccakLanes     = [24]int{10, 7, 11, 17, 18, 3, 5, 16, 8, 21, 24, 4, 15, 23, 19, 13, 12, 2, 20, 14, 22, 9, 6, 1}
+)
+
+// keccakF1600 runs the Keccak-f[1600] permutation on a 200-byte state. StrobeGo
+// does not export its own, it is only needed by strobeMetaRatchet.
+func keccakF1600(state []byte) {
+	var a [25]uint64
+	for i := range a {
+		a[i] = binary.LittleEndian.Uint64(state[8*i:])
+	}
+	var c [5]uint64
+	for round := 0; round < 24; round++ {
+		// theta
+		for x := 0; x < 5; x++ {
+			c[x] = a[x] ^ a[x+5] ^ a[x+10] ^ a[x+15] ^ a[x+20]
+		}
+		for x := 0; x < 5; x++ {
+			d := c[(x+4)%5] ^ bits.RotateLeft64(c[(x+1)%5], 1)
+			for y := 0; y < 25; y += 5 {
+				a[y+x] ^= d
+			}
+		}
+		// rho and pi
+		lane := a[1]
+		for i, j := range keccakLanes {
+			lane, a[j] = a[j], bits.RotateLeft64(lane, keccakRotations[i])
+		}
+		// chi
+		for y := 0; y < 25; y += 5 {
+			copy(c[:], a[y:y+5])
+			for x := 0; x < 5; x++ {
+				a[y+x] = c[x] ^ (^c[(x+1)%5] & c[(x+2)%5])
+			}
+		}
+		// iota
+		a[0] ^= keccakRoundConstants[round]
+	}
+	for i := range a {
+		binary.LittleEndian.PutUint64(state[8*i:], a[i])
+	}
+}
+
+func (s *strobeSymmetricState) serialize() []byte {
+	return s.strobeState.Serialize()
+}
+
+//
+// CipherState object
+//
+
+// CipherState is obtained at the end of a handshake (see WriteMessage and ReadMessage).
+// It can be used to encrypt or decrypt transport messages in one direction.
+// Messages must be decrypted in the order they were encrypted, a CipherState
+// is not safe for concurrent use.
+type CipherState struct {
+	cipher transportCipher
+}
+
+// transportCipher is the implementation of a CipherState, with Strobe or with
+// the cipher function of a Noise cipher suite (see CipherSuite)
+type transportCipher interface {
+	encrypt(plaintext []byte) []byte
+	decrypt(ciphertext []byte) ([]byte, error)
+	encryptWithNonce(nonce uint64, plaintext []byte) []byte
+	decryptWithNonce(nonce uint64, ciphertext []byte) ([]byte, error)
+	rekey()
+}
+
+// Encrypt encrypts and authenticates a plaintext message.
+// The returned ciphertext is NoiseTagLength bytes longer than the plaintext.
+func (cs *CipherState) Encrypt(plaintext []byte) []byte {
+	return cs.cipher.encrypt(plaintext)
+}
+
+// Decrypt decrypts and verifies a message encrypted by the other peer's CipherState.
+// Once a message fails to decrypt, the CipherState cannot be used anymore.
+func (cs *CipherState) Decrypt(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < NoiseTagLength {
+		return nil, newError(ErrDecrypt, "disco: the received payload is shorter than 16 bytes")
+	}
+	return cs.cipher.decrypt(ciphertext)
+}
+
+// EncryptWithNonce encrypts and authenticates a plaintext message under an explicit
+// nonce, for transports where messages can be lost or reordered (see DatagramConn).
+// Unlike Encrypt, it does not modify the CipherState: a nonce must never be used twice
+// with the same CipherState, and the nonce 2^64-1 is reserved.
+// The returned ciphertext is NoiseTagLength bytes longer than the plaintext.
+func (cs *CipherState) EncryptWithNonce(nonce uint64, plaintext []byte) []byte {
+	return cs.cipher.encryptWithNonce(nonce, plaintext)
+}
+
+// DecryptWithNonce decrypts and verifies a message encrypted with EncryptWithNonce.
+// It does not modify the CipherState, detecting replayed messages is left to the caller.
+func (cs *CipherState) DecryptWithNonce(nonce uint64, ciphertext []byte) ([]byte, error) {
+	if nonce == math.MaxUint64 {
+		return nil, newError(ErrDecrypt, "disco: the nonce 2^64-1 is reserved")
+	}
+	if len(ciphertext) < NoiseTagLength {
+		return nil, newError(ErrDecrypt, "disco: the received payload is shorter than 16 bytes")
+	}
+	return cs.cipher.decryptWithNonce(nonce, ciphertext)
+}
+
+// Rekey replaces the CipherState's key with the output of a one-way function
+// of the current key, so that a later compromise of the key does not reveal
+// previous messages. Both peers must rekey their CipherState at the same point
+// in the stream of messages.
+func (cs *CipherState) Rekey() {
+	cs.cipher.rekey()
+}
+
+type strobeCipherState struct {
+	strobeState *strobe.Strobe
+}
+
+func (cs *strobeCipherState) encrypt(plaintext []byte) []byte {
+	ciphertext := cs.strobeState.Send_ENC_unauthenticated(false, plaintext)
+	return append(ciphertext, cs.strobeState.Send_MAC(false, NoiseTagLength)...)
+}
+
+func (cs *strobeCipherState) decrypt(ciphertext []byte) ([]byte, error) {
+	plaintext := cs.strobeState.Recv_ENC_unauthenticated(false, ciphertext[:len(ciphertext)-NoiseTagLength])
+	if ok := cs.strobeState.Recv_MAC(false, ciphertext[len(ciphertext)-NoiseTagLength:]); !ok {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+func (cs *strobeCipherState) encryptWithNonce(nonce uint64, plaintext []byte) []byte {
+	strobeState := cs.strobeState.Clone()
+	var nonceBytes [8]byte
+	binary.BigEndian.PutUint64(nonceBytes[:], nonce)
+	strobeState.AD(false, nonceBytes[:])
+	ciphertext := strobeState.Send_ENC_unauthenticated(false, plaintext)
+	return append(ciphertext, strobeState.Send_MAC(false, NoiseTagLength)...)
+}
+
+func (cs *strobeCipherState) decryptWithNonce(nonce uint64, ciphertext []byte) ([]byte, error) {
+	strobeState := cs.strobeState.Clone()
+	var nonceBytes [8]byte
+	binary.BigEndian.PutUint64(nonceBytes[:], nonce)
+	strobeState.AD(false, nonceBytes[:])
+	plaintext := strobeState.Recv_ENC_unauthenticated(false, ciphertext[:len(ciphertext)-NoiseTagLength])
+	if ok := strobeState.Recv_MAC(false, ciphertext[len(ciphertext)-NoiseTagLength:]); !ok {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+func (cs *strobeCipherState) rekey() {
+	cs.strobeState.RATCHET(32)
+}
+
 //
 // HandshakeState object
 //
 
-type handshakeState struct {
+// HandshakeState holds the state of a peer during a handshake.
+// It is obtained via Initialize, and is used by calling WriteMessage and
+// ReadMessage in turns until they return two CipherState objects.
+// It can be used to run a handshake over any transport.
+type HandshakeState struct {
 	// the symmetricState object
 	symmetricState symmetricState
 	/* Empty is a special value which indicates the variable has not yet been initialized.
@@ -107,6 +361,13 @@ type handshakeState struct {
 	rs KeyPair // The remote party's static public key
 	re KeyPair // The remote party's ephemeral public key
 
+	// the DH function used with the keys
+	dh DHFunction
+
+	// the local ML-KEM key and the remote ML-KEM public key (see NoiseHFS)
+	e1  *mlkem.DecapsulationKey768
+	re1 *mlkem.EncapsulationKey768
+
 	// A boolean indicating the initiator or responder role.
 	initiator bool
 	// A sequence of message pattern. Each message pattern is a sequence
@@ -120,6 +381,12 @@ type handshakeState struct {
 	// pre-shared key
 	psk []byte
 
+	// the handshake hash, set at the end of the handshake
+	handshakeHash []byte
+
+	// the transport messages use explicit nonces (see DatagramConn)
+	datagram bool
+
 	// for test vectors
 	debugEphemeral *KeyPair
 }
@@ -127,19 +394,24 @@ type handshakeState struct {
 // Serialize is a helper function to serialize a handshake state, later to be unserialized via
 // the `RecoverState()` function.
 // For security purposes, the long-term static keypair is not serialized. Same for the psk
-func (hs *handshakeState) Serialize() []byte {
-	// [s.pubkey(32), e(64), rs(32), re(32), initiator(1), messagePatterns(?), shouldWrite(1), symmetricState.isKeyed(1) , serializedStrobeState(?)]
+func (hs *HandshakeState) Serialize() []byte {
+	// [dh, s.pubkey, e.privkey, e.pubkey, rs, re, e1.seed, re1] each preceded by its 2-byte length,
+	// followed by [initiator(1), messagePatterns(?), shouldWrite(1), symmetricState.isKeyed(1) , serializedStrobeState(?)]
 	var serialized bytes.Buffer
 
-	// s.pubkey (not the private key!)
-	serialized.Write(hs.s.PublicKey[:])
-	// e
-	serialized.Write(hs.e.PrivateKey[:])
-	serialized.Write(hs.e.PublicKey[:]) // TODO: we can re-compute this, do we serialize it?
-	// rs.pubkey
-	serialized.Write(hs.rs.PublicKey[:])
-	// re.pubkey
-	serialized.Write(hs.re.PublicKey[:])
+	// dh, s.pubkey (not the private key!), e, rs.pubkey, re.pubkey, and the ML-KEM keys
+	var e1, re1 []byte
+	if hs.e1 != nil {
+		e1 = hs.e1.Bytes()
+	}
+	if hs.re1 != nil {
+		re1 = hs.re1.Bytes()
+	}
+	var keys []byte
+	for _, key := range [][]byte{[]byte(hs.dh.String()), hs.s.PublicKey, hs.e.PrivateKey, hs.e.PublicKey, hs.rs.PublicKey, hs.re.PublicKey, e1, re1} {
+		keys = appendField(keys, key)
+	}
+	serialized.Write(keys)
 
 	// initiator
 	if hs.initiator {
@@ -160,27 +432,69 @@ func (hs *handshakeState) Serialize() []byte {
 	}
 
 	// symmetricState.isKeyed
-	if hs.symmetricState.isKeyed {
+	if hs.symmetricState.hasKey() {
 		serialized.WriteByte(1)
 	} else {
 		serialized.WriteByte(0)
 	}
 
-	// symmetricState.strobeState
-	serialized.Write(hs.symmetricState.strobeState.Serialize())
+	// symmetricState.strobeState, or the state of a Noise cipher suite
+	serialized.Write(hs.symmetricState.serialize())
 
 	//
 	return serialized.Bytes()
 }
 
+// hasKEMKeys returns true if the ML-KEM keys needed by the remaining ekem1 tokens
+// are known, or will be sent or received with e1 tokens before them
+func (hs *HandshakeState) hasKEMKeys() bool {
+	hasE1, hasRe1 := hs.e1 != nil, hs.re1 != nil
+	writing := hs.shouldWrite
+	for _, pattern := range hs.messagePatterns {
+		for _, token := range pattern {
+			switch {
+			case token == token_e1 && writing:
+				hasE1 = true
+			case token == token_e1:
+				hasRe1 = true
+			case token == token_ekem1 && writing && !hasRe1:
+				return false
+			case token == token_ekem1 && !writing && !hasE1:
+				return false
+			}
+		}
+		writing = !writing
+	}
+	return true
+}
+
 // RecoverState is a helper function to unserialize a previously serialized handshake state
 // (via the `Serialize()` function).
 // For security purposes, the long-term static keypair needs to be passed as argument.
-// RecoverState will crash if the passed serializedState is malformed
-func RecoverState(serialized []byte, psk []byte, s *KeyPair) handshakeState {
-	// [s.pubkey(32), e(64), rs(32), re(32), initiator(1), messagePatterns(?), shouldWrite(1), symmetricState.isKeyed(1) , serializedStrobeState(?)]
+// RecoverState returns an error matching ErrMalformedState if the passed serialized state
+// is malformed, and ErrInvalidKey if it was not serialized with the same static keypair.
+func RecoverState(serialized []byte, psk []byte, s *KeyPair) (*HandshakeState, error) {
+	// [dh, s.pubkey, e.privkey, e.pubkey, rs, re, e1.seed, re1] each preceded by its 2-byte length,
+	// followed by [initiator(1), messagePatterns(?), shouldWrite(1), symmetricState.isKeyed(1) , serializedStrobeState(?)]
+	var fields [8][]byte
+	for i := range fields {
+		if len(serialized) < 2 || len(serialized) < 2+int(binary.BigEndian.Uint16(serialized)) {
+			return nil, newError(ErrMalformedState, "disco: the serialized handshake state is too short")
+		}
+		length := 2 + int(binary.BigEndian.Uint16(serialized))
+		fields[i], serialized = serialized[2:length], serialized[length:]
+	}
+	if len(serialized) < 1 {
+		return nil, newError(ErrMalformedState, "disco: the serialized handshake state is too short")
+	}
 	bb := bytes.NewBuffer(serialized)
-	hs := handshakeState{}
+	hs := &HandshakeState{}
+
+	// dh
+	var ok bool
+	if hs.dh, ok = dhFunctions[string(fields[0])]; !ok {
+		return nil, newError(ErrMalformedState, "disco: the serialized DH function is not supported")
+	}
 
 	//psk
 	if psk != nil {
@@ -189,19 +503,29 @@ func RecoverState(serialized []byte, psk []byte, s *KeyPair) handshakeState {
 	}
 
 	// verify static keypair
-	if !bytes.Equal(s.PublicKey[:], serialized[0:32]) {
-		panic("wrong static keyPair passed")
+	if s == nil || !bytes.Equal(s.PublicKey, fields[1]) {
+		return nil, newError(ErrInvalidKey, "disco: wrong static keyPair passed")
 	}
 	// store static keypair
-	hs.s = *s
-	bb.Next(32)
+	hs.s = s.copy()
 	// e
-	bb.Read(hs.e.PrivateKey[:])
-	bb.Read(hs.e.PublicKey[:])
+	hs.e = KeyPair{PrivateKey: fields[2], PublicKey: fields[3]}.copy()
 	// rs.pubkey
-	bb.Read(hs.rs.PublicKey[:])
+	hs.rs = KeyPair{PublicKey: fields[4]}.copy()
 	// re.pubkey
-	bb.Read(hs.re.PublicKey[:])
+	hs.re = KeyPair{PublicKey: fields[5]}.copy()
+	// the ML-KEM keys
+	var err error
+	if len(fields[6]) > 0 {
+		if hs.e1, err = mlkem.NewDecapsulationKey768(fields[6]); err != nil {
+			return nil, newError(ErrMalformedState, "disco: the serialized ML-KEM key is malformed")
+		}
+	}
+	if len(fields[7]) > 0 {
+		if hs.re1, err = mlkem.NewEncapsulationKey768(fields[7]); err != nil {
+			return nil, newError(ErrMalformedState, "disco: the serialized ML-KEM public key is malformed")
+		}
+	}
 
 	// initiator
 	if initiator, _ := bb.ReadByte(); initiator == 1 {
@@ -211,115 +535,158 @@ func RecoverState(serialized []byte, psk []byte, s *KeyPair) handshakeState {
 	// we use gob to encode the messagePatterns
 	decoder := gob.NewDecoder(bb)
 	if err := decoder.Decode(&(hs.messagePatterns)); err != nil {
-		panic(err)
+		return nil, newError(ErrMalformedState, "disco: cannot decode the serialized message patterns: "+err.Error())
 	}
 
 	// shouldWrite
 	if shouldWrite, _ := bb.ReadByte(); shouldWrite == 1 {
 		hs.shouldWrite = true
 	}
+	if !hs.hasKEMKeys() {
+		return nil, newError(ErrMalformedState, "disco: the serialized handshake state lacks the ML-KEM key needed by the next messages")
+	}
 
 	// symmetricState.isKeyed
-	if isKeyed, _ := bb.ReadByte(); isKeyed == 1 {
-		hs.symmetricState.isKeyed = true
+	isKeyed, _ := bb.ReadByte()
+
+	// the state of a Noise cipher suite
+	if bb.Len() > 0 && bb.Bytes()[0] == noiseStateMarker {
+		symmetricState, err := recoverNoiseSymmetricState(bb.Bytes(), isKeyed == 1)
+		if err != nil {
+			return nil, err
+		}
+		hs.symmetricState = symmetricState
+		return hs, nil
 	}
 
 	// symmetricState.strobeState
-	hs.symmetricState.strobeState = strobe.RecoverState(bb.Bytes())
+	if !validStrobeState(bb.Bytes()) {
+		return nil, newError(ErrMalformedState, "disco: the serialized Strobe state is malformed")
+	}
+	hs.symmetricState = &strobeSymmetricState{strobeState: strobe.RecoverState(bb.Bytes()), isKeyed: isKeyed == 1}
 
 	//
-	return hs
+	return hs, nil
+}
+
+// validStrobeState checks the values that would make strobe.RecoverState panic
+func validStrobeState(serialized []byte) bool {
+	// [security(1), initialized(1), I0(1), curFlags(1), posBegin(1), pos(1), state(25*8)]
+	if len(serialized) != 6+25*8 || serialized[0] > 1 || serialized[2] > 3 {
+		return false
+	}
+	// pos indexes a buffer of the size of the duplex rate (security of 128 bits)
+	return int(serialized[5]) <= 1600/8-128/4
 }
 
 // Initialize allows you to initialize a peer
-// * see `patterns` for a list of available handshakePatterns
+// * see `patterns` for a list of available handshakePatterns, they can be combined with modifiers (see NoisePSK0)
 // * initiator = false means the instance is for a responder
 // * prologue is a byte string record of anything that happened prior the Noise handshakeState
 // * s, e, rs, re are the local and remote static/ephemeral key pairs to be set (if they exist)
-// the function returns a handshakeState object.
-func Initialize(handshakeType noiseHandshakeType, initiator bool, prologue []byte, s, e, rs, re *KeyPair) (hs handshakeState) {
+// (e and re are only used by fallback patterns, see NoiseFallback)
+// * psk is a 32-byte pre-shared key, mandatory for patterns with a psk modifier and ignored otherwise
+// the function returns a HandshakeState object, or an error if the keys required by the pattern are not set.
+func Initialize(handshakeType noiseHandshakeType, initiator bool, prologue []byte, s, e, rs, re *KeyPair, psk []byte) (*HandshakeState, error) {
+	return InitializeWithCipherSuite(CipherSuite{}, handshakeType, initiator, prologue, s, e, rs, re, psk)
+}
 
-	handshakePattern, ok := patterns[handshakeType]
-	if !ok {
-		panic("disco: the supplied handshakePattern does not exist")
+// InitializeWithCipherSuite is like Initialize, but uses the symmetric
+// cryptography of suite instead of Strobe (see CipherSuite).
+func InitializeWithCipherSuite(suite CipherSuite, handshakeType noiseHandshakeType, initiator bool, prologue []byte, s, e, rs, re *KeyPair, psk []byte) (*HandshakeState, error) {
+	if err := suite.check(); err != nil {
+		return nil, err
+	}
+	handshakePattern, err := getPattern(handshakeType)
+	if err != nil {
+		return nil, err
 	}
 
-	hs.symmetricState.initializeSymmetric("Noise_" + handshakePattern.name + "_25519_STROBEv1.0.2")
+	hs := &HandshakeState{}
+	if handshakeType.hasPSK() {
+		if len(psk) != 32 {
+			return nil, ErrInvalidPSK
+		}
+		hs.psk = append([]byte{}, psk...)
+	}
+
+	hs.symmetricState = suite.newSymmetricState(protocolName(handshakePattern, suite))
 
 	hs.symmetricState.mixHash(prologue)
 
-	if s != nil {
-		hs.s = *s
-	}
-	if e != nil {
-		panic("disco: fallback patterns are not implemented")
-	}
-	if rs != nil {
-		hs.rs = *rs
-	}
-	if re != nil {
-		panic("disco: fallback patterns are not implemented")
+	// the keys are copied, they are cleared with the handshake state
+	hs.dh = suite.dh()
+	for _, key := range []struct{ from, to *KeyPair }{{s, &hs.s}, {e, &hs.e}, {rs, &hs.rs}, {re, &hs.re}} {
+		if key.from == nil {
+			continue
+		}
+		if len(key.from.PublicKey) != 0 && len(key.from.PublicKey) != hs.dh.DHLen() {
+			return nil, newError(ErrInvalidKey, "disco: the keys should be "+strconv.Itoa(hs.dh.DHLen())+"-byte with the DH function "+hs.dh.String())
+		}
+		*key.to = key.from.copy()
 	}
 
 	hs.initiator = initiator
-	hs.shouldWrite = initiator
+	// in fallback patterns, the responder is the one sending the first message
+	hs.shouldWrite = initiator != handshakePattern.fallback
 
 	//Calls MixHash() once for each public key listed in the pre-messages from handshake_pattern, with the specified public key as input (see Section 7 for an explanation of pre-messages). If both initiator and responder have pre-messages, the initiator's public keys are hashed first.
-
-	// initiator pre-message pattern
-	for _, token := range handshakePattern.preMessagePatterns[0] {
-		if token == token_s {
-			if initiator {
-				if s == nil {
-					panic("disco: the static key of the client should be set")
+	for idx, preMessage := range handshakePattern.preMessagePatterns {
+		// are those our keys or the remote peer's keys?
+		local := (idx == 0) == initiator
+		for _, token := range preMessage {
+			switch token {
+			case token_s:
+				if local {
+					if s == nil {
+						return nil, newError(ErrInvalidKey, "disco: the local static key should be set")
+					}
+					hs.symmetricState.mixHash(s.PublicKey)
+				} else {
+					if rs == nil {
+						return nil, newError(ErrInvalidKey, "disco: the remote static key should be set")
+					}
+					hs.symmetricState.mixHash(rs.PublicKey)
 				}
-				hs.symmetricState.mixHash(s.PublicKey[:])
-			} else {
-				if rs == nil {
-					panic("disco: the remote static key of the server should be set")
-				}
-				hs.symmetricState.mixHash(rs.PublicKey[:])
-			}
-		} else {
-			panic("disco: token of pre-message not supported")
-		}
-	}
-
-	// responder pre-message pattern
-	for _, token := range handshakePattern.preMessagePatterns[1] {
-		if token == token_s {
-			if initiator {
-				if rs == nil {
-					panic("disco: the remote static key of the server should be set")
+			case token_e:
+				var publicKey []byte
+				if local {
+					if e == nil {
+						return nil, newError(ErrInvalidKey, "disco: the local ephemeral key should be set")
+					}
+					publicKey = e.PublicKey
+				} else {
+					if re == nil {
+						return nil, newError(ErrInvalidKey, "disco: the remote ephemeral key should be set")
+					}
+					publicKey = re.PublicKey
 				}
-				hs.symmetricState.mixHash(rs.PublicKey[:])
-			} else {
-				if s == nil {
-					panic("disco: the static key of the client should be set")
+				hs.symmetricState.mixHash(publicKey)
+				if handshakeType.hasPSK() {
+					hs.symmetricState.mixKey(publicKey)
 				}
-				hs.symmetricState.mixHash(s.PublicKey[:])
+			default:
+				return nil, errors.New("disco: token of pre-message not supported")
 			}
-		} else {
-			panic("disco: token of pre-message not supported")
 		}
 	}
 
 	hs.messagePatterns = handshakePattern.messagePatterns
 
-	return
+	return hs, nil
 }
 
 // WriteMessage takes a (nil) payload and a messageBuffer. It writes the next Noise message into
 // the message buffer.
 // messageBuffer cannot be nil
-func (hs *handshakeState) WriteMessage(payload []byte, messageBuffer *[]byte) (c1, c2 *strobe.Strobe, err error) {
-	// is it our turn to write?
-	if !hs.shouldWrite {
-		panic("disco: unexpected call to WriteMessage should be ReadMessage")
-	}
+func (hs *HandshakeState) WriteMessage(payload []byte, messageBuffer *[]byte) (c1, c2 *CipherState, err error) {
 	// do we have a token to process?
 	if len(hs.messagePatterns) == 0 || len(hs.messagePatterns[0]) == 0 {
-		panic("disco: no more tokens or message patterns to write")
+		return nil, nil, errors.New("disco: no more tokens or message patterns to write")
+	}
+	// is it our turn to write?
+	if !hs.shouldWrite {
+		return nil, nil, errors.New("disco: unexpected call to WriteMessage should be ReadMessage")
 	}
 
 	// process the patterns
@@ -328,52 +695,80 @@ func (hs *handshakeState) WriteMessage(payload []byte, messageBuffer *[]byte) (c
 		switch pattern {
 
 		default:
-			panic("Disco: token not recognized")
+			return nil, nil, errors.New("disco: token not recognized")
 
 		case token_e:
 			// debug
 			if hs.debugEphemeral != nil {
-				hs.e = *hs.debugEphemeral
+				hs.e = hs.debugEphemeral.copy()
 			} else {
-				hs.e = *GenerateKeypair(nil)
+				var e *KeyPair
+				if e, err = hs.dh.GenerateKeypair(nil); err != nil {
+					return
+				}
+				hs.e = *e
 			}
-			*messageBuffer = append(*messageBuffer, hs.e.PublicKey[:]...)
-			hs.symmetricState.mixHash(hs.e.PublicKey[:])
+			*messageBuffer = append(*messageBuffer, hs.e.PublicKey...)
+			hs.symmetricState.mixHash(hs.e.PublicKey)
 			if len(hs.psk) > 0 {
 				hs.symmetricState.mixKey(hs.e.PublicKey)
 			}
 
 		case token_s:
 			var ciphertext []byte
-			ciphertext, err = hs.symmetricState.encryptAndHash(hs.s.PublicKey[:])
+			ciphertext, err = hs.symmetricState.encryptAndHash(hs.s.PublicKey)
+			if err != nil {
+				return
+			}
+			*messageBuffer = append(*messageBuffer, ciphertext...)
+
+		case token_e1:
+			if hs.e1, err = generateKEMKey(); err != nil {
+				return
+			}
+			var ciphertext []byte
+			ciphertext, err = hs.symmetricState.encryptAndHash(hs.e1.EncapsulationKey().Bytes())
+			if err != nil {
+				return
+			}
+			*messageBuffer = append(*messageBuffer, ciphertext...)
+
+		case token_ekem1:
+			sharedKey, kemCiphertext := hs.encapsulate()
+			var ciphertext []byte
+			ciphertext, err = hs.symmetricState.encryptAndHash(kemCiphertext)
 			if err != nil {
 				return
 			}
 			*messageBuffer = append(*messageBuffer, ciphertext...)
+			hs.symmetricState.mixKey(sharedKey)
 
 		case token_ee:
-			hs.symmetricState.mixKey(dh(hs.e, hs.re.PublicKey))
+			err = hs.mixDH(hs.e, hs.re)
 
 		case token_es:
 			if hs.initiator {
-				hs.symmetricState.mixKey(dh(hs.e, hs.rs.PublicKey))
+				err = hs.mixDH(hs.e, hs.rs)
 			} else {
-				hs.symmetricState.mixKey(dh(hs.s, hs.re.PublicKey))
+				err = hs.mixDH(hs.s, hs.re)
 			}
 
 		case token_se:
 			if hs.initiator {
-				hs.symmetricState.mixKey(dh(hs.s, hs.re.PublicKey))
+				err = hs.mixDH(hs.s, hs.re)
 			} else {
-				hs.symmetricState.mixKey(dh(hs.e, hs.rs.PublicKey))
+				err = hs.mixDH(hs.e, hs.rs)
 			}
 
 		case token_ss:
-			hs.symmetricState.mixKey(dh(hs.s, hs.rs.PublicKey))
+			err = hs.mixDH(hs.s, hs.rs)
 
 		case token_psk:
 			hs.symmetricState.mixKeyAndHash(hs.psk)
 		}
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	// Appends EncryptAndHash(payload) to the buffer
@@ -388,7 +783,8 @@ func (hs *handshakeState) WriteMessage(payload []byte, messageBuffer *[]byte) (c
 	if len(hs.messagePatterns) == 1 {
 		// If there are no more message patterns returns two new CipherState objects
 		hs.messagePatterns = nil
-		c1, c2 = hs.symmetricState.Split()
+		hs.handshakeHash = hs.symmetricState.GetHandshakeHash()
+		c1, c2 = hs.split()
 	} else {
 		// remove the pattern from the messagePattern
 		hs.messagePatterns = hs.messagePatterns[1:]
@@ -403,76 +799,90 @@ func (hs *handshakeState) WriteMessage(payload []byte, messageBuffer *[]byte) (c
 // ReadMessage takes a byte sequence containing a Noise handshake message,
 // and a payload_buffer to write the message's plaintext payload into.
 // payload_buffer cannot be nil
-func (hs *handshakeState) ReadMessage(message []byte, payloadBuffer *[]byte) (c1, c2 *strobe.Strobe, err error) {
-	// is it our turn to read?
-	if hs.shouldWrite {
-		panic("disco: unexpected call to ReadMessage should be WriteMessage")
-	}
+func (hs *HandshakeState) ReadMessage(message []byte, payloadBuffer *[]byte) (c1, c2 *CipherState, err error) {
 	// do we have a token to process?
 	if len(hs.messagePatterns) == 0 || len(hs.messagePatterns[0]) == 0 {
-		panic("disco: no more message pattern to read")
+		return nil, nil, errors.New("disco: no more message pattern to read")
+	}
+	// is it our turn to read?
+	if hs.shouldWrite {
+		return nil, nil, errors.New("disco: unexpected call to ReadMessage should be WriteMessage")
 	}
 
 	// process the patterns
 	offset := 0
+	dhLen := hs.dh.DHLen()
 
 	for _, pattern := range hs.messagePatterns[0] {
 
 		switch pattern {
 
 		default:
-			panic("disco: token not recognized")
+			return nil, nil, errors.New("disco: token not recognized")
 
 		case token_e:
 			if len(message[offset:]) < dhLen {
-				return nil, nil, errors.New("disco: the received ephemeral key is to short")
+				return nil, nil, newError(ErrMalformedMessage, "disco: the received ephemeral key is to short")
 			}
-			copy(hs.re.PublicKey[:], message[offset:offset+dhLen])
+			hs.re.PublicKey = append([]byte(nil), message[offset:offset+dhLen]...)
 			offset += dhLen
-			hs.symmetricState.mixHash(hs.re.PublicKey[:])
+			hs.symmetricState.mixHash(hs.re.PublicKey)
 			if len(hs.psk) > 0 {
 				hs.symmetricState.mixKey(hs.re.PublicKey)
 			}
 
 		case token_s:
-			tagLen := 0
-			if hs.symmetricState.isKeyed {
-				tagLen = 16
-			}
-			if len(message[offset:]) < dhLen+tagLen {
-				return nil, nil, errors.New("disco: the received static key is to short")
+			var plaintext []byte
+			if plaintext, err = hs.readEncrypted(message, &offset, dhLen, "static key"); err != nil {
+				return
 			}
+			hs.rs.PublicKey = plaintext
+
+		case token_e1:
 			var plaintext []byte
-			plaintext, err = hs.symmetricState.decryptAndHash(message[offset : offset+dhLen+tagLen])
-			if err != nil {
+			if plaintext, err = hs.readEncrypted(message, &offset, mlkem.EncapsulationKeySize768, "ML-KEM public key"); err != nil {
 				return
 			}
-			copy(hs.rs.PublicKey[:], plaintext)
-			offset += dhLen + tagLen
+			if hs.re1, err = mlkem.NewEncapsulationKey768(plaintext); err != nil {
+				return nil, nil, newError(ErrInvalidKey, "disco: the received ML-KEM public key is invalid")
+			}
+
+		case token_ekem1:
+			var plaintext, sharedKey []byte
+			if plaintext, err = hs.readEncrypted(message, &offset, mlkem.CiphertextSize768, "ML-KEM ciphertext"); err != nil {
+				return
+			}
+			if sharedKey, err = hs.e1.Decapsulate(plaintext); err != nil {
+				return nil, nil, newError(ErrMalformedMessage, "disco: the received ML-KEM ciphertext is malformed")
+			}
+			hs.symmetricState.mixKey(sharedKey)
 
 		case token_ee:
-			hs.symmetricState.mixKey(dh(hs.e, hs.re.PublicKey))
+			err = hs.mixDH(hs.e, hs.re)
 
 		case token_es:
 			if hs.initiator {
-				hs.symmetricState.mixKey(dh(hs.e, hs.rs.PublicKey))
+				err = hs.mixDH(hs.e, hs.rs)
 			} else {
-				hs.symmetricState.mixKey(dh(hs.s, hs.re.PublicKey))
+				err = hs.mixDH(hs.s, hs.re)
 			}
 
 		case token_se:
 			if hs.initiator {
-				hs.symmetricState.mixKey(dh(hs.s, hs.re.PublicKey))
+				err = hs.mixDH(hs.s, hs.re)
 			} else {
-				hs.symmetricState.mixKey(dh(hs.e, hs.rs.PublicKey))
+				err = hs.mixDH(hs.e, hs.rs)
 			}
 
 		case token_ss:
-			hs.symmetricState.mixKey(dh(hs.s, hs.rs.PublicKey))
+			err = hs.mixDH(hs.s, hs.rs)
 
 		case token_psk:
 			hs.symmetricState.mixKeyAndHash(hs.psk)
 		}
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	// Appends decrpyAndHash(payload) to the buffer
@@ -487,7 +897,8 @@ func (hs *handshakeState) ReadMessage(message []byte, payloadBuffer *[]byte) (c1
 	if len(hs.messagePatterns) == 1 {
 		// If there are no more message patterns returns two new CipherState objects
 		hs.messagePatterns = nil
-		c1, c2 = hs.symmetricState.Split()
+		hs.handshakeHash = hs.symmetricState.GetHandshakeHash()
+		c1, c2 = hs.split()
 	} else {
 		hs.messagePatterns = hs.messagePatterns[1:]
 	}
@@ -498,16 +909,90 @@ func (hs *handshakeState) ReadMessage(message []byte, payloadBuffer *[]byte) (c1
 	return
 }
 
+// mixDH calls MixKey with the output of a DH between a local key pair and a remote public key
+func (hs *HandshakeState) mixDH(local, remote KeyPair) error {
+	shared, err := hs.dh.DH(local.PrivateKey, remote.PublicKey)
+	if err != nil {
+		return err
+	}
+	hs.symmetricState.mixKey(shared)
+	return nil
+}
+
+// readEncrypted reads a value of size bytes from message at offset, followed
+// by an authentication tag if the symmetric state has a key, and decrypts it
+func (hs *HandshakeState) readEncrypted(message []byte, offset *int, size int, name string) ([]byte, error) {
+	if hs.symmetricState.hasKey() {
+		size += 16
+	}
+	if len(message[*offset:]) < size {
+		return nil, newError(ErrMalformedMessage, "disco: the received "+name+" is to short")
+	}
+	plaintext, err := hs.symmetricState.decryptAndHash(message[*offset : *offset+size])
+	if err != nil {
+		return nil, err
+	}
+	*offset += size
+	return append([]byte(nil), plaintext...), nil
+}
+
+// generateKEMKey and encapsulateKEM draw the randomness of the hfs patterns,
+// the test vectors replace them to reproduce a transcript
+var (
+	generateKEMKey = mlkem.GenerateKey768
+	encapsulateKEM = (*mlkem.EncapsulationKey768).Encapsulate
+)
+
+// encapsulate returns a shared key and its encapsulation to the remote ML-KEM public key
+func (hs *HandshakeState) encapsulate() (sharedKey, ciphertext []byte) {
+	return encapsulateKEM(hs.re1)
+}
+
+// split returns the CipherStates of the transport messages at the end of the handshake
+func (hs *HandshakeState) split() (c1, c2 *CipherState) {
+	if hs.datagram {
+		return hs.symmetricState.splitDatagram()
+	}
+	return hs.symmetricState.Split()
+}
+
+// ShouldWrite returns true if the next call should be to WriteMessage,
+// and false if the next call should be to ReadMessage.
+func (hs *HandshakeState) ShouldWrite() bool {
+	return hs.shouldWrite
+}
+
+// RemoteStaticKey returns the static public key of the remote peer, if it is
+// known (received during the handshake or passed to Initialize), and nil otherwise.
+// Note that it is the responsability of the caller to authenticate a received key.
+func (hs *HandshakeState) RemoteStaticKey() []byte {
+	if len(hs.rs.PublicKey) == 0 {
+		return nil
+	}
+	return append([]byte{}, hs.rs.PublicKey...)
+}
+
+// HandshakeHash returns a 32-byte value binding the whole transcript of the handshake.
+// Once the handshake is over, it uniquely identifies the session and can be used
+// for channel binding (for example by signing it).
+func (hs *HandshakeState) HandshakeHash() []byte {
+	if hs.handshakeHash != nil {
+		return append([]byte{}, hs.handshakeHash...)
+	}
+	return hs.symmetricState.GetHandshakeHash()
+}
+
 //
 // Clearing stuff
 //
 
 // TODO: is there a better way to get rid of secrets in Go?
-func (hs *handshakeState) clear() {
+func (hs *HandshakeState) clear() {
 	hs.s.clear()
 	hs.e.clear()
 	hs.rs.clear()
 	hs.re.clear()
+	hs.e1, hs.re1 = nil, nil
 }
 
 // TODO: is there a better way to get rid of secrets in Go?
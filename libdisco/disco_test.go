@@ -197,17 +197,26 @@ func TestSerialize(t *testing.T) {
 	// init
 	s := GenerateKeypair(nil)
 	rs := GenerateKeypair(nil)
-	hs := Initialize(NoiseIK, true, nil, s, nil, rs, nil)
+	hs, err := Initialize(NoiseIK, true, nil, s, nil, rs, nil, nil)
+	if err != nil {
+		t.Fatal("cannot initialize", err)
+	}
 	// write first message
 	var msg []byte
 	hs.WriteMessage(nil, &msg)
 	// serialize
 	serialized := hs.Serialize()
 	// unserialize
-	hs2 := RecoverState(serialized, nil, s)
+	hs2, err := RecoverState(serialized, nil, s)
+	if err != nil {
+		t.Fatal("cannot recover the serialized state", err)
+	}
 
 	// let's write a message to parse
-	hsBob := Initialize(NoiseIK, false, nil, rs, nil, s, nil)
+	hsBob, err := Initialize(NoiseIK, false, nil, rs, nil, s, nil, nil)
+	if err != nil {
+		t.Fatal("cannot initialize", err)
+	}
 	var msg2 []byte
 	hsBob.ReadMessage(msg, &msg2)
 	msg2 = msg2[:0]
@@ -222,12 +231,122 @@ func TestSerialize(t *testing.T) {
 		t.Fatal("received message not as expected")
 	}
 
-	if !bytes.Equal(c1.Serialize(), t1.Serialize()) {
-		t.Fatal("obtained strobeState not matching")
+	if !bytes.Equal(c1.Encrypt([]byte("hello")), t1.Encrypt([]byte("hello"))) {
+		t.Fatal("obtained CipherState not matching")
 	}
 
-	if !bytes.Equal(c2.Serialize(), t2.Serialize()) {
-		t.Fatal("obtained strobeState not matching")
+	if !bytes.Equal(c2.Encrypt([]byte("hello")), t2.Encrypt([]byte("hello"))) {
+		t.Fatal("obtained CipherState not matching")
 	}
 
 }
+
+func TestHandshakeState(t *testing.T) {
+	clientKeyPair := GenerateKeypair(nil)
+	serverKeyPair := GenerateKeypair(nil)
+
+	client, err := Initialize(NoiseXX, true, []byte("prologue"), clientKeyPair, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal("cannot initialize the client", err)
+	}
+	server, err := Initialize(NoiseXX, false, []byte("prologue"), serverKeyPair, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal("cannot initialize the server", err)
+	}
+
+	// run the handshake over byte slices
+	var clientCiphers, serverCiphers [2]*CipherState
+	writer, reader := client, server
+	for clientCiphers[0] == nil {
+		if !writer.ShouldWrite() || reader.ShouldWrite() {
+			t.Fatal("peers do not agree on who should write")
+		}
+		var message, payload []byte
+		c1, c2, err := writer.WriteMessage([]byte("payload"), &message)
+		if err != nil {
+			t.Fatal("cannot write handshake message", err)
+		}
+		d1, d2, err := reader.ReadMessage(message, &payload)
+		if err != nil {
+			t.Fatal("cannot read handshake message", err)
+		}
+		if string(payload) != "payload" {
+			t.Fatal("handshake payload not received")
+		}
+		if writer == client {
+			clientCiphers, serverCiphers = [2]*CipherState{c1, c2}, [2]*CipherState{d1, d2}
+		} else {
+			clientCiphers, serverCiphers = [2]*CipherState{d1, d2}, [2]*CipherState{c1, c2}
+		}
+		writer, reader = reader, writer
+	}
+
+	// the handshake is over
+	var message []byte
+	if _, _, err := client.WriteMessage(nil, &message); err == nil {
+		t.Fatal("it should not be possible to write after the end of the handshake")
+	}
+	if !bytes.Equal(client.RemoteStaticKey(), serverKeyPair.PublicKey[:]) ||
+		!bytes.Equal(server.RemoteStaticKey(), clientKeyPair.PublicKey[:]) {
+		t.Fatal("remote static keys not as expected")
+	}
+	if len(client.HandshakeHash()) != 32 || !bytes.Equal(client.HandshakeHash(), server.HandshakeHash()) {
+		t.Fatal("handshake hashes do not match")
+	}
+
+	// transport messages
+	for i := 0; i < 3; i++ {
+		ciphertext := clientCiphers[0].Encrypt([]byte("client to server"))
+		plaintext, err := serverCiphers[0].Decrypt(ciphertext)
+		if err != nil || string(plaintext) != "client to server" {
+			t.Fatal("cannot decrypt client message", err)
+		}
+		ciphertext = serverCiphers[1].Encrypt([]byte("server to client"))
+		plaintext, err = clientCiphers[1].Decrypt(ciphertext)
+		if err != nil || string(plaintext) != "server to client" {
+			t.Fatal("cannot decrypt server message", err)
+		}
+	}
+
+	// rekey
+	clientCiphers[0].Rekey()
+	serverCiphers[0].Rekey()
+	plaintext, err := serverCiphers[0].Decrypt(clientCiphers[0].Encrypt([]byte("after rekey")))
+	if err != nil || string(plaintext) != "after rekey" {
+		t.Fatal("cannot decrypt after rekeying", err)
+	}
+	serverCiphers[1].Rekey()
+	if _, err := clientCiphers[1].Decrypt(serverCiphers[1].Encrypt([]byte("one-sided rekey"))); err == nil {
+		t.Fatal("a message was decrypted after only one peer rekeyed")
+	}
+
+	ciphertext := clientCiphers[0].Encrypt([]byte("tampered"))
+	ciphertext[0] ^= 1
+	if _, err := serverCiphers[0].Decrypt(ciphertext); err == nil {
+		t.Fatal("a modified message was decrypted")
+	}
+}
+
+func TestInitializeErrors(t *testing.T) {
+	// NK requires the server's static key
+	if _, err := Initialize(NoiseNK, true, nil, nil, nil, nil, nil, nil); err == nil {
+		t.Fatal("Initialize should require the remote static key")
+	}
+	// psk patterns require a pre-shared key
+	if _, err := Initialize(NoiseNNpsk2, true, nil, nil, nil, nil, nil, []byte("short")); err == nil {
+		t.Fatal("Initialize should require a 32-byte pre-shared key")
+	}
+	// unknown pattern
+	if _, err := Initialize(NoiseUnknown, true, nil, nil, nil, nil, nil, nil); err == nil {
+		t.Fatal("Initialize should not accept an unknown pattern")
+	}
+	// wrong order
+	hs, err := Initialize(NoiseNN, false, nil, nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message []byte
+	if _, _, err := hs.WriteMessage(nil, &message); err == nil {
+		t.Fatal("a responder should not be able to write first")
+	}
+}
@@ -0,0 +1,275 @@
+package libdisco
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+//
+// DiscoSocket
+//
+
+// DiscoSocket is a framing modeled after NoiseSocket, but specific to Disco:
+// the content of its messages differs, so it does not interoperate with
+// NoiseSocket peers.
+//
+// A handshake message is made of negotiation data preceded by its 2-byte
+// length, followed by a Noise message preceded by its 2-byte length. A transport
+// message is a Noise message preceded by its 2-byte length. The payload of every
+// Noise message is a body preceded by its 2-byte length and followed by padding
+// (see Config.Padding): the bodies of handshake messages are the payloads built
+// by a Conn (see buildHandshakeMessage), and the bodies of transport messages
+// are records.
+//
+// The client sends its negotiation data with its first message, the server
+// answers with empty negotiation data to accept the handshake, or with one of
+// the following bytes followed by an empty handshake message:
+const (
+	// followed by the protocol name the client should restart the handshake with
+	negotiationSwitch byte = 1
+	// followed by the reason of the rejection, the server closes the connection
+	negotiationReject byte = 2
+)
+
+// The prologues of DiscoSocket handshakes start with these strings
+const (
+	discoSocketInit   = "DiscoSocketInit"   // the handshake started by the client
+	discoSocketSwitch = "DiscoSocketSwitch" // the handshake restarted by the client after a switch
+)
+
+// discoSocketHandshake goes through the negotiation and the handshake.
+// The negotiation might replace the configuration of the connection.
+func (c *Conn) discoSocketHandshake() (hs *HandshakeState, c1, c2 *CipherState, err error) {
+	if c.isClient {
+		return c.discoSocketClientHandshake()
+	}
+	return c.discoSocketServerHandshake()
+}
+
+func (c *Conn) discoSocketClientHandshake() (hs *HandshakeState, c1, c2 *CipherState, err error) {
+	negotiationData := c.config.NegotiationData
+	if negotiationData == nil {
+		protocolName, err := c.config.ProtocolName()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		negotiationData = []byte(protocolName)
+	}
+	remoteKeyPair, err := c.remoteKeyPair()
+	if err != nil {
+		return
+	}
+
+	// -> negotiation data, first message
+	c.handshakePattern = c.config.HandshakePattern
+	prologue := c.discoSocketPrologue(discoSocketInit, negotiationData)
+	hs, err = InitializeWithCipherSuite(c.config.CipherSuite, c.config.HandshakePattern, true, prologue, c.config.KeyPair, nil, remoteKeyPair, nil, c.config.PreSharedKey)
+	if err != nil {
+		return
+	}
+	message, c1, c2, err := c.buildHandshakeMessage(hs, nil)
+	if err != nil {
+		return
+	}
+	if err = c.writeHandshakeFrame(negotiationData, message); err != nil || c1 != nil {
+		// one-way patterns end here
+		return
+	}
+
+	// <- the server's decision
+	response, responseMessage, err := c.readHandshakeFrame()
+	if err != nil {
+		return
+	}
+	if len(response) == 0 {
+		// accepted
+		if c1, c2, err = c.readHandshakeMessage(hs, responseMessage); err != nil || c1 != nil {
+			return
+		}
+		c1, c2, err = c.continueHandshake(hs)
+		return
+	}
+	if len(responseMessage) != 0 {
+		return nil, nil, nil, newError(ErrMalformedMessage, "disco: the negotiation data received from the server is malformed")
+	}
+	switch response[0] {
+	case negotiationReject:
+		return nil, nil, nil, newError(ErrRejected, "disco: the server rejected the connection: "+strconv.Quote(string(response[1:])))
+	case negotiationSwitch:
+		protocolConfig, err := ParseProtocolName(string(response[1:]))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !c.acceptsSwitch(protocolConfig.HandshakePattern) {
+			return nil, nil, nil, newError(ErrUnknownPattern, "disco: the server asked to switch to a pattern not listed in SwitchPatterns: "+strconv.Quote(string(response[1:])))
+		}
+		config := *c.config
+		config.HandshakePattern = protocolConfig.HandshakePattern
+		if err = checkRequirements(true, &config); err != nil {
+			return nil, nil, nil, err
+		}
+		c.config = &config
+
+		// restart the handshake with the new pattern
+		hs.clear()
+		c.handshakeMessageIndex = 0
+		c.handshakePattern = config.HandshakePattern
+		prologue = c.discoSocketPrologue(discoSocketSwitch, negotiationData, message, response)
+		hs, err = InitializeWithCipherSuite(c.config.CipherSuite, config.HandshakePattern, true, prologue, config.KeyPair, nil, remoteKeyPair, nil, config.PreSharedKey)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		c1, c2, err = c.continueHandshake(hs)
+		return hs, c1, c2, err
+	default:
+		return nil, nil, nil, newError(ErrMalformedMessage, "disco: the negotiation data received from the server is malformed")
+	}
+}
+
+func (c *Conn) discoSocketServerHandshake() (hs *HandshakeState, c1, c2 *CipherState, err error) {
+	// <- negotiation data, first message
+	negotiationData, message, err := c.readHandshakeFrame()
+	if err != nil {
+		return
+	}
+	negotiation := c.negotiate(negotiationData)
+	if negotiation.Config != nil {
+		if !negotiation.Config.DiscoSocket {
+			return nil, nil, nil, newError(ErrNoConfig, "disco: the Config returned by Negotiate does not have DiscoSocket set")
+		}
+		if err = checkRequirements(false, negotiation.Config); err != nil {
+			return
+		}
+		if c.config, err = negotiation.Config.resolveKeyPair(); err != nil {
+			return
+		}
+	}
+	// on one-way patterns the server cannot answer
+	oneWay := c.config.HandshakePattern.isOneWay()
+
+	switch {
+	case negotiation.Reject:
+		if !oneWay {
+			c.writeHandshakeFrame(append([]byte{negotiationReject}, negotiation.Reason...), nil)
+		}
+		return nil, nil, nil, newError(ErrRejected, "disco: the client was rejected: "+strconv.Quote(negotiation.Reason))
+	case negotiation.Switch != NoiseUnknown:
+		if oneWay {
+			return nil, nil, nil, newError(ErrOneWay, "disco: a server cannot ask to switch patterns on one-way patterns")
+		}
+		config := *c.config
+		config.HandshakePattern = negotiation.Switch
+		if err = checkRequirements(false, &config); err != nil {
+			return
+		}
+		c.config = &config
+		protocolName, err := config.ProtocolName()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		response := append([]byte{negotiationSwitch}, protocolName...)
+		if err = c.writeHandshakeFrame(response, nil); err != nil {
+			return nil, nil, nil, err
+		}
+
+		// the client restarts the handshake with the new pattern
+		remoteKeyPair, err := c.remoteKeyPair()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		c.handshakePattern = config.HandshakePattern
+		prologue := c.discoSocketPrologue(discoSocketSwitch, negotiationData, message, response)
+		hs, err = InitializeWithCipherSuite(c.config.CipherSuite, config.HandshakePattern, false, prologue, config.KeyPair, nil, remoteKeyPair, nil, config.PreSharedKey)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		c1, c2, err = c.continueHandshake(hs)
+		return hs, c1, c2, err
+	}
+
+	// accepted
+	remoteKeyPair, err := c.remoteKeyPair()
+	if err != nil {
+		return
+	}
+	c.handshakePattern = c.config.HandshakePattern
+	prologue := c.discoSocketPrologue(discoSocketInit, negotiationData)
+	hs, err = InitializeWithCipherSuite(c.config.CipherSuite, c.config.HandshakePattern, false, prologue, c.config.KeyPair, nil, remoteKeyPair, nil, c.config.PreSharedKey)
+	if err != nil {
+		return
+	}
+	if c1, c2, err = c.readHandshakeMessage(hs, message); err != nil || c1 != nil {
+		return
+	}
+	c1, c2, err = c.continueHandshake(hs)
+	return
+}
+
+// negotiate returns the decision of the server for the negotiation data of a client
+func (c *Conn) negotiate(negotiationData []byte) Negotiation {
+	if c.config.Negotiate != nil {
+		return c.config.Negotiate(negotiationData)
+	}
+	protocolName, err := c.config.ProtocolName()
+	if err != nil || string(negotiationData) != protocolName {
+		return Negotiation{Reject: true, Reason: "unsupported protocol"}
+	}
+	return Negotiation{}
+}
+
+// acceptsSwitch returns true if the client accepts to restart the handshake with the pattern
+func (c *Conn) acceptsSwitch(pattern noiseHandshakeType) bool {
+	for _, switchPattern := range c.config.SwitchPatterns {
+		if switchPattern == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// discoSocketPrologue returns the prologue of a DiscoSocket handshake: the
+// start string followed by each field preceded by its 2-byte length, and
+// followed by the prologue of the Conn
+func (c *Conn) discoSocketPrologue(start string, fields ...[]byte) []byte {
+	prologue := []byte(start)
+	for _, field := range fields {
+		prologue = appendField(prologue, field)
+	}
+	return append(prologue, c.prologue()...)
+}
+
+// appendField appends a field preceded by its 2-byte length to b
+func appendField(b, field []byte) []byte {
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(field)))
+	return append(append(b, length...), field...)
+}
+
+// discoSocketBody returns the payload of a message in the DiscoSocket format:
+// the body preceded by its 2-byte length, and followed by zeros so that the
+// payload's length is a multiple of padding (within the limits of a message)
+func discoSocketBody(body []byte, padding int) []byte {
+	length := 2 + len(body)
+	if padding > 0 && length%padding != 0 {
+		length += padding - length%padding
+		if length > NoiseMaxPlaintextSize {
+			length = NoiseMaxPlaintextSize
+		}
+	}
+	payload := make([]byte, length)
+	binary.BigEndian.PutUint16(payload, uint16(len(body)))
+	copy(payload[2:], body)
+	return payload
+}
+
+// parseDiscoSocketBody returns the body of a payload in the DiscoSocket format
+func parseDiscoSocketBody(payload []byte) ([]byte, error) {
+	if len(payload) < 2 {
+		return nil, newError(ErrMalformedMessage, "disco: the received payload is too short")
+	}
+	length := int(binary.BigEndian.Uint16(payload))
+	if length > len(payload)-2 {
+		return nil, newError(ErrMalformedMessage, "disco: the received payload is shorter than its length")
+	}
+	return payload[2 : 2+length], nil
+}
@@ -0,0 +1,253 @@
+package libdisco
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// connPair runs the handshake between a client and a server over a pipe
+func connPair(clientConfig, serverConfig *Config) (client, server *Conn, clientErr, serverErr error) {
+	clientSocket, serverSocket := net.Pipe()
+	client = Client(clientSocket, clientConfig)
+	server = Server(serverSocket, serverConfig)
+	serverDone := make(chan error, 1)
+	go func() {
+		err := server.Handshake()
+		if err != nil {
+			serverSocket.Close()
+		}
+		serverDone <- err
+	}()
+	clientErr = client.Handshake()
+	if clientErr != nil {
+		clientSocket.Close()
+	}
+	serverErr = <-serverDone
+	return
+}
+
+func TestDiscoSocket(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseXX)
+	for _, config := range []*Config{clientConfig, serverConfig} {
+		config.DiscoSocket = true
+		config.Padding = 64
+		config.HandshakePayload = func(messageIndex int) []byte { return []byte{byte(messageIndex)} }
+	}
+	var received []byte
+	serverConfig.HandshakePayloadReceived = func(messageIndex int, payload []byte) error {
+		received = append(received, payload...)
+		return nil
+	}
+
+	client, server, clientErr, serverErr := connPair(clientConfig, serverConfig)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal("the handshake failed", clientErr, serverErr)
+	}
+	defer client.Close()
+	if !bytes.Equal(received, []byte{0, 2}) {
+		t.Fatal("handshake payloads not received as expected", received)
+	}
+	if state := server.ConnectionState(); state.ProtocolName != "Noise_XX_25519_STROBEv1.0.2" {
+		t.Fatal("unexpected protocol name", state.ProtocolName)
+	}
+
+	go func() {
+		buf := make([]byte, 100)
+		n, _ := server.Read(buf)
+		server.Write(buf[:n])
+	}()
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal("client can't write", err)
+	}
+	buf := make([]byte, 100)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatal("client can't read", err)
+	}
+}
+
+// TestDiscoSocketTranscript runs a DiscoSocket server against a client that
+// builds its messages with the message-level API, following the format
+// documented in discosocket.go, so that the wire format does not change
+func TestDiscoSocketTranscript(t *testing.T) {
+	_, serverConfig := configsForPattern(NoiseNX)
+	serverConfig.DiscoSocket = true
+	serverConfig.Padding = 32
+	serverConfig.HandshakePayload = func(messageIndex int) []byte { return []byte("server") }
+	var received []byte
+	serverConfig.HandshakePayloadReceived = func(messageIndex int, payload []byte) error {
+		received = payload
+		return nil
+	}
+	clientSocket, serverSocket := net.Pipe()
+	server := Server(serverSocket, serverConfig)
+	defer server.Close()
+	defer clientSocket.Close()
+	go func() {
+		buf := make([]byte, 100)
+		if n, err := server.Read(buf); err == nil {
+			server.Write(append(buf[:n:n], " pong"...))
+		}
+	}()
+
+	// field returns b preceded by its 2-byte length
+	field := func(b []byte) []byte {
+		return append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)
+	}
+	// readField reads a field preceded by its 2-byte length
+	readField := func() []byte {
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(clientSocket, length); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(clientSocket, b); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	// body returns the body of a payload, and checks its padding
+	body := func(payload []byte) []byte {
+		if len(payload)%32 != 0 {
+			t.Fatal("the payload is not padded", len(payload))
+		}
+		return payload[2 : 2+binary.BigEndian.Uint16(payload)]
+	}
+
+	// -> negotiation data, e
+	negotiationData := []byte("Noise_NX_25519_STROBEv1.0.2")
+	prologue := append(append([]byte("DiscoSocketInit"), field(negotiationData)...), "DiscoPayload1"...)
+	client, err := Initialize(NoiseNX, true, prologue, nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message []byte
+	// an empty server name followed by the application's payload
+	if _, _, err := client.WriteMessage(field(append(field(nil), "client"...)), &message); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientSocket.Write(append(field(negotiationData), field(message)...)); err != nil {
+		t.Fatal(err)
+	}
+
+	// <- empty negotiation data, e, ee, s, es
+	if negotiationData := readField(); len(negotiationData) != 0 {
+		t.Fatal("the server should accept the handshake", negotiationData)
+	}
+	var payload []byte
+	c1, c2, err := client.ReadMessage(readField(), &payload)
+	if err != nil || c1 == nil {
+		t.Fatal("the handshake failed", err)
+	}
+	if string(received) != "client" {
+		t.Fatal("the server did not receive the client's payload", received)
+	}
+	// the proof of the server's key followed by the application's payload
+	expected := append(field(serverConfig.StaticPublicKeyProof), "server"...)
+	if !bytes.Equal(body(payload), expected) {
+		t.Fatal("unexpected handshake payload", body(payload))
+	}
+
+	// transport messages carry records: a type byte followed by the data
+	if _, err := clientSocket.Write(field(c1.Encrypt(field(append([]byte{recordTypeData}, "ping"...))))); err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := c2.Decrypt(readField())
+	if err != nil {
+		t.Fatal("cannot decrypt the server's message", err)
+	}
+	if record := body(plaintext); string(record) != "\x00ping pong" {
+		t.Fatal("unexpected record", record)
+	}
+}
+
+func TestDiscoSocketSwitch(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseXX)
+	for _, config := range []*Config{clientConfig, serverConfig} {
+		config.DiscoSocket = true
+	}
+	serverConfig.Negotiate = func(negotiationData []byte) Negotiation {
+		if string(negotiationData) != "Noise_XX_25519_STROBEv1.0.2" {
+			t.Error("unexpected negotiation data", string(negotiationData))
+		}
+		return Negotiation{Switch: NoiseNX}
+	}
+
+	// the client does not accept to switch
+	if _, _, clientErr, _ := connPair(clientConfig, serverConfig); !errors.Is(clientErr, ErrUnknownPattern) {
+		t.Fatal("expected ErrUnknownPattern", clientErr)
+	}
+
+	clientConfig.SwitchPatterns = []noiseHandshakeType{NoiseNX}
+	client, server, clientErr, serverErr := connPair(clientConfig, serverConfig)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal("the handshake failed", clientErr, serverErr)
+	}
+	defer client.Close()
+	if client.ConnectionState().HandshakePattern != NoiseNX || server.ConnectionState().HandshakePattern != NoiseNX {
+		t.Fatal("the peers should have switched to NX")
+	}
+	if clientConfig.HandshakePattern != NoiseXX || serverConfig.HandshakePattern != NoiseXX {
+		t.Fatal("the configurations should not be modified")
+	}
+	clientBinding, _ := client.ChannelBinding()
+	serverBinding, _ := server.ChannelBinding()
+	if !bytes.Equal(clientBinding, serverBinding) {
+		t.Fatal("client and server channel bindings do not match")
+	}
+}
+
+func TestDiscoSocketReject(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseNK)
+	for _, config := range []*Config{clientConfig, serverConfig} {
+		config.DiscoSocket = true
+	}
+	clientConfig.NegotiationData = []byte("Noise_NK_25519_STROBEv2.0.0")
+
+	_, _, clientErr, serverErr := connPair(clientConfig, serverConfig)
+	if !errors.Is(clientErr, ErrRejected) || !errors.Is(serverErr, ErrRejected) {
+		t.Fatal("expected ErrRejected", clientErr, serverErr)
+	}
+
+	// the default negotiation data is the protocol name
+	clientConfig.NegotiationData = nil
+	client, _, clientErr, serverErr := connPair(clientConfig, serverConfig)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal("the handshake failed", clientErr, serverErr)
+	}
+	client.Close()
+
+	clientConfig.NoisePipes = true
+	if err := checkRequirements(true, clientConfig); err == nil {
+		t.Fatal("DiscoSocket should not be usable with Noise Pipes")
+	}
+}
+
+func TestDiscoSocketBody(t *testing.T) {
+	for _, test := range []struct {
+		body    []byte
+		padding int
+		length  int
+	}{
+		{nil, 0, 2}, {[]byte("hello"), 0, 7}, {[]byte("hello"), 16, 16}, {make([]byte, 14), 16, 16},
+		{make([]byte, 15), 16, 32}, {make([]byte, NoiseMaxPlaintextSize-2), 1000, NoiseMaxPlaintextSize},
+	} {
+		payload := discoSocketBody(test.body, test.padding)
+		if len(payload) != test.length {
+			t.Fatal("unexpected padded length", len(payload), test.length)
+		}
+		body, err := parseDiscoSocketBody(payload)
+		if err != nil || !bytes.Equal(body, test.body) {
+			t.Fatal("cannot parse the payload", err)
+		}
+	}
+	for _, payload := range [][]byte{nil, {0}, {0, 2, 1}} {
+		if _, err := parseDiscoSocketBody(payload); !errors.Is(err, ErrMalformedMessage) {
+			t.Fatal("expected ErrMalformedMessage", err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package libdisco
+
+import (
+	"errors"
+	"strconv"
+)
+
+// The following errors can be returned by this package. The returned error
+// usually carries a more detailed message, use errors.Is to match it.
+var (
+	// ErrNoConfig is returned when a nil Config is passed
+	ErrNoConfig = errors.New("disco: no Config set")
+	// ErrNoVerifier is returned when the handshake pattern requires a PublicKeyVerifier (or VerifyPublicKey)
+	ErrNoVerifier = errors.New("disco: no public key verifier set in Config")
+	// ErrNoProof is returned when the handshake pattern requires a StaticPublicKeyProof
+	ErrNoProof = errors.New("disco: no public key proof set in Config")
+	// ErrInvalidPSK is returned when the handshake pattern requires a 32-byte pre-shared key
+	ErrInvalidPSK = errors.New("disco: a 32-byte pre-shared key is required by the handshake pattern")
+	// ErrInvalidKey is returned when a key is missing or of the wrong size
+	ErrInvalidKey = errors.New("disco: invalid key")
+	// ErrUnknownPattern is returned for handshake patterns or modifiers that are not supported
+	ErrUnknownPattern = errors.New("disco: the supplied handshakePattern does not exist")
+	// ErrUnknownCipherSuite is returned for cipher suites that are not supported
+	ErrUnknownCipherSuite = errors.New("disco: the cipher suite is not supported")
+	// ErrAuthFailed is returned when the remote peer's static key could not be authenticated
+	ErrAuthFailed = errors.New("disco: the received public key could not be authenticated")
+	// ErrDecrypt is returned when a message cannot be decrypted, either because
+	// it was modified or because the peers do not share the same keys
+	ErrDecrypt = errors.New("disco: cannot decrypt the payload")
+	// ErrMessageTooLarge is returned when a message exceeds the maximum size
+	// allowed by the transport (see NoiseMessageLength and MaxDatagramPayloadSize)
+	ErrMessageTooLarge = errors.New("disco: message exceeds the maximum size")
+	// ErrMalformedMessage is returned when a message received from the peer cannot be parsed
+	ErrMalformedMessage = errors.New("disco: malformed message")
+	// ErrOneWay is returned when trying to write as a server, or to read as a
+	// client, on a one-way handshake pattern (N, K or X)
+	ErrOneWay = errors.New("disco: one-way patterns only allow the client to write")
+	// ErrHandshakeIncomplete is returned when information about the handshake
+	// is requested before its completion
+	ErrHandshakeIncomplete = errors.New("disco: handshake not completed")
+	// ErrTruncated is returned by Read when the connection ends without the
+	// peer having sent a close notification, which might be the sign of an attacker
+	// cutting the connection
+	ErrTruncated = errors.New("disco: the connection was closed without a close notification")
+	// ErrShutdown is returned when writing on a connection after Close or CloseWrite
+	ErrShutdown = errors.New("disco: the connection is shut down for writing")
+	// ErrRejected is returned by a DiscoSocket peer when the server rejected the
+	// client during the negotiation
+	ErrRejected = errors.New("disco: the connection was rejected during the negotiation")
+	// ErrMalformedState is returned by RecoverState when the serialized handshake state is invalid
+	ErrMalformedState = errors.New("disco: the serialized handshake state is malformed")
+	// ErrInvalidCertificate is returned when a certificate or a chain of
+	// certificates is malformed, or does not authenticate a public key
+	ErrInvalidCertificate = errors.New("disco: invalid certificate")
+	// ErrCertificateExpired is returned when a certificate is not valid at the current time
+	ErrCertificateExpired = errors.New("disco: the certificate is expired or not yet valid")
+	// ErrInvalidRevocationList is returned when a revocation list is malformed,
+	// not signed by the root key, or older than the current one
+	ErrInvalidRevocationList = errors.New("disco: invalid revocation list")
+	// ErrKeyRevoked is returned when the remote peer's static key is in the
+	// revocation list (see CreatePublicKeyVerifierWithRevocation)
+	ErrKeyRevoked = errors.New("disco: the static public key is revoked")
+	// ErrHostKeyMismatch is returned when a known host presents a static key
+	// different from the one pinned on first use (see KnownHosts)
+	ErrHostKeyMismatch = errors.New("disco: the static key of the host does not match the known key")
+)
+
+// AlertCode is the reason carried by an alert record, sent to the peer
+// when a connection fails (see Conn.SendAlert)
+type AlertCode uint8
+
+// The following alert codes are used by this package,
+// applications are free to use their own codes starting at AlertApplication.
+const (
+	// AlertInternalError is sent when the connection fails for a reason unrelated to the peer
+	AlertInternalError AlertCode = iota + 1
+	// AlertAuthFailed is sent when the peer's static key could not be authenticated
+	AlertAuthFailed
+	// AlertDecryptError is sent when a message from the peer could not be decrypted
+	AlertDecryptError
+	// AlertUnexpectedMessage is sent when a message from the peer could not be parsed
+	AlertUnexpectedMessage
+	// AlertApplication is the first alert code available to applications
+	AlertApplication AlertCode = 128
+)
+
+var alertCodeNames = map[AlertCode]string{
+	AlertInternalError:     "internal error",
+	AlertAuthFailed:        "authentication failed",
+	AlertDecryptError:      "decrypt error",
+	AlertUnexpectedMessage: "unexpected message",
+}
+
+// String returns a description of the alert code.
+func (code AlertCode) String() string {
+	if name, ok := alertCodeNames[code]; ok {
+		return name
+	}
+	return "alert(" + strconv.Itoa(int(code)) + ")"
+}
+
+// AlertError is returned by Read when the peer sent an alert. The
+// connection cannot be read from afterwards.
+type AlertError struct {
+	Code        AlertCode
+	Description string
+}
+
+func (e *AlertError) Error() string {
+	if e.Description == "" {
+		return "disco: received alert: " + e.Code.String()
+	}
+	return "disco: received alert: " + e.Code.String() + ": " + e.Description
+}
+
+// discoError is an error with a detailed message that matches one of the errors above
+type discoError struct {
+	err error
+	msg string
+}
+
+func (e *discoError) Error() string { return e.msg }
+func (e *discoError) Unwrap() error { return e.err }
+
+// newError returns an error with the message msg that matches err with errors.Is
+func newError(err error, msg string) error {
+	return &discoError{err: err, msg: msg}
+}
@@ -0,0 +1,140 @@
+package libdisco
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConfigErrors(t *testing.T) {
+	if _, err := Listen("tcp", "127.0.0.1:0", nil); !errors.Is(err, ErrNoConfig) {
+		t.Fatal("expected ErrNoConfig", err)
+	}
+	if _, err := Dial("tcp", "127.0.0.1:0", nil); !errors.Is(err, ErrNoConfig) {
+		t.Fatal("expected ErrNoConfig", err)
+	}
+	if _, err := ListenDisco("tcp", "127.0.0.1:0", &Config{HandshakePattern: NoiseXX, StaticPublicKeyProof: []byte{}}); !errors.Is(err, ErrNoVerifier) {
+		t.Fatal("expected ErrNoVerifier", err)
+	}
+	if _, err := Dial("tcp", "127.0.0.1:0", &Config{HandshakePattern: NoiseXX, PublicKeyVerifier: verifier}); !errors.Is(err, ErrNoProof) {
+		t.Fatal("expected ErrNoProof", err)
+	}
+	if _, err := Dial("tcp", "127.0.0.1:0", &Config{HandshakePattern: NoiseNNpsk2}); !errors.Is(err, ErrInvalidPSK) {
+		t.Fatal("expected ErrInvalidPSK", err)
+	}
+	if _, err := Dial("tcp", "127.0.0.1:0", &Config{HandshakePattern: noiseHandshakeType(0xff)}); !errors.Is(err, ErrUnknownPattern) {
+		t.Fatal("expected ErrUnknownPattern", err)
+	}
+	if _, err := parseHandshakePattern("XXpsk9"); !errors.Is(err, ErrUnknownPattern) {
+		t.Fatal("expected ErrUnknownPattern", err)
+	}
+}
+
+func TestOneWayErrors(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseN)
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	server := Server(serverConn, serverConfig)
+	client := Client(clientConn, clientConfig)
+
+	if _, err := server.Write([]byte("hello")); !errors.Is(err, ErrOneWay) {
+		t.Fatal("expected ErrOneWay", err)
+	}
+	if err := server.Rekey(); !errors.Is(err, ErrOneWay) {
+		t.Fatal("expected ErrOneWay", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatal("handshake failed", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal("handshake failed", err)
+	}
+	if _, err := client.Read(make([]byte, 10)); !errors.Is(err, ErrOneWay) {
+		t.Fatal("expected ErrOneWay", err)
+	}
+	if err := server.SendAlert(AlertApplication, ""); !errors.Is(err, ErrOneWay) {
+		t.Fatal("expected ErrOneWay", err)
+	}
+}
+
+func TestAuthFailed(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseXX)
+	clientConfig.PublicKeyVerifier = func([]byte, []byte) bool { return false }
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	server := Server(serverConn, serverConfig)
+	client := Client(clientConn, clientConfig)
+
+	// the server learns why the connection failed
+	serverErr := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 10))
+		serverErr <- err
+	}()
+	if err := client.Handshake(); !errors.Is(err, ErrAuthFailed) {
+		t.Fatal("expected ErrAuthFailed", err)
+	}
+	clientConn.Close()
+	var alert *AlertError
+	if err := <-serverErr; !errors.As(err, &alert) || alert.Code != AlertAuthFailed {
+		t.Fatal("expected an AlertAuthFailed alert", err)
+	}
+
+	// the error is not delayed by a server that does not read the alert
+	clientConfig, serverConfig = configsForPattern(NoiseNX)
+	clientConfig.PublicKeyVerifier = func([]byte, []byte) bool { return false }
+	start := time.Now()
+	if _, _, clientErr, _ := connPair(clientConfig, serverConfig); !errors.Is(clientErr, ErrAuthFailed) {
+		t.Fatal("expected ErrAuthFailed", clientErr)
+	}
+	if time.Since(start) >= closeNotifyTimeout {
+		t.Fatal("the handshake waited for the alert to be read")
+	}
+}
+
+func TestRecoverStateErrors(t *testing.T) {
+	s := GenerateKeypair(nil)
+	hs, err := Initialize(NoiseXX, true, nil, s, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal("cannot initialize", err)
+	}
+	serialized := hs.Serialize()
+
+	if _, err := RecoverState(serialized, nil, GenerateKeypair(nil)); !errors.Is(err, ErrInvalidKey) {
+		t.Fatal("expected ErrInvalidKey", err)
+	}
+	for _, malformed := range [][]byte{
+		nil,
+		serialized[:40],
+		serialized[:200],
+		serialized[:len(serialized)-1],
+	} {
+		if _, err := RecoverState(malformed, nil, s); !errors.Is(err, ErrMalformedState) {
+			t.Fatal("expected ErrMalformedState", err)
+		}
+	}
+	// the position in the Strobe buffer is out of bounds
+	corrupted := append([]byte{}, serialized...)
+	corrupted[len(corrupted)-201] = 0xff
+	if _, err := RecoverState(corrupted, nil, s); !errors.Is(err, ErrMalformedState) {
+		t.Fatal("expected ErrMalformedState", err)
+	}
+
+	if _, err := RecoverState(serialized, nil, s); err != nil {
+		t.Fatal("cannot recover the serialized state", err)
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	var cs CipherState
+	if _, err := cs.Decrypt([]byte("short")); !errors.Is(err, ErrDecrypt) {
+		t.Fatal("expected ErrDecrypt", err)
+	}
+}
@@ -39,8 +39,8 @@ func main() {
 	if len(os.Args) == 3 && os.Args[1] == "sign" {
 		// what do we sign?
 		toSign, err := hex.DecodeString(os.Args[2])
-		if err != nil || len(toSign) != 32 {
-			fmt.Println("public key passed is not a 32-byte value in hexadecimal (", len(toSign), ")")
+		if err != nil {
+			fmt.Println("public key passed is not in hexadecimal")
 			return
 		}
 
@@ -52,7 +52,11 @@ func main() {
 		}
 
 		// create proof
-		proof := libdisco.CreateStaticPublicKeyProof(privkey, toSign)
+		proof, err := libdisco.CreateStaticPublicKeyProof(privkey, toSign)
+		if err != nil {
+			fmt.Println("couldn't create the proof:", err)
+			return
+		}
 
 		// display the proof
 		fmt.Println("proof successfuly created:")
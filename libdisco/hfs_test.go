@@ -0,0 +1,35 @@
+//go:build go1.26
+
+package libdisco
+
+import (
+	"crypto/mlkem"
+	"crypto/mlkem/mlkemtest"
+	"testing"
+)
+
+// the vectors need a derandomized ML-KEM encapsulation, only available since Go 1.26
+
+func TestHFSVectors(t *testing.T) {
+	vectors := readNoiseVectors(t, "testdata/hfs_vectors.txt")
+	if len(vectors) == 0 {
+		t.Fatal("no test vectors found")
+	}
+	defer func(generate func() (*mlkem.DecapsulationKey768, error), encapsulate func(*mlkem.EncapsulationKey768) ([]byte, []byte)) {
+		generateKEMKey, encapsulateKEM = generate, encapsulate
+	}(generateKEMKey, encapsulateKEM)
+
+	for _, vector := range vectors {
+		generateKEMKey = func() (*mlkem.DecapsulationKey768, error) {
+			return mlkem.NewDecapsulationKey768(vector.kemSeed)
+		}
+		encapsulateKEM = func(encapsulationKey *mlkem.EncapsulationKey768) (sharedKey, ciphertext []byte) {
+			sharedKey, ciphertext, err := mlkemtest.Encapsulate768(encapsulationKey, vector.kemRandom)
+			if err != nil {
+				t.Fatal(vector.protocolName, err)
+			}
+			return sharedKey, ciphertext
+		}
+		testNoiseVector(t, vector)
+	}
+}
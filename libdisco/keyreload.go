@@ -0,0 +1,104 @@
+package libdisco
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// KeyPairReloader holds a key pair loaded from a file with LoadDiscoKeyPair,
+// along with its proof, and reloads them on demand. Its GetKeyPair method can
+// be used as Config.GetKeyPair to rotate the static key of a listener without
+// restarting it.
+type KeyPairReloader struct {
+	dh                                 DHFunction
+	keyPairFile, passphrase, proofFile string
+
+	lock    sync.RWMutex
+	keyPair *KeyPair
+	proof   []byte
+}
+
+// NewKeyPairReloader loads a key pair from keyPairFile (see LoadDiscoKeyPair)
+// and a proof, in hexadecimal form, from proofFile. proofFile can be empty if
+// no proof is needed.
+func NewKeyPairReloader(keyPairFile, passphrase, proofFile string) (*KeyPairReloader, error) {
+	return NewKeyPairReloaderWithDH(DH25519, keyPairFile, passphrase, proofFile)
+}
+
+// NewKeyPairReloaderWithDH works like NewKeyPairReloader for key pairs of the
+// DH function dh (see LoadDiscoKeyPairWithDH).
+func NewKeyPairReloaderWithDH(dh DHFunction, keyPairFile, passphrase, proofFile string) (*KeyPairReloader, error) {
+	reloader := &KeyPairReloader{dh: dh, keyPairFile: keyPairFile, passphrase: passphrase, proofFile: proofFile}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Reload reads the key pair and the proof from their files again. If they
+// cannot be read, the current ones are kept and an error is returned.
+func (r *KeyPairReloader) Reload() error {
+	keyPair, err := LoadDiscoKeyPairWithDH(r.dh, r.keyPairFile, r.passphrase)
+	if err != nil {
+		return err
+	}
+	var proof []byte
+	if r.proofFile != "" {
+		hexProof, err := ioutil.ReadFile(r.proofFile)
+		if err != nil {
+			return err
+		}
+		if proof, err = hex.DecodeString(string(bytes.TrimSpace(hexProof))); err != nil {
+			return err
+		}
+	}
+
+	r.lock.Lock()
+	r.keyPair, r.proof = keyPair, proof
+	r.lock.Unlock()
+	return nil
+}
+
+// GetKeyPair returns the key pair and the proof that were last loaded.
+func (r *KeyPairReloader) GetKeyPair() (*KeyPair, []byte, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.keyPair, r.proof, nil
+}
+
+// ReloadOnSignal reloads the key pair and the proof every time one of the
+// signals is received by the process (for example syscall.SIGHUP), until
+// stop is called. Errors are ignored and the current key pair is then kept,
+// call Reload directly to handle them.
+func (r *KeyPairReloader) ReloadOnSignal(signals ...os.Signal) (stop func()) {
+	return reloadOnSignal(r.Reload, signals...)
+}
+
+// reloadOnSignal calls reload every time one of the signals is received by the
+// process, until stop is called
+func reloadOnSignal(reload func() error, signals ...os.Signal) (stop func()) {
+	received := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(received, signals...)
+	go func() {
+		for {
+			select {
+			case <-received:
+				reload()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(received)
+			close(done)
+		})
+	}
+}
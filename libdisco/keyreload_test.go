@@ -0,0 +1,194 @@
+package libdisco
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// rotateKeyPair saves a new key pair and its proof in the files
+func rotateKeyPair(t *testing.T, keyPairFile, proofFile string) *KeyPair {
+	// the key pair file is read-only, replace it
+	tempFile := keyPairFile + ".new"
+	keyPair, err := GenerateAndSaveDiscoKeyPair(tempFile, "")
+	if err != nil {
+		t.Fatal("cannot save the key pair", err)
+	}
+	if err := os.Rename(tempFile, keyPairFile); err != nil {
+		t.Fatal(err)
+	}
+	proof := createProof(keyPair.PublicKey[:])
+	if err := ioutil.WriteFile(proofFile, []byte(hex.EncodeToString(proof)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return keyPair
+}
+
+func TestKeyPairReloader(t *testing.T) {
+	dir := t.TempDir()
+	keyPairFile := filepath.Join(dir, "keyPair")
+	proofFile := filepath.Join(dir, "proof")
+	firstKeyPair := rotateKeyPair(t, keyPairFile, proofFile)
+
+	reloader, err := NewKeyPairReloader(keyPairFile, "", proofFile)
+	if err != nil {
+		t.Fatal("cannot load the key pair", err)
+	}
+	clientConfig, serverConfig := configsForPattern(NoiseNX)
+	serverConfig.KeyPair = nil
+	serverConfig.StaticPublicKeyProof = nil
+	serverConfig.GetKeyPair = reloader.GetKeyPair
+
+	listener, err := Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			serverConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer serverConn.Close()
+				buf := make([]byte, 100)
+				for {
+					n, err := serverConn.Read(buf)
+					if err != nil {
+						return
+					}
+					serverConn.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+
+	// remoteKey connects to the listener and returns the key of the server
+	remoteKey := func() []byte {
+		clientConn, err := dialConn(listener.Addr().String(), clientConfig)
+		if err != nil {
+			t.Fatal("client can't connect to server", err)
+		}
+		defer clientConn.Close()
+		return clientConn.ConnectionState().RemotePublicKey
+	}
+	if !bytes.Equal(remoteKey(), firstKeyPair.PublicKey[:]) {
+		t.Fatal("the server should use the key pair loaded")
+	}
+	established, err := dialConn(listener.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal("client can't connect to server", err)
+	}
+	defer established.Close()
+
+	// rotate the key
+	secondKeyPair := rotateKeyPair(t, keyPairFile, proofFile)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal("cannot reload the key pair", err)
+	}
+	if !bytes.Equal(remoteKey(), secondKeyPair.PublicKey[:]) {
+		t.Fatal("the server should use the new key pair")
+	}
+	// connections established before are not affected
+	buf := make([]byte, 5)
+	if _, err := established.Write([]byte("hello")); err != nil {
+		t.Fatal("client can't write", err)
+	}
+	if _, err := established.Read(buf); err != nil || string(buf) != "hello" {
+		t.Fatal("client can't read", err)
+	}
+
+	// a key pair that cannot be loaded is not used
+	if err := ioutil.WriteFile(proofFile, []byte("not hexadecimal"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Fatal("a malformed proof should not be loaded")
+	}
+	if keyPair, _, _ := reloader.GetKeyPair(); !bytes.Equal(keyPair.PublicKey, secondKeyPair.PublicKey) {
+		t.Fatal("the previous key pair should be kept")
+	}
+
+	// reload on signal
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := reloader.ReloadOnSignal(syscall.SIGHUP)
+	defer stop()
+	thirdKeyPair := rotateKeyPair(t, keyPairFile, proofFile)
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		t.Skip("cannot send signals on this platform")
+	}
+	for i := 0; ; i++ {
+		if keyPair, _, _ := reloader.GetKeyPair(); bytes.Equal(keyPair.PublicKey, thirdKeyPair.PublicKey) {
+			break
+		}
+		if i == 100 {
+			t.Fatal("the key pair was not reloaded on signal")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGetKeyPairConcurrentUse(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseNX)
+	keyPair, proof := serverConfig.KeyPair, serverConfig.StaticPublicKeyProof
+	serverConfig.KeyPair = nil
+	serverConfig.StaticPublicKeyProof = nil
+	serverConfig.GetKeyPair = func() (*KeyPair, []byte, error) { return keyPair, proof, nil }
+
+	serverConn, clientConn := net.Pipe()
+	server := Server(serverConn, serverConfig)
+	client := Client(clientConn, clientConfig)
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	// the handshake is started by whichever call of the server comes first
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		if _, err := server.Write([]byte("hello")); err != nil {
+			t.Error("server can't write", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "world" {
+			t.Error("server can't read", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		server.RemoteAddr()
+	}()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("client can't read", err)
+	}
+	if _, err := client.Write([]byte("world")); err != nil {
+		t.Fatal("client can't write", err)
+	}
+	wg.Wait()
+}
+
+// dialConn dials addr over TCP and returns the Disco connection
+func dialConn(addr string, config *Config) (*Conn, error) {
+	conn, err := Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*Conn), nil
+}
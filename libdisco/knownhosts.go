@@ -0,0 +1,127 @@
+package libdisco
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//
+// Known hosts
+//
+
+// Without a root key, a client can trust the static key of a server on first
+// use: the first connection to a host pins the key the server presented, and
+// later connections to that host must present the same key.
+
+// KnownHosts is a file-backed store of the static keys of known hosts, one
+// "host hexadecimal-key" line per host, in the spirit of SSH's known_hosts
+// file. Lines starting with # are ignored.
+//
+// It is safe for concurrent use, including by several processes sharing the
+// same file: new hosts are appended with a single write, and if two
+// processes pin different keys for the same host the first line wins.
+type KnownHosts struct {
+	file string
+	lock sync.Mutex
+}
+
+// NewKnownHosts returns a store backed by file, which is created on the first
+// connection to a host if it does not exist.
+func NewKnownHosts(file string) *KnownHosts {
+	return &KnownHosts{file: file}
+}
+
+// Verifier returns a VerifyPublicKey callback (see Config) pinning the static
+// key of host, for example the address that is dialed. The proof sent by
+// the server is ignored.
+func (k *KnownHosts) Verifier(host string) func(publicKey, proof []byte) error {
+	return func(publicKey, _ []byte) error {
+		return k.Verify(host, publicKey)
+	}
+}
+
+// Verify returns nil if publicKey is the known key of host, or pins it if
+// host is not known yet. It returns an error matching ErrHostKeyMismatch if
+// host is known with another key.
+func (k *KnownHosts) Verify(host string, publicKey []byte) error {
+	if host == "" || strings.ContainsAny(host, " \t\r\n") || strings.HasPrefix(host, "#") {
+		return newError(ErrAuthFailed, "disco: the host "+strconv.Quote(host)+" cannot be stored in known_hosts")
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	knownKey, err := k.lookup(host)
+	if err != nil {
+		return err
+	}
+	if knownKey == nil {
+		// first use: pin the key, unless another process just pinned one
+		if err = k.appendHost(host, publicKey); err != nil {
+			return err
+		}
+		if knownKey, err = k.lookup(host); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(knownKey, publicKey) {
+		return newError(ErrHostKeyMismatch, "disco: the static key of "+strconv.Quote(host)+" does not match the key in "+k.file)
+	}
+	return nil
+}
+
+// Lookup returns the known key of host, or nil if host is not known.
+func (k *KnownHosts) Lookup(host string) ([]byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.lookup(host)
+}
+
+// lookup returns the key of the first line for host
+func (k *KnownHosts) lookup(host string) ([]byte, error) {
+	f, err := os.Open(k.file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") || fields[0] != host {
+			continue
+		}
+		if publicKey, err := hex.DecodeString(fields[1]); err == nil {
+			return publicKey, nil
+		}
+	}
+	return nil, scanner.Err()
+}
+
+// appendHost adds a line for host at the end of the file
+func (k *KnownHosts) appendHost(host string, publicKey []byte) error {
+	f, err := os.OpenFile(k.file, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	line := host + " " + hex.EncodeToString(publicKey) + "\n"
+	// do not extend a line left incomplete
+	last := make([]byte, 1)
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			line = "\n" + line
+		}
+	}
+	if _, err = f.Write([]byte(line)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,92 @@
+package libdisco
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestKnownHosts(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	knownHosts := NewKnownHosts(file)
+	clientConfig, serverConfig := configsForPattern(NoiseXX)
+	clientConfig.PublicKeyVerifier = nil
+	clientConfig.VerifyPublicKey = knownHosts.Verifier("server:1234")
+
+	// the first connection pins the key of the server
+	for i := 0; i < 2; i++ {
+		client, server, clientErr, serverErr := connPair(clientConfig, serverConfig)
+		if clientErr != nil || serverErr != nil {
+			t.Fatal("the handshake failed", clientErr, serverErr)
+		}
+		go func() {
+			// wait for the client to close the connection
+			server.Read(make([]byte, 1))
+		}()
+		client.Close()
+	}
+	if publicKey, err := knownHosts.Lookup("server:1234"); err != nil || !bytes.Equal(publicKey, serverConfig.KeyPair.PublicKey) {
+		t.Fatal("the key of the server should be pinned", err)
+	}
+
+	// another key for the same host is rejected
+	serverConfig.KeyPair = GenerateKeypair(nil)
+	serverConfig.StaticPublicKeyProof = createProof(serverConfig.KeyPair.PublicKey)
+	if _, _, clientErr, _ := connPair(clientConfig, serverConfig); !errors.Is(clientErr, ErrHostKeyMismatch) {
+		t.Fatal("expected ErrHostKeyMismatch", clientErr)
+	}
+	// unless the host is different
+	if err := knownHosts.Verify("other:1234", serverConfig.KeyPair.PublicKey); err != nil {
+		t.Fatal("a new host should be pinned", err)
+	}
+	if err := knownHosts.Verify("bad host", serverConfig.KeyPair.PublicKey); err == nil {
+		t.Fatal("hosts containing spaces cannot be stored")
+	}
+}
+
+func TestKnownHostsConcurrentWriters(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	// an incomplete line left by a previous writer
+	if err := ioutil.WriteFile(file, []byte("# comment\nbroken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// every store acts like a different process sharing the same file
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	accepted := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			knownHosts := NewKnownHosts(file)
+			if err := knownHosts.Verify("host"+strconv.Itoa(i), GenerateKeypair(nil).PublicKey); err != nil {
+				t.Error("a new host should be pinned", err)
+			}
+			// only one of the keys presented for the same host is pinned
+			err := knownHosts.Verify("shared", GenerateKeypair(nil).PublicKey)
+			if err != nil && !errors.Is(err, ErrHostKeyMismatch) {
+				t.Error("expected ErrHostKeyMismatch", err)
+			}
+			if err == nil {
+				lock.Lock()
+				accepted++
+				lock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if accepted != 1 {
+		t.Fatal("exactly one key should be pinned for the host, got", accepted)
+	}
+	knownHosts := NewKnownHosts(file)
+	for i := 0; i < 20; i++ {
+		if publicKey, err := knownHosts.Lookup("host" + strconv.Itoa(i)); err != nil || publicKey == nil {
+			t.Fatal("every host should be pinned", err)
+		}
+	}
+}
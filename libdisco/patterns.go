@@ -1,10 +1,17 @@
 package libdisco
 
+import (
+	"strconv"
+	"strings"
+)
+
 //
 // Handshake Patterns
 //
 
-type noiseHandshakeType int8
+// a noiseHandshakeType is made of a base pattern in its lowest byte,
+// and of a set of modifiers in the upper bits (see NoisePSK0)
+type noiseHandshakeType uint32
 
 const (
 	// NoiseUnknown is for specifying an unknown pattern
@@ -54,19 +61,258 @@ const (
 	NoiseIK
 	// NoiseIX Not documented
 	NoiseIX
-	// NoiseNNpsk2 Not documented
-	NoiseNNpsk2
 
-	// NoiseNN Not implemented
+	// NoiseNN is a pattern where neither the client nor the server
+	// are authenticated. It only protects against passive attackers.
 	NoiseNN
-	// NoiseKN Not implemented
+
+	// NoiseKN is a pattern where the server already knows the client
+	// static key, but the client does not authenticate the server.
 	NoiseKN
-	// NoiseXN Not implemented
+
+	// NoiseXN is a pattern where the client transmits its static key
+	// at the end of the handshake, but does not authenticate the server.
+	// It is the responsability of the server to validate the received key properly.
 	NoiseXN
-	// NoiseIN Not implemented
+
+	// NoiseIN is a pattern where the client immediately transmits its
+	// static key, but does not authenticate the server.
+	// It is the responsability of the server to validate the received key properly.
 	NoiseIN
+
+	// The following patterns are the deferred variants of the previous patterns.
+	// A "1" after the client (resp. server) letter indicates that the DH operations
+	// authenticating the client (resp. server) static key are delayed by one message.
+	// This improves identity hiding at the cost of delaying authentication.
+
+	// NoiseNK1 is the deferred variant of NoiseNK.
+	NoiseNK1
+	// NoiseNX1 is the deferred variant of NoiseNX.
+	NoiseNX1
+	// NoiseX1N is the deferred variant of NoiseXN.
+	NoiseX1N
+	// NoiseX1K is a deferred variant of NoiseXK.
+	NoiseX1K
+	// NoiseXK1 is a deferred variant of NoiseXK.
+	NoiseXK1
+	// NoiseX1K1 is a deferred variant of NoiseXK.
+	NoiseX1K1
+	// NoiseX1X is a deferred variant of NoiseXX.
+	NoiseX1X
+	// NoiseXX1 is a deferred variant of NoiseXX.
+	NoiseXX1
+	// NoiseX1X1 is a deferred variant of NoiseXX.
+	NoiseX1X1
+	// NoiseK1N is the deferred variant of NoiseKN.
+	NoiseK1N
+	// NoiseK1K is a deferred variant of NoiseKK.
+	NoiseK1K
+	// NoiseKK1 is a deferred variant of NoiseKK.
+	NoiseKK1
+	// NoiseK1K1 is a deferred variant of NoiseKK.
+	NoiseK1K1
+	// NoiseK1X is a deferred variant of NoiseKX.
+	NoiseK1X
+	// NoiseKX1 is a deferred variant of NoiseKX.
+	NoiseKX1
+	// NoiseK1X1 is a deferred variant of NoiseKX.
+	NoiseK1X1
+	// NoiseI1N is the deferred variant of NoiseIN.
+	NoiseI1N
+	// NoiseI1K is a deferred variant of NoiseIK.
+	NoiseI1K
+	// NoiseIK1 is a deferred variant of NoiseIK.
+	NoiseIK1
+	// NoiseI1K1 is a deferred variant of NoiseIK.
+	NoiseI1K1
+	// NoiseI1X is a deferred variant of NoiseIX.
+	NoiseI1X
+	// NoiseIX1 is a deferred variant of NoiseIX.
+	NoiseIX1
+	// NoiseI1X1 is a deferred variant of NoiseIX.
+	NoiseI1X1
+)
+
+// The following modifiers can be combined with any of the previous handshake
+// patterns via a bitwise OR. For example `NoiseXX | NoisePSK3` is the XXpsk3
+// pattern, and `NoiseNN | NoisePSK0 | NoisePSK2` is the NNpsk0+psk2 pattern.
+// A pskN modifier (N > 0) requires the pattern to have at least N messages.
+// Patterns using a psk modifier require a 32-byte Config.PreSharedKey.
+const (
+	// NoisePSK0 mixes the pre-shared key at the start of the first message
+	NoisePSK0 noiseHandshakeType = 1 << (8 + iota)
+	// NoisePSK1 mixes the pre-shared key at the end of the first message
+	NoisePSK1
+	// NoisePSK2 mixes the pre-shared key at the end of the second message
+	NoisePSK2
+	// NoisePSK3 mixes the pre-shared key at the end of the third message
+	NoisePSK3
+	// NoiseFallback converts the first message of the client into a pre-message
+	// that the server received through other means (for example a failed
+	// IK handshake, see Config.NoisePipes). The server then sends the first message.
+	// Only patterns where the first message contains nothing but public keys can be
+	// converted (for example `NoiseXX | NoiseFallback` is the XXfallback pattern).
+	NoiseFallback
+	// NoiseHFS adds a post-quantum ML-KEM-768 key exchange to the ephemeral
+	// Diffie-Hellman (Hybrid Forward Secrecy): the peer sending the first
+	// ephemeral key also sends an ML-KEM public key (the e1 token), and the
+	// other peer mixes an encapsulation to it along with the ee DH (the ekem1
+	// token). It can only be applied to patterns with an ee DH, and not with
+	// NoiseFallback (for example `NoiseXX | NoiseHFS` is the XXhfs pattern).
+	NoiseHFS
+)
+
+const (
+	basePatternMask    noiseHandshakeType = 0xff
+	pskModifiersMask                      = NoisePSK0 | NoisePSK1 | NoisePSK2 | NoisePSK3
+	maxPskModifier                        = 3
+	supportedModifiers                    = pskModifiersMask | NoiseFallback | NoiseHFS
 )
 
+// NoiseNNpsk2 is the NN pattern where both peers are authenticated by
+// a pre-shared key mixed at the end of the second message.
+const NoiseNNpsk2 = NoiseNN | NoisePSK2
+
+// The hybrid variants of the XX and IK patterns (see NoiseHFS).
+const (
+	NoiseXXhfs = NoiseXX | NoiseHFS
+	NoiseIKhfs = NoiseIK | NoiseHFS
+)
+
+// basePattern returns the handshake pattern without its modifiers
+func (ht noiseHandshakeType) basePattern() noiseHandshakeType {
+	return ht & basePatternMask
+}
+
+// hasPSK returns true if the handshake pattern makes use of a pre-shared key
+func (ht noiseHandshakeType) hasPSK() bool {
+	return ht&pskModifiersMask != 0
+}
+
+// isOneWay returns true if only the client can send data after the handshake
+func (ht noiseHandshakeType) isOneWay() bool {
+	base := ht.basePattern()
+	return base == NoiseN || base == NoiseK || base == NoiseX
+}
+
+// getPattern returns the handshake pattern corresponding to a noiseHandshakeType,
+// with all of its modifiers applied.
+func getPattern(handshakeType noiseHandshakeType) (handshakePattern, error) {
+	base, ok := patterns[handshakeType.basePattern()]
+	if !ok || handshakeType&^basePatternMask&^supportedModifiers != 0 {
+		return handshakePattern{}, ErrUnknownPattern
+	}
+
+	// copy the base pattern so that we do not modify the patterns table
+	pattern := handshakePattern{
+		name: base.name,
+		preMessagePatterns: []messagePattern{
+			append(messagePattern{}, base.preMessagePatterns[0]...),
+			append(messagePattern{}, base.preMessagePatterns[1]...),
+		},
+		messagePatterns: make([]messagePattern, len(base.messagePatterns)),
+	}
+	for idx, message := range base.messagePatterns {
+		pattern.messagePatterns[idx] = append(messagePattern{}, message...)
+	}
+	var modifiers []string
+
+	// apply the fallback modifier
+	if handshakeType&NoiseFallback != 0 {
+		if len(pattern.messagePatterns) < 2 || len(pattern.preMessagePatterns[0]) != 0 {
+			return handshakePattern{}, newError(ErrUnknownPattern, "disco: the fallback modifier cannot be applied to "+base.name)
+		}
+		for _, token := range pattern.messagePatterns[0] {
+			if token != token_e && token != token_s {
+				return handshakePattern{}, newError(ErrUnknownPattern, "disco: the fallback modifier cannot be applied to "+base.name)
+			}
+		}
+		pattern.preMessagePatterns[0] = pattern.messagePatterns[0]
+		pattern.messagePatterns = pattern.messagePatterns[1:]
+		pattern.fallback = true
+		modifiers = append(modifiers, "fallback")
+	}
+
+	// apply the hfs modifier
+	if handshakeType&NoiseHFS != 0 {
+		if pattern.fallback || !pattern.addHFSTokens() {
+			return handshakePattern{}, newError(ErrUnknownPattern, "disco: the hfs modifier cannot be applied to "+pattern.name)
+		}
+		pattern.hfs = true
+		modifiers = append(modifiers, "hfs")
+	}
+
+	// apply psk modifiers
+	for position := 0; position <= maxPskModifier; position++ {
+		if handshakeType&(NoisePSK0<<uint(position)) == 0 {
+			continue
+		}
+		if position == 0 {
+			pattern.messagePatterns[0] = append(messagePattern{token_psk}, pattern.messagePatterns[0]...)
+		} else {
+			if position > len(pattern.messagePatterns) {
+				return handshakePattern{}, newError(ErrUnknownPattern, "disco: the psk"+strconv.Itoa(position)+" modifier cannot be applied to a pattern of "+strconv.Itoa(len(pattern.messagePatterns))+" message(s)")
+			}
+			pattern.messagePatterns[position-1] = append(pattern.messagePatterns[position-1], token_psk)
+		}
+		modifiers = append(modifiers, "psk"+strconv.Itoa(position))
+	}
+	pattern.name += strings.Join(modifiers, "+")
+
+	return pattern, nil
+}
+
+// addHFSTokens adds the e1 token after the first e token and the DH tokens
+// following it, and the ekem1 token after the ee token. It returns false if
+// the pattern has no ee token.
+func (pattern *handshakePattern) addHFSTokens() bool {
+	e1Message := -1
+	for idx, message := range pattern.messagePatterns {
+		for position, token := range message {
+			switch {
+			case token == token_e && e1Message == -1:
+				// the ee token comes later, from the other peer
+				e1Message = idx
+				for position++; position < len(message); position++ {
+					if message[position] != token_es && message[position] != token_se &&
+						message[position] != token_ee && message[position] != token_ss {
+						break
+					}
+				}
+				pattern.messagePatterns[idx] = insertToken(message, position, token_e1)
+			case token == token_ee && e1Message != -1 && idx != e1Message:
+				pattern.messagePatterns[idx] = insertToken(message, position+1, token_ekem1)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// insertToken returns the message pattern with the token inserted at position
+func insertToken(message messagePattern, position int, token token) messagePattern {
+	inserted := append(messagePattern{}, message[:position]...)
+	inserted = append(inserted, token)
+	return append(inserted, message[position:]...)
+}
+
+// sendsStatic returns true if the initiator (or the responder) transmits
+// its static key as part of a handshake message
+func (pattern handshakePattern) sendsStatic(initiator bool) bool {
+	for idx, message := range pattern.messagePatterns {
+		// messages are sent in turns, starting with the initiator (except in fallback patterns)
+		if (idx%2 == 0) != pattern.fallback != initiator {
+			continue
+		}
+		for _, token := range message {
+			if token == token_s {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 type token uint8
 
 const (
@@ -78,6 +324,9 @@ const (
 	token_ss
 	token_ee
 	token_psk
+	// the ML-KEM public key and encapsulation of the hfs modifier
+	token_e1
+	token_ekem1
 )
 
 type messagePattern []token
@@ -86,6 +335,10 @@ type handshakePattern struct {
 	name               string
 	preMessagePatterns []messagePattern
 	messagePatterns    []messagePattern
+	// the first message is sent by the responder (see NoiseFallback)
+	fallback bool
+	// the pattern has the hfs modifier (see NoiseHFS)
+	hfs bool
 }
 
 // TODO: add more patterns
@@ -189,6 +442,78 @@ var patterns = map[noiseHandshakeType]handshakePattern{
 		},
 	},
 
+	/*
+		NN():
+		  -> e
+		  <- e, ee
+	*/
+	NoiseNN: handshakePattern{
+		name: "NN",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},           // →
+			messagePattern{token_e, token_ee}, // ←
+		},
+	},
+
+	/*
+		KN(s):
+		  -> s
+		  ...
+		  -> e
+		  <- e, ee, se
+	*/
+	NoiseKN: handshakePattern{
+		name: "KN",
+		preMessagePatterns: []messagePattern{
+			messagePattern{token_s}, // →
+			messagePattern{},        // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                     // →
+			messagePattern{token_e, token_ee, token_se}, // ←
+		},
+	},
+
+	/*
+		XN(s):
+		  -> e
+		  <- e, ee
+		  -> s, se
+	*/
+	NoiseXN: handshakePattern{
+		name: "XN",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},           // →
+			messagePattern{token_e, token_ee}, // ←
+			messagePattern{token_s, token_se}, // →
+		},
+	},
+
+	/*
+		IN(s):
+		  -> e, s
+		  <- e, ee, se
+	*/
+	NoiseIN: handshakePattern{
+		name: "IN",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_s},            // →
+			messagePattern{token_e, token_ee, token_se}, // ←
+		},
+	},
+
 	/*
 			KX(s, rs):
 		      -> s
@@ -262,20 +587,543 @@ var patterns = map[noiseHandshakeType]handshakePattern{
 		},
 	},
 
+	//
+	// 7.7. Deferred patterns
+	//
+
+	/*
+		NK1:
+		  <- s
+		  ...
+		  -> e
+		  <- e, ee, es
+	*/
+	NoiseNK1: handshakePattern{
+		name: "NK1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{},        // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                     // →
+			messagePattern{token_e, token_ee, token_es}, // ←
+		},
+	},
+
+	/*
+		NX1:
+		  -> e
+		  <- e, ee, s
+		  -> es
+	*/
+	NoiseNX1: handshakePattern{
+		name: "NX1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                    // →
+			messagePattern{token_e, token_ee, token_s}, // ←
+			messagePattern{token_es},                   // →
+		},
+	},
+
+	/*
+		X1N:
+		  -> e
+		  <- e, ee
+		  -> s
+		  <- se
+	*/
+	NoiseX1N: handshakePattern{
+		name: "X1N",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},           // →
+			messagePattern{token_e, token_ee}, // ←
+			messagePattern{token_s},           // →
+			messagePattern{token_se},          // ←
+		},
+	},
+
+	/*
+		X1K:
+		  <- s
+		  ...
+		  -> e, es
+		  <- e, ee
+		  -> s
+		  <- se
+	*/
+	NoiseX1K: handshakePattern{
+		name: "X1K",
+		preMessagePatterns: []messagePattern{
+			messagePattern{},        // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_es}, // →
+			messagePattern{token_e, token_ee}, // ←
+			messagePattern{token_s},           // →
+			messagePattern{token_se},          // ←
+		},
+	},
+
+	/*
+		XK1:
+		  <- s
+		  ...
+		  -> e
+		  <- e, ee, es
+		  -> s, se
+	*/
+	NoiseXK1: handshakePattern{
+		name: "XK1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{},        // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                     // →
+			messagePattern{token_e, token_ee, token_es}, // ←
+			messagePattern{token_s, token_se},           // →
+		},
+	},
+
+	/*
+		X1K1:
+		  <- s
+		  ...
+		  -> e
+		  <- e, ee, es
+		  -> s
+		  <- se
+	*/
+	NoiseX1K1: handshakePattern{
+		name: "X1K1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{},        // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                     // →
+			messagePattern{token_e, token_ee, token_es}, // ←
+			messagePattern{token_s},                     // →
+			messagePattern{token_se},                    // ←
+		},
+	},
+
+	/*
+		X1X:
+		  -> e
+		  <- e, ee, s, es
+		  -> s
+		  <- se
+	*/
+	NoiseX1X: handshakePattern{
+		name: "X1X",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                              // →
+			messagePattern{token_e, token_ee, token_s, token_es}, // ←
+			messagePattern{token_s},                              // →
+			messagePattern{token_se},                             // ←
+		},
+	},
+
+	/*
+		XX1:
+		  -> e
+		  <- e, ee, s
+		  -> es, s, se
+	*/
+	NoiseXX1: handshakePattern{
+		name: "XX1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                     // →
+			messagePattern{token_e, token_ee, token_s},  // ←
+			messagePattern{token_es, token_s, token_se}, // →
+		},
+	},
+
+	/*
+		X1X1:
+		  -> e
+		  <- e, ee, s
+		  -> es, s
+		  <- se
+	*/
+	NoiseX1X1: handshakePattern{
+		name: "X1X1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                    // →
+			messagePattern{token_e, token_ee, token_s}, // ←
+			messagePattern{token_es, token_s},          // →
+			messagePattern{token_se},                   // ←
+		},
+	},
+
+	/*
+		K1N:
+		  -> s
+		  ...
+		  -> e
+		  <- e, ee
+		  -> se
+	*/
+	NoiseK1N: handshakePattern{
+		name: "K1N",
+		preMessagePatterns: []messagePattern{
+			messagePattern{token_s}, // →
+			messagePattern{},        // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},           // →
+			messagePattern{token_e, token_ee}, // ←
+			messagePattern{token_se},          // →
+		},
+	},
+
+	/*
+		K1K:
+		  -> s
+		  <- s
+		  ...
+		  -> e, es
+		  <- e, ee
+		  -> se
+	*/
+	NoiseK1K: handshakePattern{
+		name: "K1K",
+		preMessagePatterns: []messagePattern{
+			messagePattern{token_s}, // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_es}, // →
+			messagePattern{token_e, token_ee}, // ←
+			messagePattern{token_se},          // →
+		},
+	},
+
+	/*
+		KK1:
+		  -> s
+		  <- s
+		  ...
+		  -> e
+		  <- e, ee, se, es
+	*/
+	NoiseKK1: handshakePattern{
+		name: "KK1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{token_s}, // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                               // →
+			messagePattern{token_e, token_ee, token_se, token_es}, // ←
+		},
+	},
+
+	/*
+		K1K1:
+		  -> s
+		  <- s
+		  ...
+		  -> e
+		  <- e, ee, es
+		  -> se
+	*/
+	NoiseK1K1: handshakePattern{
+		name: "K1K1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{token_s}, // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                     // →
+			messagePattern{token_e, token_ee, token_es}, // ←
+			messagePattern{token_se},                    // →
+		},
+	},
+
+	/*
+		K1X:
+		  -> s
+		  ...
+		  -> e
+		  <- e, ee, s, es
+		  -> se
+	*/
+	NoiseK1X: handshakePattern{
+		name: "K1X",
+		preMessagePatterns: []messagePattern{
+			messagePattern{token_s}, // →
+			messagePattern{},        // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                              // →
+			messagePattern{token_e, token_ee, token_s, token_es}, // ←
+			messagePattern{token_se},                             // →
+		},
+	},
+
+	/*
+		KX1:
+		  -> s
+		  ...
+		  -> e
+		  <- e, ee, se, s
+		  -> es
+	*/
+	NoiseKX1: handshakePattern{
+		name: "KX1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{token_s}, // →
+			messagePattern{},        // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                              // →
+			messagePattern{token_e, token_ee, token_se, token_s}, // ←
+			messagePattern{token_es},                             // →
+		},
+	},
+
 	/*
-		NNpsk2():
+		K1X1:
+		  -> s
+		  ...
 		  -> e
-		  <- e, ee, psk
+		  <- e, ee, s
+		  -> se, es
+	*/
+	NoiseK1X1: handshakePattern{
+		name: "K1X1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{token_s}, // →
+			messagePattern{},        // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e},                    // →
+			messagePattern{token_e, token_ee, token_s}, // ←
+			messagePattern{token_se, token_es},         // →
+		},
+	},
+
+	/*
+		I1N:
+		  -> e, s
+		  <- e, ee
+		  -> se
+	*/
+	NoiseI1N: handshakePattern{
+		name: "I1N",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_s},  // →
+			messagePattern{token_e, token_ee}, // ←
+			messagePattern{token_se},          // →
+		},
+	},
+
+	/*
+		I1K:
+		  <- s
+		  ...
+		  -> e, es, s
+		  <- e, ee
+		  -> se
+	*/
+	NoiseI1K: handshakePattern{
+		name: "I1K",
+		preMessagePatterns: []messagePattern{
+			messagePattern{},        // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_es, token_s}, // →
+			messagePattern{token_e, token_ee},          // ←
+			messagePattern{token_se},                   // →
+		},
+	},
+
+	/*
+		IK1:
+		  <- s
+		  ...
+		  -> e, s
+		  <- e, ee, se, es
+	*/
+	NoiseIK1: handshakePattern{
+		name: "IK1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{},        // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_s},                      // →
+			messagePattern{token_e, token_ee, token_se, token_es}, // ←
+		},
+	},
+
+	/*
+		I1K1:
+		  <- s
+		  ...
+		  -> e, s
+		  <- e, ee, es
+		  -> se
 	*/
-	NoiseNNpsk2: handshakePattern{
-		name: "NNpsk2",
+	NoiseI1K1: handshakePattern{
+		name: "I1K1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{},        // →
+			messagePattern{token_s}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_s},            // →
+			messagePattern{token_e, token_ee, token_es}, // ←
+			messagePattern{token_se},                    // →
+		},
+	},
+
+	/*
+		I1X:
+		  -> e, s
+		  <- e, ee, s, es
+		  -> se
+	*/
+	NoiseI1X: handshakePattern{
+		name: "I1X",
 		preMessagePatterns: []messagePattern{
 			messagePattern{}, // →
 			messagePattern{}, // ←
 		},
 		messagePatterns: []messagePattern{
-			messagePattern{token_e},                      // →
-			messagePattern{token_e, token_ee, token_psk}, // ←
+			messagePattern{token_e, token_s},                     // →
+			messagePattern{token_e, token_ee, token_s, token_es}, // ←
+			messagePattern{token_se},                             // →
 		},
 	},
+
+	/*
+		IX1:
+		  -> e, s
+		  <- e, ee, se, s
+		  -> es
+	*/
+	NoiseIX1: handshakePattern{
+		name: "IX1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_s},                     // →
+			messagePattern{token_e, token_ee, token_se, token_s}, // ←
+			messagePattern{token_es},                             // →
+		},
+	},
+
+	/*
+		I1X1:
+		  -> e, s
+		  <- e, ee, s
+		  -> se, es
+	*/
+	NoiseI1X1: handshakePattern{
+		name: "I1X1",
+		preMessagePatterns: []messagePattern{
+			messagePattern{}, // →
+			messagePattern{}, // ←
+		},
+		messagePatterns: []messagePattern{
+			messagePattern{token_e, token_s},           // →
+			messagePattern{token_e, token_ee, token_s}, // ←
+			messagePattern{token_se, token_es},         // →
+		},
+	},
+}
+
+// String returns the name of the handshake pattern with its modifiers (for example "IKpsk2")
+func (ht noiseHandshakeType) String() string {
+	pattern, err := getPattern(ht)
+	if err != nil {
+		return "unknown"
+	}
+	return pattern.name
+}
+
+// parseHandshakePattern parses a pattern name with its modifiers (for example "XXpsk0+psk3")
+func parseHandshakePattern(name string) (noiseHandshakeType, error) {
+	// the modifiers start at the first lowercase letter
+	idx := strings.IndexFunc(name, func(r rune) bool { return r >= 'a' && r <= 'z' })
+	if idx == -1 {
+		idx = len(name)
+	}
+	baseName, modifiers := name[:idx], name[idx:]
+
+	// base pattern
+	var handshakeType noiseHandshakeType
+	for patternType, pattern := range patterns {
+		if pattern.name == baseName {
+			handshakeType = patternType
+			break
+		}
+	}
+	if handshakeType == NoiseUnknown {
+		return NoiseUnknown, newError(ErrUnknownPattern, "disco: handshake pattern "+strconv.Quote(baseName)+" is not supported")
+	}
+
+	// modifiers
+	if modifiers != "" {
+		for _, modifier := range strings.Split(modifiers, "+") {
+			if modifier == "fallback" {
+				handshakeType |= NoiseFallback
+				continue
+			}
+			if modifier == "hfs" {
+				handshakeType |= NoiseHFS
+				continue
+			}
+			if !strings.HasPrefix(modifier, "psk") {
+				return NoiseUnknown, newError(ErrUnknownPattern, "disco: pattern modifier "+strconv.Quote(modifier)+" is not supported")
+			}
+			position, err := strconv.Atoi(modifier[len("psk"):])
+			if err != nil || position < 0 || position > maxPskModifier {
+				return NoiseUnknown, newError(ErrUnknownPattern, "disco: pattern modifier "+strconv.Quote(modifier)+" is not supported")
+			}
+			handshakeType |= NoisePSK0 << uint(position)
+		}
+	}
+
+	// validate the result
+	pattern, err := getPattern(handshakeType)
+	if err != nil {
+		return NoiseUnknown, err
+	}
+	if pattern.name != name {
+		return NoiseUnknown, newError(ErrUnknownPattern, "disco: handshake pattern "+strconv.Quote(name)+" is not in canonical form (expected "+strconv.Quote(pattern.name)+")")
+	}
+
+	return handshakeType, nil
 }
@@ -3,6 +3,8 @@ package libdisco
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"testing"
 
 	"golang.org/x/crypto/ed25519"
@@ -21,6 +23,15 @@ func init() {
 	publicKeyVerifier = CreatePublicKeyVerifier(rootKey.publicKey)
 }
 
+// createProof returns the proof of publicKey signed by the root key of the tests
+func createProof(publicKey []byte) []byte {
+	proof, err := CreateStaticPublicKeyProof(rootKey.privateKey, publicKey)
+	if err != nil {
+		panic(err)
+	}
+	return proof
+}
+
 func TestNoiseKK(t *testing.T) {
 
 	// init
@@ -156,14 +167,14 @@ func TestNoiseXX(t *testing.T) {
 		KeyPair:              clientKeyPair,
 		HandshakePattern:     NoiseXX,
 		PublicKeyVerifier:    publicKeyVerifier,
-		StaticPublicKeyProof: CreateStaticPublicKeyProof(rootKey.privateKey, clientKeyPair.PublicKey[:]),
+		StaticPublicKeyProof: createProof(clientKeyPair.PublicKey[:]),
 	}
 	serverKeyPair := GenerateKeypair(nil)
 	serverConfig := Config{
 		KeyPair:              serverKeyPair,
 		HandshakePattern:     NoiseXX,
 		PublicKeyVerifier:    publicKeyVerifier,
-		StaticPublicKeyProof: CreateStaticPublicKeyProof(rootKey.privateKey, serverKeyPair.PublicKey[:]),
+		StaticPublicKeyProof: createProof(serverKeyPair.PublicKey[:]),
 	}
 
 	// get a Noise.listener
@@ -267,3 +278,554 @@ func TestNoiseN(t *testing.T) {
 		t.Fatal("client can't write on socket")
 	}
 }
+
+// testHelloCaVa runs a server with serverConfig, connects a client with
+// clientConfig and exchanges a message in each direction.
+func testHelloCaVa(t *testing.T, clientConfig, serverConfig *Config) {
+	// get a Noise.listener
+	listener, err := Listen("tcp", "127.0.0.1:0", serverConfig) // port 0 will find out a free port
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+	addr := listener.Addr().String()
+
+	// run the server and Accept one connection
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		serverSocket, err := listener.Accept()
+		if err != nil {
+			t.Error("a server cannot accept()")
+			return
+		}
+		defer serverSocket.Close()
+		var buf [100]byte
+		n, err := serverSocket.Read(buf[:])
+		if err != nil {
+			t.Error("server can't read on socket", err)
+			return
+		}
+		if !bytes.Equal(buf[:n], []byte("hello")) {
+			t.Error("client message failed")
+			return
+		}
+
+		if _, err = serverSocket.Write([]byte("ca va?")); err != nil {
+			t.Error("server can't write on socket", err)
+		}
+	}()
+
+	// Run the client
+	clientSocket, err := Dial("tcp", addr, clientConfig)
+	if err != nil {
+		t.Fatal("client can't connect to server", err)
+	}
+	defer clientSocket.Close()
+	_, err = clientSocket.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal("client can't write on socket", err)
+	}
+	var buf [100]byte
+	n, err := clientSocket.Read(buf[:])
+	if err != nil {
+		t.Fatal("client can't read server's answer", err)
+	}
+	if !bytes.Equal(buf[:n], []byte("ca va?")) {
+		t.Fatal("server message failed")
+	}
+	<-serverDone
+}
+
+func TestNoiseNN(t *testing.T) {
+	clientConfig := Config{
+		HandshakePattern: NoiseNN,
+	}
+	serverConfig := Config{
+		HandshakePattern: NoiseNN,
+	}
+
+	testHelloCaVa(t, &clientConfig, &serverConfig)
+}
+
+func TestNoiseKN(t *testing.T) {
+	clientConfig := Config{
+		KeyPair:          GenerateKeypair(nil),
+		HandshakePattern: NoiseKN,
+	}
+	serverConfig := Config{
+		HandshakePattern: NoiseKN,
+		RemoteKey:        clientConfig.KeyPair.PublicKey[:],
+	}
+
+	testHelloCaVa(t, &clientConfig, &serverConfig)
+}
+
+func TestNoiseXN(t *testing.T) {
+	clientKeyPair := GenerateKeypair(nil)
+	clientConfig := Config{
+		KeyPair:              clientKeyPair,
+		HandshakePattern:     NoiseXN,
+		StaticPublicKeyProof: createProof(clientKeyPair.PublicKey[:]),
+	}
+	serverConfig := Config{
+		HandshakePattern:  NoiseXN,
+		PublicKeyVerifier: publicKeyVerifier,
+	}
+
+	testHelloCaVa(t, &clientConfig, &serverConfig)
+}
+
+func TestNoiseIN(t *testing.T) {
+	clientKeyPair := GenerateKeypair(nil)
+	clientConfig := Config{
+		KeyPair:              clientKeyPair,
+		HandshakePattern:     NoiseIN,
+		StaticPublicKeyProof: createProof(clientKeyPair.PublicKey[:]),
+	}
+	serverConfig := Config{
+		HandshakePattern:  NoiseIN,
+		PublicKeyVerifier: publicKeyVerifier,
+	}
+
+	testHelloCaVa(t, &clientConfig, &serverConfig)
+}
+
+func TestNoiseINBadProof(t *testing.T) {
+	clientConfig := Config{
+		KeyPair:              GenerateKeypair(nil),
+		HandshakePattern:     NoiseIN,
+		StaticPublicKeyProof: []byte("not a proof"),
+	}
+	serverConfig := Config{
+		HandshakePattern:  NoiseIN,
+		PublicKeyVerifier: publicKeyVerifier,
+	}
+
+	listener, err := Listen("tcp", "127.0.0.1:0", &serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverSocket, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer serverSocket.Close()
+		serverErr <- serverSocket.(*Conn).Handshake()
+	}()
+
+	clientSocket, err := Dial("tcp", listener.Addr().String(), &clientConfig)
+	if err != nil {
+		t.Fatal("client can't connect to server", err)
+	}
+	defer clientSocket.Close()
+
+	if err := <-serverErr; err == nil {
+		t.Fatal("server accepted a client static key with an invalid proof")
+	}
+}
+
+func TestPSKModifiers(t *testing.T) {
+	testVectors := []struct {
+		handshakeType noiseHandshakeType
+		name          string
+		valid         bool
+	}{
+		{NoiseNNpsk2, "NNpsk2", true},
+		{NoiseNN | NoisePSK0, "NNpsk0", true},
+		{NoiseNN | NoisePSK0 | NoisePSK2, "NNpsk0+psk2", true},
+		{NoiseXX | NoisePSK3, "XXpsk3", true},
+		{NoiseIK | NoisePSK2, "IKpsk2", true},
+		{NoiseX | NoisePSK1, "Xpsk1", true},
+		{NoiseN | NoisePSK2, "", false},
+		{NoiseIK | NoisePSK3, "", false},
+		{NoiseUnknown | NoisePSK0, "", false},
+	}
+
+	for _, testVector := range testVectors {
+		pattern, err := getPattern(testVector.handshakeType)
+		if !testVector.valid {
+			if err == nil {
+				t.Fatal("invalid pattern accepted", testVector.handshakeType)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal("valid pattern rejected", testVector.name, err)
+		}
+		if pattern.name != testVector.name {
+			t.Fatal("expected pattern name", testVector.name, "got", pattern.name)
+		}
+	}
+
+	// modifiers must not modify the base patterns
+	getPattern(NoiseXX | NoisePSK0 | NoisePSK3)
+	for _, message := range patterns[NoiseXX].messagePatterns {
+		for _, token := range message {
+			if token == token_psk {
+				t.Fatal("the base pattern was modified")
+			}
+		}
+	}
+}
+
+func TestNoiseXXpsk3(t *testing.T) {
+	psk := make([]byte, 32)
+	rand.Read(psk)
+
+	clientKeyPair := GenerateKeypair(nil)
+	clientConfig := Config{
+		KeyPair:              clientKeyPair,
+		HandshakePattern:     NoiseXX | NoisePSK3,
+		PublicKeyVerifier:    publicKeyVerifier,
+		StaticPublicKeyProof: createProof(clientKeyPair.PublicKey[:]),
+		PreSharedKey:         psk,
+	}
+	serverKeyPair := GenerateKeypair(nil)
+	serverConfig := Config{
+		KeyPair:              serverKeyPair,
+		HandshakePattern:     NoiseXX | NoisePSK3,
+		PublicKeyVerifier:    publicKeyVerifier,
+		StaticPublicKeyProof: createProof(serverKeyPair.PublicKey[:]),
+		PreSharedKey:         psk,
+	}
+
+	testHelloCaVa(t, &clientConfig, &serverConfig)
+}
+
+func TestNoiseIKpsk2(t *testing.T) {
+	psk := make([]byte, 32)
+	rand.Read(psk)
+
+	clientKeyPair := GenerateKeypair(nil)
+	serverConfig := Config{
+		KeyPair:           GenerateKeypair(nil),
+		HandshakePattern:  NoiseIK | NoisePSK2,
+		PublicKeyVerifier: publicKeyVerifier,
+		PreSharedKey:      psk,
+	}
+	clientConfig := Config{
+		KeyPair:              clientKeyPair,
+		HandshakePattern:     NoiseIK | NoisePSK2,
+		RemoteKey:            serverConfig.KeyPair.PublicKey[:],
+		StaticPublicKeyProof: createProof(clientKeyPair.PublicKey[:]),
+		PreSharedKey:         psk,
+	}
+
+	testHelloCaVa(t, &clientConfig, &serverConfig)
+}
+
+func TestNoiseNNpsk0WrongKey(t *testing.T) {
+	clientPsk := make([]byte, 32)
+	rand.Read(clientPsk)
+	serverPsk := make([]byte, 32)
+	rand.Read(serverPsk)
+
+	clientConfig := Config{
+		HandshakePattern: NoiseNN | NoisePSK0,
+		PreSharedKey:     clientPsk,
+	}
+	serverConfig := Config{
+		HandshakePattern: NoiseNN | NoisePSK0,
+		PreSharedKey:     serverPsk,
+	}
+
+	listener, err := Listen("tcp", "127.0.0.1:0", &serverConfig)
+	if err != nil {
+		t.Fatal("cannot setup a listener on localhost:", err)
+	}
+	defer listener.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverSocket, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer serverSocket.Close()
+		serverErr <- serverSocket.(*Conn).Handshake()
+	}()
+
+	clientSocket, err := Dial("tcp", listener.Addr().String(), &clientConfig)
+	if err == nil {
+		clientSocket.Close()
+		t.Fatal("client completed a handshake with the wrong pre-shared key")
+	}
+	if err := <-serverErr; err == nil {
+		t.Fatal("server completed a handshake with the wrong pre-shared key")
+	}
+}
+
+func TestPSKRequirements(t *testing.T) {
+	config := Config{
+		HandshakePattern: NoiseNK | NoisePSK2,
+		KeyPair:          GenerateKeypair(nil),
+	}
+	if err := checkRequirements(false, &config); err == nil {
+		t.Fatal("a psk pattern was accepted without a pre-shared key")
+	}
+	config.PreSharedKey = make([]byte, 32)
+	if err := checkRequirements(false, &config); err != nil {
+		t.Fatal("a psk pattern was rejected with a valid pre-shared key", err)
+	}
+}
+
+func TestFallbackModifier(t *testing.T) {
+	pattern, err := getPattern(NoiseXX | NoiseFallback)
+	if err != nil {
+		t.Fatal("XXfallback should be a valid pattern", err)
+	}
+	if pattern.name != "XXfallback" || !pattern.fallback || len(pattern.messagePatterns) != 2 {
+		t.Fatal("XXfallback was not built correctly")
+	}
+	if len(pattern.preMessagePatterns[0]) != 1 || pattern.preMessagePatterns[0][0] != token_e {
+		t.Fatal("XXfallback should have an ephemeral key in the initiator pre-message")
+	}
+	// the first message of IK contains DH operations
+	if _, err := getPattern(NoiseIK | NoiseFallback); err == nil {
+		t.Fatal("IKfallback should not be a valid pattern")
+	}
+	// one-way patterns can't be converted
+	if _, err := getPattern(NoiseN | NoiseFallback); err == nil {
+		t.Fatal("Nfallback should not be a valid pattern")
+	}
+	if name := (NoiseXX | NoiseFallback | NoisePSK0).String(); name != "XXfallback+psk0" {
+		t.Fatal("unexpected name for XXfallback+psk0", name)
+	}
+}
+
+func TestHFSModifier(t *testing.T) {
+	for _, testVector := range []struct {
+		handshakeType noiseHandshakeType
+		name          string
+		messages      []messagePattern
+	}{
+		{NoiseXXhfs, "XXhfs", []messagePattern{
+			{token_e, token_e1},
+			{token_e, token_ee, token_ekem1, token_s, token_es},
+			{token_s, token_se},
+		}},
+		{NoiseIKhfs, "IKhfs", []messagePattern{
+			{token_e, token_es, token_e1, token_s, token_ss},
+			{token_e, token_ee, token_ekem1, token_se},
+		}},
+		{NoiseXX | NoiseHFS | NoisePSK3, "XXhfs+psk3", []messagePattern{
+			{token_e, token_e1},
+			{token_e, token_ee, token_ekem1, token_s, token_es},
+			{token_s, token_se, token_psk},
+		}},
+	} {
+		pattern, err := getPattern(testVector.handshakeType)
+		if err != nil {
+			t.Fatal("valid pattern rejected", testVector.name, err)
+		}
+		if pattern.name != testVector.name || !pattern.hfs || len(pattern.messagePatterns) != len(testVector.messages) {
+			t.Fatal(testVector.name, "was not built correctly")
+		}
+		for idx, message := range testVector.messages {
+			if len(message) != len(pattern.messagePatterns[idx]) {
+				t.Fatal(testVector.name, "was not built correctly")
+			}
+			for position, token := range message {
+				if pattern.messagePatterns[idx][position] != token {
+					t.Fatal(testVector.name, "was not built correctly")
+				}
+			}
+		}
+	}
+	// the modifier needs an ee DH
+	for _, handshakeType := range []noiseHandshakeType{NoiseN | NoiseHFS, NoiseX | NoiseHFS, NoiseXX | NoiseFallback | NoiseHFS} {
+		if _, err := getPattern(handshakeType); err == nil {
+			t.Fatal("invalid pattern accepted", handshakeType)
+		}
+	}
+}
+
+func TestNoiseXXhfs(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseXXhfs)
+	testHelloCaVa(t, clientConfig, serverConfig)
+
+	// a recovered state needs the ML-KEM keys used by the next messages
+	initiator, _ := Initialize(NoiseXXhfs, true, nil, clientConfig.KeyPair, nil, nil, nil, nil)
+	responder, _ := Initialize(NoiseXXhfs, false, nil, serverConfig.KeyPair, nil, nil, nil, nil)
+	var message, payload []byte
+	if _, _, err := initiator.WriteMessage(nil, &message); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := responder.ReadMessage(message, &payload); err != nil {
+		t.Fatal(err)
+	}
+	serialized := responder.Serialize()
+	if _, err := RecoverState(serialized, nil, serverConfig.KeyPair); err != nil {
+		t.Fatal("cannot recover the state", err)
+	}
+	// remove the ML-KEM public key of the initiator, the last of the length-prefixed keys
+	offset := 0
+	for i := 0; i < 7; i++ {
+		offset += 2 + int(binary.BigEndian.Uint16(serialized[offset:]))
+	}
+	withoutKey := append(append([]byte{}, serialized[:offset]...), 0, 0)
+	withoutKey = append(withoutKey, serialized[offset+2+int(binary.BigEndian.Uint16(serialized[offset:])):]...)
+	if _, err := RecoverState(withoutKey, nil, serverConfig.KeyPair); !errors.Is(err, ErrMalformedState) {
+		t.Fatal("expected ErrMalformedState", err)
+	}
+}
+
+func TestNoiseIKhfs(t *testing.T) {
+	clientConfig, serverConfig := configsForPattern(NoiseIKhfs)
+	clientConfig.CipherSuite = CipherSuite{Cipher: CipherChaChaPoly, Hash: HashSHA256}
+	serverConfig.CipherSuite = clientConfig.CipherSuite
+	testHelloCaVa(t, clientConfig, serverConfig)
+
+	// the ML-KEM keys are kept in serialized states
+	initiator, _ := Initialize(NoiseIKhfs, true, nil, clientConfig.KeyPair, nil, serverConfig.KeyPair, nil, nil)
+	responder, _ := Initialize(NoiseIKhfs, false, nil, serverConfig.KeyPair, nil, nil, nil, nil)
+	var message, payload []byte
+	if _, _, err := initiator.WriteMessage(nil, &message); err != nil {
+		t.Fatal(err)
+	}
+	initiator, err := RecoverState(initiator.Serialize(), nil, clientConfig.KeyPair)
+	if err != nil {
+		t.Fatal("cannot recover the state", err)
+	}
+	if _, _, err := responder.ReadMessage(message, &payload); err != nil {
+		t.Fatal(err)
+	}
+	message = message[:0]
+	responderCipher, _, err := responder.WriteMessage(nil, &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initiatorCipher, _, err := initiator.ReadMessage(message, &payload)
+	if err != nil {
+		t.Fatal("cannot read the encapsulation with a recovered state", err)
+	}
+	if plaintext, err := responderCipher.Decrypt(initiatorCipher.Encrypt([]byte("hello"))); err != nil || string(plaintext) != "hello" {
+		t.Fatal("cannot decrypt", err)
+	}
+}
+
+func TestNoisePipes(t *testing.T) {
+	serverKeyPair := GenerateKeypair(nil)
+	serverConfig := Config{
+		KeyPair:              serverKeyPair,
+		HandshakePattern:     NoiseIK,
+		NoisePipes:           true,
+		PublicKeyVerifier:    publicKeyVerifier,
+		StaticPublicKeyProof: createProof(serverKeyPair.PublicKey[:]),
+	}
+
+	var cachedKey []byte
+	clientKeyPair := GenerateKeypair(nil)
+	clientConfig := Config{
+		KeyPair:              clientKeyPair,
+		HandshakePattern:     NoiseIK,
+		NoisePipes:           true,
+		PublicKeyVerifier:    publicKeyVerifier,
+		StaticPublicKeyProof: createProof(clientKeyPair.PublicKey[:]),
+		RemoteKeyUpdated: func(publicKey []byte) {
+			cachedKey = publicKey
+		},
+	}
+
+	// first connection: the client doesn't know the server's key (XX)
+	testHelloCaVa(t, &clientConfig, &serverConfig)
+	if !bytes.Equal(cachedKey, serverKeyPair.PublicKey[:]) {
+		t.Fatal("the client did not learn the server's static key")
+	}
+
+	// second connection: the client uses the cached key (IK)
+	clientConfig.RemoteKey = cachedKey
+	cachedKey = nil
+	testHelloCaVa(t, &clientConfig, &serverConfig)
+	if cachedKey != nil {
+		t.Fatal("the client should not have learned a new key")
+	}
+
+	// third connection: the server rotated its key (IK then XXfallback)
+	newServerKeyPair := GenerateKeypair(nil)
+	serverConfig.KeyPair = newServerKeyPair
+	serverConfig.StaticPublicKeyProof = createProof(newServerKeyPair.PublicKey[:])
+	testHelloCaVa(t, &clientConfig, &serverConfig)
+	if !bytes.Equal(cachedKey, newServerKeyPair.PublicKey[:]) {
+		t.Fatal("the client did not learn the server's new static key")
+	}
+}
+
+// configsForPattern returns a client and a server configuration with
+// all the keys, proofs and verifiers that the pattern could require
+func configsForPattern(handshakeType noiseHandshakeType) (clientConfig, serverConfig *Config) {
+	clientKeyPair := GenerateKeypair(nil)
+	serverKeyPair := GenerateKeypair(nil)
+	clientConfig = &Config{
+		KeyPair:              clientKeyPair,
+		HandshakePattern:     handshakeType,
+		PublicKeyVerifier:    publicKeyVerifier,
+		StaticPublicKeyProof: createProof(clientKeyPair.PublicKey[:]),
+	}
+	serverConfig = &Config{
+		KeyPair:              serverKeyPair,
+		HandshakePattern:     handshakeType,
+		PublicKeyVerifier:    publicKeyVerifier,
+		StaticPublicKeyProof: createProof(serverKeyPair.PublicKey[:]),
+	}
+	pattern, _ := getPattern(handshakeType)
+	if len(pattern.preMessagePatterns[0]) > 0 {
+		serverConfig.RemoteKey = clientKeyPair.PublicKey[:]
+	}
+	if len(pattern.preMessagePatterns[1]) > 0 {
+		clientConfig.RemoteKey = serverKeyPair.PublicKey[:]
+	}
+	if handshakeType.hasPSK() {
+		psk := make([]byte, 32)
+		rand.Read(psk)
+		clientConfig.PreSharedKey = psk
+		serverConfig.PreSharedKey = psk
+	}
+	return
+}
+
+func TestDeferredPatterns(t *testing.T) {
+	deferredPatterns := []noiseHandshakeType{
+		NoiseNK1, NoiseNX1, NoiseX1N, NoiseX1K, NoiseXK1, NoiseX1K1, NoiseX1X, NoiseXX1,
+		NoiseX1X1, NoiseK1N, NoiseK1K, NoiseKK1, NoiseK1K1, NoiseK1X, NoiseKX1, NoiseK1X1,
+		NoiseI1N, NoiseI1K, NoiseIK1, NoiseI1K1, NoiseI1X, NoiseIX1, NoiseI1X1,
+	}
+
+	for _, handshakeType := range deferredPatterns {
+		t.Run(handshakeType.String(), func(t *testing.T) {
+			clientConfig, serverConfig := configsForPattern(handshakeType)
+			testHelloCaVa(t, clientConfig, serverConfig)
+		})
+	}
+
+	// modifiers also apply to deferred patterns
+	t.Run("X1X1psk3", func(t *testing.T) {
+		clientConfig, serverConfig := configsForPattern(NoiseX1X1 | NoisePSK3)
+		testHelloCaVa(t, clientConfig, serverConfig)
+	})
+}
+
+func TestDeferredPatternsRequirements(t *testing.T) {
+	// the server sends its static key in X1X, the client must verify it
+	if err := checkRequirements(true, &Config{HandshakePattern: NoiseX1X, StaticPublicKeyProof: []byte{}}); err != ErrNoVerifier {
+		t.Fatal("a X1X client should require a public key verifier")
+	}
+	// the client sends its static key in I1K, the server must verify it
+	if err := checkRequirements(false, &Config{HandshakePattern: NoiseI1K}); err != ErrNoVerifier {
+		t.Fatal("a I1K server should require a public key verifier")
+	}
+	// no static keys are transmitted in K1K1
+	if err := checkRequirements(false, &Config{HandshakePattern: NoiseK1K1}); err != nil {
+		t.Fatal("a K1K1 server should not require a proof or a verifier")
+	}
+	if _, err := ParseProtocolName("Noise_X1X1psk3_25519_STROBEv1.0.2"); err != nil {
+		t.Fatal("deferred pattern names should be parsed", err)
+	}
+}
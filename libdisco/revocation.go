@@ -0,0 +1,200 @@
+package libdisco
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+//
+// Revocation
+//
+
+// A static key signed by a root key (see CreateStaticPublicKeyProof) can be
+// revoked by listing it in a revocation list signed by the same root key.
+// Every new list has a higher number than the previous one so that a peer
+// cannot be made to go back to an older list.
+
+// revocationListVersion is the first byte of an encoded revocation list
+const revocationListVersion = 1
+
+// revocationListContext is prepended to the signed part of a revocation list
+const revocationListContext = "DiscoRevocationList"
+
+// RevocationList is a list of revoked static public keys
+type RevocationList struct {
+	// the number of the list, incremented every time a new list is issued
+	Number uint64
+	// the time at which the list was issued
+	IssuedAt time.Time
+	// the revoked public keys
+	RevokedKeys [][]byte
+
+	revoked map[string]bool
+}
+
+// CreateRevocationList signs a revocation list with the root key that signed
+// the proofs of the revoked keys, and returns it in its encoded form. number
+// must be higher than the number of the previous list.
+func CreateRevocationList(rootPrivateKey ed25519.PrivateKey, number uint64, revokedKeys [][]byte) ([]byte, error) {
+	if len(rootPrivateKey) != ed25519.PrivateKeySize {
+		return nil, newError(ErrInvalidKey, "disco: the root private key should be an ed25519 private key")
+	}
+
+	// [version(1), number(8), issuedAt(8), numKeys(4), keys, signature]
+	// where the keys are preceded by their 2-byte length
+	list := make([]byte, 21)
+	list[0] = revocationListVersion
+	binary.BigEndian.PutUint64(list[1:9], number)
+	binary.BigEndian.PutUint64(list[9:17], uint64(time.Now().Unix()))
+	binary.BigEndian.PutUint32(list[17:21], uint32(len(revokedKeys)))
+	for _, publicKey := range revokedKeys {
+		if !isPublicKeySize(len(publicKey)) {
+			return nil, newError(ErrInvalidKey, "disco: the revoked keys should be static public keys")
+		}
+		list = appendField(list, publicKey)
+	}
+	signature := ed25519.Sign(rootPrivateKey, append([]byte(revocationListContext), list...))
+	return append(list, signature...), nil
+}
+
+// ParseRevocationList verifies that a revocation list created by
+// CreateRevocationList is signed by rootPublicKey, and parses it.
+func ParseRevocationList(rootPublicKey ed25519.PublicKey, data []byte) (*RevocationList, error) {
+	malformed := newError(ErrInvalidRevocationList, "disco: the revocation list is malformed")
+	if len(data) < 21+ed25519.SignatureSize || data[0] != revocationListVersion {
+		return nil, malformed
+	}
+	signed, signature := data[:len(data)-ed25519.SignatureSize], data[len(data)-ed25519.SignatureSize:]
+	if len(rootPublicKey) != ed25519.PublicKeySize ||
+		!ed25519.Verify(rootPublicKey, append([]byte(revocationListContext), signed...), signature) {
+		return nil, newError(ErrInvalidRevocationList, "disco: the revocation list is not signed by the root key")
+	}
+
+	list := &RevocationList{
+		Number:   binary.BigEndian.Uint64(signed[1:9]),
+		IssuedAt: time.Unix(int64(binary.BigEndian.Uint64(signed[9:17])), 0),
+		revoked:  make(map[string]bool),
+	}
+	numKeys := binary.BigEndian.Uint32(signed[17:21])
+	rest := signed[21:]
+	for i := uint32(0); i < numKeys; i++ {
+		if len(rest) < 2 || len(rest) < 2+int(binary.BigEndian.Uint16(rest)) {
+			return nil, malformed
+		}
+		length := 2 + int(binary.BigEndian.Uint16(rest))
+		publicKey := append([]byte(nil), rest[2:length]...)
+		list.RevokedKeys = append(list.RevokedKeys, publicKey)
+		list.revoked[string(publicKey)] = true
+		rest = rest[length:]
+	}
+	if len(rest) != 0 {
+		return nil, malformed
+	}
+	return list, nil
+}
+
+// IsRevoked returns true if publicKey is in the list
+func (list *RevocationList) IsRevoked(publicKey []byte) bool {
+	return list.revoked[string(publicKey)]
+}
+
+// RevocationChecker holds the latest revocation list signed by a root key,
+// loaded from a file and reloaded on demand, so that keys can be revoked
+// without restarting the peers. It is safe for concurrent use.
+type RevocationChecker struct {
+	rootPublicKey ed25519.PublicKey
+	file          string
+
+	lock sync.RWMutex
+	list *RevocationList
+}
+
+// NewRevocationChecker loads a revocation list signed by rootPublicKey, in
+// hexadecimal form, from file. file can be empty if the lists are passed to
+// Update instead, no key is then revoked until the first update.
+func NewRevocationChecker(rootPublicKey ed25519.PublicKey, file string) (*RevocationChecker, error) {
+	checker := &RevocationChecker{rootPublicKey: rootPublicKey, file: file}
+	if file == "" {
+		checker.list = &RevocationList{revoked: make(map[string]bool)}
+		return checker, nil
+	}
+	if err := checker.Reload(); err != nil {
+		return nil, err
+	}
+	return checker, nil
+}
+
+// Reload reads the revocation list from its file again (see Update).
+func (r *RevocationChecker) Reload() error {
+	hexList, err := ioutil.ReadFile(r.file)
+	if err != nil {
+		return err
+	}
+	data, err := hex.DecodeString(string(bytes.TrimSpace(hexList)))
+	if err != nil {
+		return newError(ErrInvalidRevocationList, "disco: the revocation list is not in hexadecimal form")
+	}
+	return r.Update(data)
+}
+
+// Update replaces the current revocation list with data, a list created by
+// CreateRevocationList. If data is not signed by the root key, or if its
+// number is lower than the one of the current list, the current list is kept
+// and an error is returned.
+func (r *RevocationChecker) Update(data []byte) error {
+	list, err := ParseRevocationList(r.rootPublicKey, data)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.list != nil && list.Number < r.list.Number {
+		return newError(ErrInvalidRevocationList, "disco: the revocation list is older than the current one")
+	}
+	r.list = list
+	return nil
+}
+
+// RevocationList returns the revocation list that was last loaded.
+func (r *RevocationChecker) RevocationList() *RevocationList {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.list
+}
+
+// IsRevoked returns true if publicKey is in the revocation list that was last loaded.
+func (r *RevocationChecker) IsRevoked(publicKey []byte) bool {
+	return r.RevocationList().IsRevoked(publicKey)
+}
+
+// ReloadOnSignal reloads the revocation list every time one of the signals
+// is received by the process (for example syscall.SIGHUP), until stop is
+// called. Errors are ignored and the current list is then kept, call Reload
+// directly to handle them.
+func (r *RevocationChecker) ReloadOnSignal(signals ...os.Signal) (stop func()) {
+	return reloadOnSignal(r.Reload, signals...)
+}
+
+// CreatePublicKeyVerifierWithRevocation returns a VerifyPublicKey callback
+// (see Config) that works like CreatePublicKeyVerifier, but also rejects the
+// public keys revoked by the current list of checker. The handshake then fails
+// with an error matching ErrKeyRevoked, or ErrAuthFailed if the proof is invalid.
+func CreatePublicKeyVerifierWithRevocation(rootPublicKey ed25519.PublicKey, checker *RevocationChecker) func([]byte, []byte) error {
+	verifier := CreatePublicKeyVerifier(rootPublicKey)
+	return func(publicKey, proof []byte) error {
+		if !verifier(publicKey, proof) {
+			return newError(ErrAuthFailed, "disco: the static public key is not signed by the root key")
+		}
+		if checker.IsRevoked(publicKey) {
+			return newError(ErrKeyRevoked, "disco: the static public key is in the revocation list")
+		}
+		return nil
+	}
+}
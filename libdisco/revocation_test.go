@@ -0,0 +1,110 @@
+package libdisco
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// saveRevocationList signs a revocation list with the root key and saves it in file
+func saveRevocationList(t *testing.T, file string, number uint64, revokedKeys ...[]byte) []byte {
+	list, err := CreateRevocationList(rootKey.privateKey, number, revokedKeys)
+	if err != nil {
+		t.Fatal("cannot create the revocation list", err)
+	}
+	if err := ioutil.WriteFile(file, []byte(hex.EncodeToString(list)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestRevocationList(t *testing.T) {
+	revoked, notRevoked := GenerateKeypair(nil), GenerateKeypair(nil)
+	data, err := CreateRevocationList(rootKey.privateKey, 7, [][]byte{revoked.PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := ParseRevocationList(rootKey.publicKey, data)
+	if err != nil {
+		t.Fatal("cannot parse the revocation list", err)
+	}
+	if list.Number != 7 || len(list.RevokedKeys) != 1 || !list.IsRevoked(revoked.PublicKey) || list.IsRevoked(notRevoked.PublicKey) {
+		t.Fatal("unexpected revocation list", list)
+	}
+
+	otherRoot, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := ParseRevocationList(otherRoot, data); !errors.Is(err, ErrInvalidRevocationList) {
+		t.Fatal("a list signed by another root key should be rejected", err)
+	}
+	data[10] ^= 1
+	if _, err := ParseRevocationList(rootKey.publicKey, data); !errors.Is(err, ErrInvalidRevocationList) {
+		t.Fatal("a modified list should be rejected", err)
+	}
+	if _, err := ParseRevocationList(rootKey.publicKey, data[:20]); !errors.Is(err, ErrInvalidRevocationList) {
+		t.Fatal("a truncated list should be rejected", err)
+	}
+	if _, err := CreateRevocationList(rootKey.privateKey, 8, [][]byte{{1, 2, 3}}); !errors.Is(err, ErrInvalidKey) {
+		t.Fatal("only static public keys can be revoked", err)
+	}
+}
+
+func TestRevocationChecker(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "revocations")
+	saveRevocationList(t, file, 1)
+	checker, err := NewRevocationChecker(rootKey.publicKey, file)
+	if err != nil {
+		t.Fatal("cannot load the revocation list", err)
+	}
+	clientConfig, serverConfig := configsForPattern(NoiseNX)
+	clientConfig.PublicKeyVerifier = nil
+	clientConfig.VerifyPublicKey = CreatePublicKeyVerifierWithRevocation(rootKey.publicKey, checker)
+
+	client, server, clientErr, serverErr := connPair(clientConfig, serverConfig)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal("the handshake failed", clientErr, serverErr)
+	}
+	go func() {
+		// wait for the client to close the connection
+		server.Read(make([]byte, 1))
+	}()
+	client.Close()
+
+	// revoke the key of the server
+	saveRevocationList(t, file, 2, serverConfig.KeyPair.PublicKey)
+	if err := checker.Reload(); err != nil {
+		t.Fatal("cannot reload the revocation list", err)
+	}
+	if !checker.IsRevoked(serverConfig.KeyPair.PublicKey) {
+		t.Fatal("the key of the server should be revoked")
+	}
+	if _, _, clientErr, _ := connPair(clientConfig, serverConfig); !errors.Is(clientErr, ErrKeyRevoked) {
+		t.Fatal("a revoked key should not be authenticated", clientErr)
+	}
+
+	// older lists are not loaded
+	older := saveRevocationList(t, file, 1)
+	if err := checker.Reload(); !errors.Is(err, ErrInvalidRevocationList) {
+		t.Fatal("an older list should not be loaded", err)
+	}
+	if err := checker.Update(older); !errors.Is(err, ErrInvalidRevocationList) {
+		t.Fatal("an older list should not be loaded", err)
+	}
+	if checker.RevocationList().Number != 2 {
+		t.Fatal("the current list should be kept")
+	}
+
+	// lists can be passed directly
+	checker, err = NewRevocationChecker(rootKey.publicKey, "")
+	if err != nil || checker.IsRevoked(serverConfig.KeyPair.PublicKey) {
+		t.Fatal("no key should be revoked without a list", err)
+	}
+	list, _ := CreateRevocationList(rootKey.privateKey, 3, [][]byte{serverConfig.KeyPair.PublicKey})
+	if err := checker.Update(list); err != nil || !checker.IsRevoked(serverConfig.KeyPair.PublicKey) {
+		t.Fatal("the list should be loaded", err)
+	}
+}